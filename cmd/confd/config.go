@@ -24,6 +24,7 @@ type BackendsConfig = backends.Config
 type Config struct {
 	TemplateConfig
 	BackendsConfig
+	AuditLogFile   string `toml:"audit-log"`
 	Interval       int    `toml:"interval"`
 	SRVDomain      string `toml:"srv_domain"`
 	SRVRecord      string `toml:"srv_record"`
@@ -32,32 +33,50 @@ type Config struct {
 	PrintVersion   bool
 	ConfigFile     string
 	OneTime        bool
+	Verify         bool
 	ClientInsecure bool
 }
 
 var config Config
 
 func init() {
+	flag.StringVar(&config.AuditLogFile, "audit-log", "", "file to append a JSON record of each target config sync to")
 	flag.StringVar(&config.AuthToken, "auth-token", "", "Auth bearer token to use")
+	flag.BoolVar(&config.CacheValues, "cache-values", false, "fetch keys shared by template resources once per run")
 	flag.StringVar(&config.Backend, "backend", "", "backend to use")
-	flag.BoolVar(&config.BasicAuth, "basic-auth", false, "Use Basic Auth to authenticate (only used with -backend=consul and -backend=etcd)")
+	flag.BoolVar(&config.BasicAuth, "basic-auth", false, "Use Basic Auth to authenticate (only used with -backend=consul, -backend=etcd and -backend=http)")
+	flag.BoolVar(&config.CheckInDryRun, "check-in-dry-run", false, "run the check commands against the staged configs in noop mode")
 	flag.StringVar(&config.ClientCaKeys, "client-ca-keys", "", "client ca keys")
 	flag.StringVar(&config.ClientCert, "client-cert", "", "the client cert")
 	flag.StringVar(&config.ClientKey, "client-key", "", "the client key")
 	flag.BoolVar(&config.ClientInsecure, "client-insecure", false, "Allow connections to SSL sites without certs (only used with -backend=etcd)")
 	flag.StringVar(&config.ConfDir, "confdir", "/etc/confd", "confd conf directory")
+	flag.Var(&config.ConfigDirs, "config-dir", "a directory of template resources searched after conf.d, overriding the resources of the same name")
 	flag.StringVar(&config.ConfigFile, "config-file", "/etc/confd/confd.toml", "the confd config file")
-	flag.Var(&config.YAMLFile, "file", "the YAML file to watch for changes (only used with -backend=file)")
+	flag.BoolVar(&config.EnableSprigAliases, "enable-sprig-aliases", false, "register the sprig names of template functions, such as upper or b64enc")
+	flag.StringVar(&config.EtcdVersion, "etcd-version", "v3", "the etcd API version to read from, v2 or v3 (only used with -backend=etcd)")
+	flag.Var(&config.YAMLFile, "file", "the YAML file to watch for changes (only used with -backend=file), or the .env file to read (only used with -backend=dotenv)")
 	flag.StringVar(&config.Filter, "filter", "*", "files filter (only used with -backend=file)")
+	flag.StringVar(&config.FooterTemplate, "footer-template", "", "a template appended to the output of every template resource")
+	flag.Var(&config.Headers, "header", "an HTTP header to send, as Name: value (only used with -backend=http)")
+	flag.StringVar(&config.HeaderTemplate, "header-template", "", "a template prepended to the output of every template resource")
 	flag.IntVar(&config.Interval, "interval", 600, "backend polling interval")
 	flag.BoolVar(&config.KeepStageFile, "keep-stage-file", false, "keep staged files")
 	flag.StringVar(&config.LogLevel, "log-level", "", "level which confd should log messages")
+	flag.Var(&config.MaskPatterns, "mask-pattern", "a regular expression whose matches are masked in the logged output of check and reload commands")
+	flag.IntVar(&config.MaxRenderDepth, "max-render-depth", 0, "how deeply templates may invoke templates before rendering fails (default 100)")
 	flag.Var(&config.BackendNodes, "node", "list of backend nodes")
 	flag.BoolVar(&config.Noop, "noop", false, "only show pending changes")
 	flag.BoolVar(&config.OneTime, "onetime", false, "run once and exit")
 	flag.StringVar(&config.Prefix, "prefix", "", "key path prefix")
 	flag.BoolVar(&config.PrintVersion, "version", false, "print version and exit")
+	flag.BoolVar(&config.RedactDestInLogs, "redact-dest-in-logs", false, "log a digest of the dest of template resources instead of their path")
+	flag.IntVar(&config.RefreshInterval, "refresh-interval", 0, "seconds during which fetched values are reused, and between requests in watch mode (only used with -backend=http)")
+	flag.DurationVar(&config.ReloadJitter, "reload-jitter", 0, "spread out the reload commands of a run by random delays of up to this duration")
+	flag.Var(&config.RequireKeys, "require-key", "a key which must exist in the backend before any template resource is processed")
+	flag.StringVar(&config.ResourceFilter, "resource-filter", "", "only process the template resources whose file name, dest or dest file name match this glob pattern")
 	flag.StringVar(&config.Scheme, "scheme", "http", "the backend URI scheme for nodes retrieved from DNS SRV records (http or https)")
+	flag.BoolVar(&config.SnapshotStore, "snapshot-store", false, "fetch the keys of all template resources at the start of a run so that they render the same store state")
 	flag.StringVar(&config.SRVDomain, "srv-domain", "", "the name of the resource record")
 	flag.StringVar(&config.SRVRecord, "srv-record", "", "the SRV record to search for backends nodes. Example: _etcd-client._tcp.example.com")
 	flag.BoolVar(&config.SyncOnly, "sync-only", false, "sync without check_cmd and reload_cmd")
@@ -68,10 +87,12 @@ func init() {
 	flag.StringVar(&config.SecretID, "secret-id", "", "Vault secret-id to use with the AppRole backend (only used with -backend=vault and auth-type=app-role)")
 	flag.StringVar(&config.Path, "path", "", "Vault mount path of the auth method (only used with -backend=vault)")
 	flag.StringVar(&config.Table, "table", "", "the name of the DynamoDB table (only used with -backend=dynamodb)")
-	flag.StringVar(&config.Separator, "separator", "", "the separator to replace '/' with when looking up keys in the backend, prefixed '/' will also be removed (only used with -backend=redis)")
-	flag.StringVar(&config.Username, "username", "", "the username to authenticate as (only used with vault and etcd backends)")
-	flag.StringVar(&config.Password, "password", "", "the password to authenticate with (only used with vault and etcd backends)")
+	flag.StringVar(&config.Separator, "separator", "", "the separator to replace '/' with when looking up keys in the backend, prefixed '/' will also be removed (only used with -backend=redis, -backend=gcp and -backend=azure)")
+	flag.StringVar(&config.Username, "username", "", "the username to authenticate as (only used with vault, etcd and http backends)")
+	flag.StringVar(&config.Password, "password", "", "the password to authenticate with (only used with vault, etcd and http backends)")
+	flag.BoolVar(&config.Verify, "verify", false, "report target configs out of sync with the backend, exit 1 on drift")
 	flag.BoolVar(&config.Watch, "watch", false, "enable watch support")
+	flag.BoolVar(&config.WatchConfDir, "watch-confdir", false, "reload template resources when their files change")
 }
 
 // initConfig initializes the confd configuration by first setting defaults,
@@ -148,7 +169,9 @@ func initConfig() error {
 
 	if config.Watch {
 		unsupportedBackends := map[string]bool{
+			"azure":    true,
 			"dynamodb": true,
+			"gcp":      true,
 			"ssm":      true,
 		}
 
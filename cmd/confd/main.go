@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
 	"syscall"
 
 	"github.com/abtreece/confd/pkg/backends"
@@ -14,7 +15,14 @@ import (
 )
 
 func main() {
-	flag.Parse()
+	// confd diff prints the changes processing would apply, and exits 1 if
+	// there are any.
+	diff := len(os.Args) > 1 && os.Args[1] == "diff"
+	if diff {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 	if config.PrintVersion {
 		fmt.Printf("confd %s (Git SHA: %s, Go Version: %s)\n", Version, GitSHA, runtime.Version())
 		os.Exit(0)
@@ -31,6 +39,46 @@ func main() {
 	}
 
 	config.TemplateConfig.StoreClient = storeClient
+	if config.AuditLogFile != "" {
+		f, err := os.OpenFile(config.AuditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		config.TemplateConfig.AuditLog = f
+	}
+	if config.Verify {
+		drifted, err := template.VerifyDrift(config.TemplateConfig)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		for _, dest := range drifted {
+			log.Warning("Target config " + dest + " out of sync")
+		}
+		if len(drifted) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if diff {
+		diffs, err := template.Diff(config.TemplateConfig)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		dests := make([]string, 0, len(diffs))
+		for dest := range diffs {
+			dests = append(dests, dest)
+		}
+		sort.Strings(dests)
+		for _, dest := range dests {
+			fmt.Print(diffs[dest])
+		}
+		if len(diffs) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if config.OneTime {
 		if err := template.Process(config.TemplateConfig); err != nil {
 			log.Fatal(err.Error())
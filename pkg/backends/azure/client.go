@@ -0,0 +1,230 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/abtreece/confd/pkg/log"
+)
+
+const (
+	keyVaultResource   = "https://vault.azure.net"
+	keyVaultAPIVersion = "7.4"
+	appConfigVersion   = "1.0"
+)
+
+// Client reads the secrets of a Key Vault and the key-values of an App
+// Configuration store.
+type Client struct {
+	client         *http.Client
+	cred           azcore.TokenCredential
+	keyVaultURL    string
+	appConfigURL   string
+	appConfigLabel string
+	separator      string
+}
+
+// apiError is the error body returned by Key Vault and App Configuration.
+type apiError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Detail string `json:"detail"`
+}
+
+// New returns a client for the Key Vault at AZURE_KEYVAULT_URL and the App
+// Configuration store at AZURE_APPCONFIG_URL. At least one of them is
+// required. Secret names are mapped to keys by replacing separator, "-" if
+// empty, with "/".
+func New(separator string) (*Client, error) {
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	cred, err := newCredential()
+	if err != nil {
+		return nil, err
+	}
+	c := newClient(httpClient, cred, separator)
+	c.keyVaultURL = strings.TrimSuffix(os.Getenv("AZURE_KEYVAULT_URL"), "/")
+	c.appConfigURL = strings.TrimSuffix(os.Getenv("AZURE_APPCONFIG_URL"), "/")
+	c.appConfigLabel = os.Getenv("AZURE_APPCONFIG_LABEL")
+	if c.keyVaultURL == "" && c.appConfigURL == "" {
+		return nil, errors.New("AZURE_KEYVAULT_URL or AZURE_APPCONFIG_URL is required")
+	}
+	log.Debug(fmt.Sprintf("Key Vault: %s, App Configuration: %s", c.keyVaultURL, c.appConfigURL))
+
+	// Fail early, if no credentials can be found
+	if _, err := c.token(context.Background(), c.resource()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newClient(httpClient *http.Client, cred azcore.TokenCredential, separator string) *Client {
+	if separator == "" {
+		separator = "-"
+	}
+	return &Client{
+		client:    httpClient,
+		cred:      cred,
+		separator: separator,
+	}
+}
+
+// resource returns a resource the client reads from, to check credentials.
+func (c *Client) resource() string {
+	if c.keyVaultURL != "" {
+		return keyVaultResource
+	}
+	return c.appConfigURL
+}
+
+// GetValues retrieves the values for the given keys. App Configuration
+// key-values are read first, so that secrets take precedence.
+func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	ctx := context.Background()
+	if c.appConfigURL != "" {
+		if err := c.getKeyValues(ctx, keys, vars); err != nil {
+			return vars, err
+		}
+	}
+	if c.keyVaultURL != "" {
+		if err := c.getSecrets(ctx, keys, vars); err != nil {
+			return vars, err
+		}
+	}
+	return vars, nil
+}
+
+// matchesAny reports whether k is one of keys or under one of them.
+func matchesAny(k string, keys []string) bool {
+	for _, key := range keys {
+		if k == key || strings.HasPrefix(k, strings.TrimSuffix(key, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// secretKey maps the secret ID to a key, so that the secret
+// myapp-database-url is the key /myapp/database/url.
+func (c *Client) secretKey(id string) string {
+	name := strings.TrimSuffix(id, "/")
+	name = name[strings.LastIndex(name, "/")+1:]
+	return path.Join("/", strings.ReplaceAll(name, c.separator, "/"))
+}
+
+// getSecrets adds the enabled Key Vault secrets matching keys to vars.
+func (c *Client) getSecrets(ctx context.Context, keys []string, vars map[string]string) error {
+	next := c.keyVaultURL + "/secrets?api-version=" + keyVaultAPIVersion
+	for next != "" {
+		var page struct {
+			Value []struct {
+				ID         string `json:"id"`
+				Attributes struct {
+					Enabled bool `json:"enabled"`
+				} `json:"attributes"`
+			} `json:"value"`
+			NextLink string `json:"nextLink"`
+		}
+		if _, err := c.get(ctx, keyVaultResource, next, &page); err != nil {
+			return err
+		}
+		for _, s := range page.Value {
+			k := c.secretKey(s.ID)
+			if !s.Attributes.Enabled || !matchesAny(k, keys) {
+				continue
+			}
+			log.Debug("Processing secret=%s", s.ID)
+			var secret struct {
+				Value string `json:"value"`
+			}
+			found, err := c.get(ctx, keyVaultResource, s.ID+"?api-version="+keyVaultAPIVersion, &secret)
+			if err != nil {
+				return err
+			}
+			if found {
+				vars[k] = secret.Value
+			}
+		}
+		next = page.NextLink
+	}
+	return nil
+}
+
+// getKeyValues adds the App Configuration key-values with the configured
+// label, matching keys, to vars. Keys are made absolute.
+func (c *Client) getKeyValues(ctx context.Context, keys []string, vars map[string]string) error {
+	query := url.Values{"key": {"*"}, "api-version": {appConfigVersion}}
+	if c.appConfigLabel != "" {
+		query.Set("label", c.appConfigLabel)
+	}
+	next := c.appConfigURL + "/kv?" + query.Encode()
+	for next != "" {
+		var page struct {
+			Items []struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			} `json:"items"`
+			NextLink string `json:"@nextLink"`
+		}
+		if _, err := c.get(ctx, c.appConfigURL, next, &page); err != nil {
+			return err
+		}
+		for _, kv := range page.Items {
+			k := path.Join("/", kv.Key)
+			if matchesAny(k, keys) {
+				vars[k] = kv.Value
+			}
+		}
+		next = page.NextLink
+		// App Configuration returns links relative to the store.
+		if strings.HasPrefix(next, "/") {
+			next = c.appConfigURL + next
+		}
+	}
+	return nil
+}
+
+// get decodes the response of an authorized GET request to u into out.
+// It returns false if the resource doesn't exist.
+func (c *Client) get(ctx context.Context, resource, u string, out interface{}) (bool, error) {
+	token, err := c.token(ctx, resource)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := &apiError{}
+		json.NewDecoder(resp.Body).Decode(e)
+		return false, fmt.Errorf("Azure request failed - %s %s%s", resp.Status, e.Error.Message, e.Detail)
+	}
+	return true, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// WatchPrefix is not implemented
+func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	<-stopChan
+	return 0, nil
+}
@@ -0,0 +1,137 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// fakeCredential is a TokenCredential returning a token named after the
+// requested scope, or err if set.
+type fakeCredential struct {
+	err error
+}
+
+func (f *fakeCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	if f.err != nil {
+		return azcore.AccessToken{}, f.err
+	}
+	if len(opts.Scopes) != 1 {
+		return azcore.AccessToken{}, fmt.Errorf("Expected one scope, got %v", opts.Scopes)
+	}
+	resource := strings.TrimSuffix(opts.Scopes[0], "/.default")
+	return azcore.AccessToken{Token: "token-for-" + resource, ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func newFakeAzure(t *testing.T) *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/secrets":
+			if r.Header.Get("Authorization") != "Bearer token-for-"+keyVaultResource {
+				t.Errorf("Unexpected authorization %q", r.Header.Get("Authorization"))
+			}
+			// Serve the secrets over two pages.
+			if r.URL.Query().Get("page") == "" {
+				w.Write([]byte(`{"value": [
+  {"id": "` + ts.URL + `/secrets/myapp-database-url", "attributes": {"enabled": true}},
+  {"id": "` + ts.URL + `/secrets/myapp-disabled", "attributes": {"enabled": false}}
+], "nextLink": "` + ts.URL + `/secrets?api-version=7.4&page=2"}`))
+				return
+			}
+			w.Write([]byte(`{"value": [
+  {"id": "` + ts.URL + `/secrets/myapp-database-user", "attributes": {"enabled": true}},
+  {"id": "` + ts.URL + `/secrets/other-name", "attributes": {"enabled": true}}
+], "nextLink": null}`))
+		case "/secrets/myapp-database-url":
+			w.Write([]byte(`{"value": "db.example.com"}`))
+		case "/secrets/myapp-database-user":
+			w.Write([]byte(`{"value": "rob"}`))
+		case "/kv":
+			if r.Header.Get("Authorization") != "Bearer token-for-"+ts.URL {
+				t.Errorf("Unexpected authorization %q", r.Header.Get("Authorization"))
+			}
+			if r.URL.Query().Get("label") != "prod" {
+				t.Errorf("Expected label filter prod, got %q", r.URL.Query().Get("label"))
+			}
+			if r.URL.Query().Get("after") == "" {
+				w.Write([]byte(`{"items": [
+  {"key": "myapp/database/url", "value": "overridden", "label": "prod"},
+  {"key": "myapp/port", "value": "5432", "label": "prod"}
+], "@nextLink": "/kv?key=*&label=prod&api-version=1.0&after=bXlhcHA"}`))
+				return
+			}
+			w.Write([]byte(`{"items": [
+  {"key": "/myapplication/name", "value": "other", "label": "prod"}
+]}`))
+		default:
+			t.Errorf("Unexpected request %s", r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": "SecretNotFound", "message": "not found"}}`))
+		}
+	}))
+	return ts
+}
+
+func TestGetValuesKeyVault(t *testing.T) {
+	ts := newFakeAzure(t)
+	defer ts.Close()
+
+	c := newClient(ts.Client(), &fakeCredential{}, "")
+	c.keyVaultURL = ts.URL
+	vars, err := c.GetValues([]string{"/myapp"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{
+		"/myapp/database/url":  "db.example.com",
+		"/myapp/database/user": "rob",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected %v, got %v", expected, vars)
+	}
+}
+
+func TestGetValuesAppConfiguration(t *testing.T) {
+	ts := newFakeAzure(t)
+	defer ts.Close()
+
+	c := newClient(ts.Client(), &fakeCredential{}, "")
+	c.keyVaultURL = ts.URL
+	c.appConfigURL = ts.URL
+	c.appConfigLabel = "prod"
+	vars, err := c.GetValues([]string{"/myapp"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{
+		"/myapp/database/url":  "db.example.com",
+		"/myapp/database/user": "rob",
+		"/myapp/port":          "5432",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected %v, got %v", expected, vars)
+	}
+}
+
+func TestGetValuesTokenError(t *testing.T) {
+	ts := newFakeAzure(t)
+	defer ts.Close()
+
+	c := newClient(ts.Client(), &fakeCredential{err: errors.New("no identity")}, "")
+	c.keyVaultURL = ts.URL
+	_, err := c.GetValues([]string{"/myapp"})
+	if err == nil || !strings.Contains(err.Error(), "no identity") {
+		t.Errorf("Expected the credential error, got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// newCredential returns the default Azure credential, which tries the
+// environment, workload identity, managed identity and Azure CLI in turn.
+func newCredential() (azcore.TokenCredential, error) {
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create Azure credential - %s", err.Error())
+	}
+	return cred, nil
+}
+
+// token returns the access token authorizing requests to resource. The
+// credential caches tokens until shortly before they expire.
+func (c *Client) token(ctx context.Context, resource string) (string, error) {
+	t, err := c.cred.GetToken(ctx, policy.TokenRequestOptions{
+		Scopes: []string{resource + "/.default"},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Cannot get access token - %s", err.Error())
+	}
+	return t.Token, nil
+}
@@ -3,12 +3,17 @@ package backends
 import (
 	"errors"
 	"strings"
+	"time"
 
+	"github.com/abtreece/confd/pkg/backends/azure"
 	"github.com/abtreece/confd/pkg/backends/consul"
+	"github.com/abtreece/confd/pkg/backends/dotenv"
 	"github.com/abtreece/confd/pkg/backends/dynamodb"
 	"github.com/abtreece/confd/pkg/backends/env"
 	"github.com/abtreece/confd/pkg/backends/etcd"
 	"github.com/abtreece/confd/pkg/backends/file"
+	"github.com/abtreece/confd/pkg/backends/gcp"
+	"github.com/abtreece/confd/pkg/backends/http"
 	"github.com/abtreece/confd/pkg/backends/redis"
 	"github.com/abtreece/confd/pkg/backends/ssm"
 	"github.com/abtreece/confd/pkg/backends/vault"
@@ -23,6 +28,14 @@ type StoreClient interface {
 	WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error)
 }
 
+// A KeyTransformer is a StoreClient returning the values of a key under
+// another key than the one requested, such as the env backend returning
+// the values of /my_app, read from MY_APP, under /my/app.
+type KeyTransformer interface {
+	// TransformKey returns the key the values of key are returned under.
+	TransformKey(key string) string
+}
+
 // New is used to create a storage client based on our configuration.
 func New(config Config) (StoreClient, error) {
 
@@ -43,7 +56,7 @@ func New(config Config) (StoreClient, error) {
 		)
 	case "etcd":
 		log.Info("Backend source(s) set to " + strings.Join(backendNodes, ", "))
-		return etcd.NewEtcdClient(backendNodes, config.ClientCert, config.ClientKey, config.ClientCaKeys, config.ClientInsecure, config.BasicAuth, config.Username, config.Password)
+		return etcd.NewEtcdClient(backendNodes, config.EtcdVersion, config.ClientCert, config.ClientKey, config.ClientCaKeys, config.ClientInsecure, config.BasicAuth, config.Username, config.Password)
 	case "zookeeper":
 		log.Info("Backend source(s) set to " + strings.Join(backendNodes, ", "))
 		return zookeeper.NewZookeeperClient(backendNodes)
@@ -55,6 +68,9 @@ func New(config Config) (StoreClient, error) {
 	case "file":
 		log.Info("Backend source(s) set to " + strings.Join(config.YAMLFile, ", "))
 		return file.NewFileClient(config.YAMLFile, config.Filter)
+	case "dotenv":
+		log.Info("Backend source(s) set to " + strings.Join(config.YAMLFile, ", "))
+		return dotenv.NewDotenvClient(config.YAMLFile)
 	case "vault":
 		log.Info("Backend source(s) set to " + strings.Join(backendNodes, ", "))
 		vaultConfig := map[string]string{
@@ -77,6 +93,23 @@ func New(config Config) (StoreClient, error) {
 		return dynamodb.NewDynamoDBClient(table)
 	case "ssm":
 		return ssm.New()
+	case "http":
+		if len(backendNodes) == 0 {
+			return nil, errors.New("No HTTP endpoint configured")
+		}
+		log.Info("Backend source(s) set to " + backendNodes[0])
+		username, password := "", ""
+		if config.BasicAuth {
+			username, password = config.Username, config.Password
+		}
+		return http.NewHTTPClient(backendNodes[0], config.Headers, config.AuthToken,
+			username, password,
+			time.Duration(config.RefreshInterval)*time.Second,
+		)
+	case "gcp":
+		return gcp.New(config.Separator)
+	case "azure":
+		return azure.New(config.Separator)
 	}
 	return nil, errors.New("Invalid backend")
 }
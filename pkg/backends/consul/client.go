@@ -2,6 +2,7 @@ package consul
 
 import (
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/hashicorp/consul/api"
@@ -10,6 +11,17 @@ import (
 // Client provides a wrapper around the consulkv client
 type ConsulClient struct {
 	client *api.KV
+	health *api.Health
+}
+
+// Service is a healthy instance of a service registered in Consul.
+type Service struct {
+	ID      string
+	Name    string
+	Node    string
+	Address string
+	Port    int
+	Tags    []string
 }
 
 // NewConsulClient returns a new client to Consul for the given address
@@ -41,7 +53,7 @@ func New(nodes []string, scheme, cert, key, caCert string, basicAuth bool, usern
 	if err != nil {
 		return nil, err
 	}
-	return &ConsulClient{client.KV()}, nil
+	return &ConsulClient{client.KV(), client.Health()}, nil
 }
 
 // GetValues queries Consul for keys
@@ -60,6 +72,41 @@ func (c *ConsulClient) GetValues(keys []string) (map[string]string, error) {
 	return vars, nil
 }
 
+// Service queries Consul for the instances of the named service passing
+// their health checks. Instances without a service address use the address
+// of their node. They are sorted by node and ID so that the result only
+// changes when the instances do.
+func (c *ConsulClient) Service(name string) ([]Service, error) {
+	entries, _, err := c.health.Service(name, "", true, nil)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]Service, 0, len(entries))
+	for _, e := range entries {
+		s := Service{
+			ID:      e.Service.ID,
+			Name:    e.Service.Service,
+			Address: e.Service.Address,
+			Port:    e.Service.Port,
+			Tags:    e.Service.Tags,
+		}
+		if e.Node != nil {
+			s.Node = e.Node.Node
+			if s.Address == "" {
+				s.Address = e.Node.Address
+			}
+		}
+		services = append(services, s)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Node != services[j].Node {
+			return services[i].Node < services[j].Node
+		}
+		return services[i].ID < services[j].ID
+	})
+	return services, nil
+}
+
 type watchResponse struct {
 	waitIndex uint64
 	err       error
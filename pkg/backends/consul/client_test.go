@@ -0,0 +1,48 @@
+package consul
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestService(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/web" {
+			http.NotFound(w, r)
+			return
+		}
+		if _, ok := r.URL.Query()["passing"]; !ok {
+			t.Errorf("Expected only passing instances to be requested, got %s", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[
+  {"Node": {"Node": "node2", "Address": "10.0.0.2"},
+   "Service": {"ID": "web-2", "Service": "web", "Address": "", "Port": 8080, "Tags": ["blue"]}},
+  {"Node": {"Node": "node1", "Address": "10.0.0.1"},
+   "Service": {"ID": "web-1b", "Service": "web", "Address": "192.168.0.1", "Port": 8081, "Tags": null}},
+  {"Node": {"Node": "node1", "Address": "10.0.0.1"},
+   "Service": {"ID": "web-1a", "Service": "web", "Address": "192.168.0.1", "Port": 8080, "Tags": ["green"]}}
+]`))
+	}))
+	defer ts.Close()
+
+	c, err := New([]string{strings.TrimPrefix(ts.URL, "http://")}, "http", "", "", "", false, "", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	services, err := c.Service("web")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []Service{
+		{ID: "web-1a", Name: "web", Node: "node1", Address: "192.168.0.1", Port: 8080, Tags: []string{"green"}},
+		{ID: "web-1b", Name: "web", Node: "node1", Address: "192.168.0.1", Port: 8081},
+		{ID: "web-2", Name: "web", Node: "node2", Address: "10.0.0.2", Port: 8080, Tags: []string{"blue"}},
+	}
+	if !reflect.DeepEqual(services, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, services)
+	}
+}
@@ -0,0 +1,178 @@
+package dotenv
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/abtreece/confd/pkg/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+var replacer = strings.NewReplacer("/", "_")
+
+var cleanReplacer = strings.NewReplacer("_", "/")
+
+// Client reads key/values from .env files
+type Client struct {
+	files []string
+}
+
+// NewDotenvClient returns a client reading the given .env files. Files
+// listed later override the variables of the earlier ones.
+func NewDotenvClient(files []string) (*Client, error) {
+	return &Client{files: files}, nil
+}
+
+// GetValues parses the .env files and returns the variables matching keys.
+// As with the env backend, the variable DATABASE_URL is the key
+// /database/url.
+func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	envMap := make(map[string]string)
+	for _, file := range c.files {
+		if err := parseFile(file, envMap); err != nil {
+			return nil, err
+		}
+	}
+	vars := make(map[string]string)
+	for _, key := range keys {
+		k := transform(key)
+		for envKey, envValue := range envMap {
+			if strings.HasPrefix(envKey, k) {
+				vars[clean(envKey)] = envValue
+			}
+		}
+	}
+
+	log.Debug(fmt.Sprintf("Key Map: %#v", vars))
+
+	return vars, nil
+}
+
+// TransformKey returns the key the values of key are returned under, that
+// of the variable it is read from.
+func (c *Client) TransformKey(key string) string {
+	return clean(transform(key))
+}
+
+func transform(key string) string {
+	k := strings.TrimPrefix(key, "/")
+	return strings.ToUpper(replacer.Replace(k))
+}
+
+func clean(key string) string {
+	newKey := "/" + key
+	return cleanReplacer.Replace(strings.ToLower(newKey))
+}
+
+// parseFile adds the variables of the .env file at path to vars.
+func parseFile(path string, vars map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		key, value, ok, err := parseLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("Cannot parse %s line %d - %s", path, n, err.Error())
+		}
+		if ok {
+			vars[key] = value
+		}
+	}
+	return scanner.Err()
+}
+
+// parseLine parses a KEY=value line, optionally prefixed with export.
+// Values may be single quoted, taken literally, or double quoted, where
+// \n, \t, \" and \\ are unescaped. Unquoted values end at a " #" comment.
+// It returns false for blank and comment lines.
+func parseLine(line string) (string, string, bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false, nil
+	}
+	line = strings.TrimPrefix(line, "export ")
+	index := strings.Index(line, "=")
+	if index < 0 {
+		return "", "", false, fmt.Errorf("missing = in %q", line)
+	}
+	key := strings.TrimSpace(line[:index])
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", false, fmt.Errorf("invalid variable name %q", key)
+	}
+	value := strings.TrimSpace(line[index+1:])
+
+	switch {
+	case strings.HasPrefix(value, "'"):
+		end := strings.Index(value[1:], "'")
+		if end < 0 {
+			return "", "", false, fmt.Errorf("unterminated quote in %q", line)
+		}
+		return key, value[1 : end+1], true, nil
+	case strings.HasPrefix(value, `"`):
+		var b strings.Builder
+		for i := 1; i < len(value); i++ {
+			switch value[i] {
+			case '"':
+				return key, b.String(), true, nil
+			case '\\':
+				if i+1 < len(value) {
+					i++
+					switch value[i] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(value[i])
+					}
+					continue
+				}
+				b.WriteByte('\\')
+			default:
+				b.WriteByte(value[i])
+			}
+		}
+		return "", "", false, fmt.Errorf("unterminated quote in %q", line)
+	}
+	if comment := strings.Index(value, " #"); comment >= 0 {
+		value = strings.TrimSpace(value[:comment])
+	}
+	return key, value, true, nil
+}
+
+// WatchPrefix waits for any of the .env files to change.
+func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	if waitIndex == 0 {
+		return 1, nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return 0, err
+	}
+	defer watcher.Close()
+	for _, file := range c.files {
+		if err := watcher.Add(file); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		select {
+		case event := <-watcher.Events:
+			log.Debug(fmt.Sprintf("Event: %s", event))
+			if event.Op&(fsnotify.Write|fsnotify.Remove|fsnotify.Create|fsnotify.Rename) != 0 {
+				return waitIndex + 1, nil
+			}
+		case err := <-watcher.Errors:
+			return 0, err
+		case <-stopChan:
+			return waitIndex, nil
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package dotenv
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	return path
+}
+
+func TestGetValues(t *testing.T) {
+	dir := t.TempDir()
+	env := writeFile(t, dir, ".env", `# Database settings
+
+export MYAPP_DATABASE_URL=db.example.com # primary
+MYAPP_DATABASE_USER = "rob"
+MYAPP_DATABASE_PASSWORD='p@ss #not a comment'
+MYAPP_GREETING="hello\n\"world\"" # trailing comment
+MYAPP_EMPTY=
+  # indented comment
+OTHER_NAME=other
+`)
+	local := writeFile(t, dir, ".env.local", `MYAPP_DATABASE_USER=alice
+`)
+
+	c, err := NewDotenvClient([]string{env, local})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	vars, err := c.GetValues([]string{"/myapp"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{
+		"/myapp/database/url":      "db.example.com",
+		"/myapp/database/user":     "alice",
+		"/myapp/database/password": "p@ss #not a comment",
+		"/myapp/greeting":          "hello\n\"world\"",
+		"/myapp/empty":             "",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, vars)
+	}
+}
+
+func TestGetValuesInvalid(t *testing.T) {
+	for _, contents := range []string{
+		"MYAPP_NAME\n",
+		"MYAPP_NAME=\"unterminated\n",
+		"MY APP=value\n",
+	} {
+		env := writeFile(t, t.TempDir(), ".env", contents)
+		c, err := NewDotenvClient([]string{env})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := c.GetValues([]string{"/myapp"}); err == nil {
+			t.Errorf("Expected an error parsing %q, got nil", contents)
+		}
+	}
+}
@@ -41,6 +41,12 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 	return vars, nil
 }
 
+// TransformKey returns the key the values of key are returned under, that
+// of the environment variable it is read from.
+func (c *Client) TransformKey(key string) string {
+	return clean(transform(key))
+}
+
 func transform(key string) string {
 	k := strings.TrimPrefix(key, "/")
 	return strings.ToUpper(replacer.Replace(k))
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
 	"strings"
 	"time"
@@ -11,6 +12,7 @@ import (
 	"sync"
 
 	"github.com/abtreece/confd/pkg/log"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
@@ -102,15 +104,38 @@ type Client struct {
 	watches map[string]*Watch
 	// Protect watch
 	wm sync.Mutex
+	// Set when reading from the v2 keys API instead
+	v2 *v2Client
 }
 
 // NewEtcdClient returns an *etcd.Client with a connection to named machines.
-func NewEtcdClient(machines []string, cert, key, caCert string, clientInsecure bool, basicAuth bool, username string, password string) (*Client, error) {
+// version selects the etcd API to read from: v3, the default, or the legacy
+// v2 keys API.
+func NewEtcdClient(machines []string, version, cert, key, caCert string, clientInsecure bool, basicAuth bool, username string, password string) (*Client, error) {
+	tlsConfig, err := newTLSConfig(cert, key, caCert, clientInsecure)
+	if err != nil {
+		return &Client{}, err
+	}
+
+	switch version {
+	case "", "v3":
+	case "v2":
+		v2 := newV2Client(machines, tlsConfig)
+		if basicAuth {
+			v2.username = username
+			v2.password = password
+		}
+		return &Client{v2: v2}, nil
+	default:
+		return &Client{}, fmt.Errorf("Invalid etcd version %q", version)
+	}
+
 	cfg := clientv3.Config{
 		Endpoints:            machines,
 		DialTimeout:          5 * time.Second,
 		DialKeepAliveTime:    10 * time.Second,
 		DialKeepAliveTimeout: 3 * time.Second,
+		TLS:                  tlsConfig,
 	}
 
 	if basicAuth {
@@ -118,6 +143,17 @@ func NewEtcdClient(machines []string, cert, key, caCert string, clientInsecure b
 		cfg.Password = password
 	}
 
+	client, err := clientv3.New(cfg)
+	if err != nil {
+		return &Client{}, err
+	}
+
+	return &Client{client: client, watches: make(map[string]*Watch)}, nil
+}
+
+// newTLSConfig returns the TLS configuration for the client certificate
+// and CA, or nil if neither is set.
+func newTLSConfig(cert, key, caCert string, clientInsecure bool) (*tls.Config, error) {
 	tlsEnabled := false
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: clientInsecure,
@@ -126,7 +162,7 @@ func NewEtcdClient(machines []string, cert, key, caCert string, clientInsecure b
 	if caCert != "" {
 		certBytes, err := ioutil.ReadFile(caCert)
 		if err != nil {
-			return &Client{}, err
+			return nil, err
 		}
 
 		caCertPool := x509.NewCertPool()
@@ -141,26 +177,23 @@ func NewEtcdClient(machines []string, cert, key, caCert string, clientInsecure b
 	if cert != "" && key != "" {
 		tlsCert, err := tls.LoadX509KeyPair(cert, key)
 		if err != nil {
-			return &Client{}, err
+			return nil, err
 		}
 		tlsConfig.Certificates = []tls.Certificate{tlsCert}
 		tlsEnabled = true
 	}
 
-	if tlsEnabled {
-		cfg.TLS = tlsConfig
+	if !tlsEnabled {
+		return nil, nil
 	}
-
-	client, err := clientv3.New(cfg)
-	if err != nil {
-		return &Client{}, err
-	}
-
-	return &Client{client, make(map[string]*Watch), sync.Mutex{}}, nil
+	return tlsConfig, nil
 }
 
 // GetValues queries etcd for keys prefixed by prefix.
 func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	if c.v2 != nil {
+		return c.v2.getValues(keys)
+	}
 	// Use all operations on the same revision
 	var first_rev int64 = 0
 	vars := make(map[string]string)
@@ -186,18 +219,7 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 			return err
 		}
 		for i, r := range result.Responses {
-			originKey := ops[i]
-			// append a '/' if not already exists
-			originKeyFixed := originKey
-			if !strings.HasSuffix(originKeyFixed, "/") {
-				originKeyFixed = originKey + "/"
-			}
-			for _, ev := range r.GetResponseRange().Kvs {
-				k := string(ev.Key)
-				if k == originKey || strings.HasPrefix(k, originKeyFixed) {
-					vars[string(ev.Key)] = string(ev.Value)
-				}
-			}
+			addRangeValues(vars, ops[i], r.GetResponseRange().Kvs)
 		}
 		if first_rev == 0 {
 			// Save the revison of the first request
@@ -222,7 +244,28 @@ func (c *Client) GetValues(keys []string) (map[string]string, error) {
 	return vars, nil
 }
 
+// addRangeValues adds the pairs of a prefix range read of originKey to vars.
+// Only originKey itself and the keys under it are kept, so that reading
+// "/app" doesn't return "/application".
+func addRangeValues(vars map[string]string, originKey string, kvs []*mvccpb.KeyValue) {
+	for _, ev := range kvs {
+		k := string(ev.Key)
+		if keyUnder(k, originKey) {
+			vars[k] = string(ev.Value)
+		}
+	}
+}
+
+// keyUnder reports whether k is key or a key under it, so that /app
+// matches /app/name but not /application.
+func keyUnder(k, key string) bool {
+	return k == key || strings.HasPrefix(k, strings.TrimSuffix(key, "/")+"/")
+}
+
 func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	if c.v2 != nil {
+		return c.v2.watchPrefix(prefix, keys, waitIndex, stopChan)
+	}
 	var err error
 
 	// Create watch for each key
@@ -0,0 +1,123 @@
+package etcd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func TestAddRangeValues(t *testing.T) {
+	kvs := []*mvccpb.KeyValue{
+		{Key: []byte("/app/db/user"), Value: []byte("rob")},
+		{Key: []byte("/app/db"), Value: []byte("db.example.com")},
+		{Key: []byte("/application/name"), Value: []byte("other")},
+	}
+	vars := make(map[string]string)
+	addRangeValues(vars, "/app/db", kvs)
+	expected := map[string]string{
+		"/app/db":      "db.example.com",
+		"/app/db/user": "rob",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected %v, got %v", expected, vars)
+	}
+}
+
+func TestV2GetValues(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("recursive") != "true" {
+			t.Errorf("Expected a recursive read, got %s", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v2/keys/app":
+			w.Header().Set("X-Etcd-Index", "12")
+			w.Write([]byte(`{"action": "get", "node": {"key": "/app", "dir": true, "nodes": [
+  {"key": "/app/name", "value": "confd", "modifiedIndex": 4},
+  {"key": "/app/db", "dir": true, "nodes": [
+    {"key": "/app/db/user", "value": "rob", "modifiedIndex": 7}
+  ]},
+  {"key": "/app/empty", "dir": true}
+]}}`))
+		case "/v2/keys/single":
+			w.Write([]byte(`{"action": "get", "node": {"key": "/single", "value": "one", "modifiedIndex": 9}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errorCode": 100, "message": "Key not found", "cause": "` + r.URL.Path + `"}`))
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewEtcdClient([]string{ts.URL}, "v2", "", "", "", false, false, "", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	vars, err := c.GetValues([]string{"/app", "/single", "/missing"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{
+		"/app/name":    "confd",
+		"/app/db/user": "rob",
+		"/single":      "one",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected %v, got %v", expected, vars)
+	}
+}
+
+func TestV2GetValuesError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"errorCode": 209, "message": "Invalid field"}`))
+	}))
+	defer ts.Close()
+
+	c, err := NewEtcdClient([]string{ts.URL}, "v2", "", "", "", false, false, "", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := c.GetValues([]string{"/app"}); err == nil {
+		t.Error("Expected an error, got nil")
+	}
+}
+
+func TestV2WatchPrefixKeyBoundary(t *testing.T) {
+	// Changes to /appfoo and /application don't concern the /app watcher.
+	events := []string{
+		`{"action": "set", "node": {"key": "/appfoo", "value": "x", "modifiedIndex": 5}}`,
+		`{"action": "set", "node": {"key": "/application/name", "value": "x", "modifiedIndex": 6}}`,
+		`{"action": "set", "node": {"key": "/app/name", "value": "confd", "modifiedIndex": 7}}`,
+	}
+	var waitIndexes []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		waitIndexes = append(waitIndexes, r.URL.Query().Get("waitIndex"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(events[len(waitIndexes)-1]))
+	}))
+	defer ts.Close()
+
+	c, err := NewEtcdClient([]string{ts.URL}, "v2", "", "", "", false, false, "", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	index, err := c.WatchPrefix("/", []string{"/app"}, 4, make(chan bool))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if index != 7 {
+		t.Errorf("Expected the watch to return at index 7, got %d", index)
+	}
+	if expected := []string{"5", "6", "7"}; !reflect.DeepEqual(waitIndexes, expected) {
+		t.Errorf("Expected wait indexes %v, got %v", expected, waitIndexes)
+	}
+}
+
+func TestNewEtcdClientInvalidVersion(t *testing.T) {
+	if _, err := NewEtcdClient([]string{"http://127.0.0.1:2379"}, "v4", "", "", "", false, false, "", ""); err == nil {
+		t.Error("Expected an error for etcd version v4, got nil")
+	}
+}
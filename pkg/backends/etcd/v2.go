@@ -0,0 +1,186 @@
+package etcd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abtreece/confd/pkg/log"
+)
+
+// etcd v2 error code returned when the requested key doesn't exist.
+const v2KeyNotFound = 100
+
+// etcd v2 error code returned when the watched index has been compacted.
+const v2EventIndexCleared = 401
+
+// v2Client reads from the legacy etcd v2 keys API over HTTP.
+type v2Client struct {
+	endpoints []string
+	client    *http.Client
+	username  string
+	password  string
+}
+
+// v2Node is a key or directory of the v2 keys API.
+type v2Node struct {
+	Key           string    `json:"key"`
+	Value         string    `json:"value"`
+	Dir           bool      `json:"dir"`
+	Nodes         []*v2Node `json:"nodes"`
+	ModifiedIndex uint64    `json:"modifiedIndex"`
+}
+
+// v2Response is the body of a v2 keys API response, either a node or an error.
+type v2Response struct {
+	Node      *v2Node `json:"node"`
+	ErrorCode int     `json:"errorCode"`
+	Message   string  `json:"message"`
+	Index     uint64  `json:"index"`
+}
+
+func newV2Client(endpoints []string, tlsConfig *tls.Config) *v2Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &v2Client{
+		endpoints: endpoints,
+		client:    &http.Client{Transport: transport},
+	}
+}
+
+// get requests key from the first endpoint answering, with the given query.
+func (c *v2Client) get(ctx context.Context, key string, query url.Values) (*v2Response, error) {
+	var lastErr error
+	for _, endpoint := range c.endpoints {
+		u := strings.TrimSuffix(endpoint, "/") + "/v2/keys" + key + "?" + query.Encode()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if c.username != "" {
+			req.SetBasicAuth(c.username, c.password)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		r := &v2Response{}
+		err = json.NewDecoder(resp.Body).Decode(r)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("Cannot decode response from %s - %s", endpoint, err.Error())
+			continue
+		}
+		if index, err := strconv.ParseUint(resp.Header.Get("X-Etcd-Index"), 10, 64); err == nil {
+			r.Index = index
+		}
+		return r, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("No etcd endpoint configured")
+	}
+	return nil, lastErr
+}
+
+// getValues queries the v2 keys API recursively for each key. Directories
+// are flattened into the keys they hold.
+func (c *v2Client) getValues(keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, key := range keys {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(3)*time.Second)
+		r, err := c.get(ctx, key, url.Values{"recursive": {"true"}, "sorted": {"true"}})
+		cancel()
+		if err != nil {
+			return vars, err
+		}
+		if r.ErrorCode == v2KeyNotFound {
+			continue
+		}
+		if r.ErrorCode != 0 {
+			return vars, fmt.Errorf("Cannot get %s - %s", key, r.Message)
+		}
+		addV2Values(vars, r.Node)
+	}
+	return vars, nil
+}
+
+// addV2Values adds the values of node and, for a directory, of the nodes
+// under it to vars.
+func addV2Values(vars map[string]string, node *v2Node) {
+	if node == nil {
+		return
+	}
+	if !node.Dir {
+		vars[node.Key] = node.Value
+		return
+	}
+	for _, n := range node.Nodes {
+		addV2Values(vars, n)
+	}
+}
+
+// watchPrefix waits for a change under prefix after waitIndex, through the
+// v2 keys API long polling. Changes outside of keys are skipped.
+func (c *v2Client) watchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	// return something > 0 to trigger a key retrieval from the store
+	if waitIndex == 0 {
+		return 1, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelRoutine := make(chan struct{})
+	defer cancel()
+	defer close(cancelRoutine)
+	go func() {
+		select {
+		case <-stopChan:
+			cancel()
+		case <-cancelRoutine:
+			return
+		}
+	}()
+
+	for {
+		query := url.Values{
+			"wait":      {"true"},
+			"recursive": {"true"},
+			"waitIndex": {strconv.FormatUint(waitIndex+1, 10)},
+		}
+		r, err := c.get(ctx, prefix, query)
+		if err != nil {
+			if ctx.Err() != nil {
+				return waitIndex, nil
+			}
+			return waitIndex, err
+		}
+		if r.ErrorCode == v2EventIndexCleared {
+			// The index was compacted, start over from the current one.
+			log.Debug("Watch to '%s' index %d cleared", prefix, waitIndex)
+			return r.Index, nil
+		}
+		if r.ErrorCode != 0 {
+			return waitIndex, fmt.Errorf("Cannot watch %s - %s", prefix, r.Message)
+		}
+		if r.Node == nil {
+			return waitIndex, fmt.Errorf("Cannot watch %s - no node in response", prefix)
+		}
+		// Only return if we have a key prefix we care about.
+		for _, k := range keys {
+			if keyUnder(r.Node.Key, k) {
+				return r.Node.ModifiedIndex, nil
+			}
+		}
+		waitIndex = r.Node.ModifiedIndex
+	}
+}
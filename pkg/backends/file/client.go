@@ -4,9 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 
 	"github.com/abtreece/confd/pkg/log"
@@ -45,14 +43,14 @@ func readFile(path string, vars map[string]string) error {
 		if err != nil {
 			return err
 		}
-		err = nodeWalk(fileMap, "/", vars)
+		err = util.NodeWalk(fileMap, "/", vars)
 	case "", ".yml", ".yaml":
 		fileMap := make(map[interface{}]interface{})
 		err = yaml.Unmarshal(data, &fileMap)
 		if err != nil {
 			return err
 		}
-		err = nodeWalk(fileMap, "/", vars)
+		err = util.NodeWalk(fileMap, "/", vars)
 	default:
 		err = fmt.Errorf("Invalid file extentsion. YAML or JSON only.")
 	}
@@ -94,36 +92,6 @@ VarsLoop:
 	return vars, nil
 }
 
-// nodeWalk recursively descends nodes, updating vars.
-func nodeWalk(node interface{}, key string, vars map[string]string) error {
-	switch node.(type) {
-	case []interface{}:
-		for i, j := range node.([]interface{}) {
-			key := path.Join(key, strconv.Itoa(i))
-			nodeWalk(j, key, vars)
-		}
-	case map[interface{}]interface{}:
-		for k, v := range node.(map[interface{}]interface{}) {
-			key := path.Join(key, k.(string))
-			nodeWalk(v, key, vars)
-		}
-	case map[string]interface{}:
-		for k, v := range node.(map[string]interface{}) {
-			key := path.Join(key, k)
-			nodeWalk(v, key, vars)
-		}
-	case string:
-		vars[key] = node.(string)
-	case int:
-		vars[key] = strconv.Itoa(node.(int))
-	case bool:
-		vars[key] = strconv.FormatBool(node.(bool))
-	case float64:
-		vars[key] = strconv.FormatFloat(node.(float64), 'f', -1, 64)
-	}
-	return nil
-}
-
 func (c *Client) watchChanges(watcher *fsnotify.Watcher, stopChan chan bool) ResultError {
 	outputChannel := make(chan ResultError)
 	go func() error {
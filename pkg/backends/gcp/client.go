@@ -0,0 +1,272 @@
+package gcp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/abtreece/confd/pkg/log"
+)
+
+const (
+	defaultSecretManagerURL = "https://secretmanager.googleapis.com"
+	defaultRuntimeConfigURL = "https://runtimeconfig.googleapis.com"
+)
+
+// Client reads the latest version of the Secret Manager secrets of a
+// project and, optionally, the variables of a Runtime Configurator config.
+type Client struct {
+	client           *http.Client
+	tokens           tokenSource
+	project          string
+	runtimeConfig    string
+	separator        string
+	secretManagerURL string
+	runtimeConfigURL string
+}
+
+// apiError is the error body returned by the Google APIs.
+type apiError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+// New returns a client authenticated with the application default
+// credentials. Secret names are mapped to keys by replacing separator,
+// "_" if empty, with "/".
+func New(separator string) (*Client, error) {
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	creds, err := findCredentials(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	tokens := oauthTokenSource{src: creds.TokenSource}
+
+	project := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	if project == "" {
+		project = creds.ProjectID
+	}
+	if project == "" {
+		return nil, errors.New("No project found in the credentials, set GOOGLE_CLOUD_PROJECT")
+	}
+	log.Debug(fmt.Sprintf("Project: %s", project))
+
+	c := newClient(httpClient, tokens, project, separator)
+	c.runtimeConfig = os.Getenv("GCP_RUNTIME_CONFIG")
+	if endpoint := os.Getenv("GCP_SECRET_MANAGER_ENDPOINT"); endpoint != "" {
+		c.secretManagerURL = endpoint
+	}
+	if endpoint := os.Getenv("GCP_RUNTIME_CONFIG_ENDPOINT"); endpoint != "" {
+		c.runtimeConfigURL = endpoint
+	}
+
+	// Fail early, if no credentials can be found
+	if _, err := tokens.token(context.Background()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newClient(httpClient *http.Client, tokens tokenSource, project, separator string) *Client {
+	if separator == "" {
+		separator = "_"
+	}
+	return &Client{
+		client:           httpClient,
+		tokens:           tokens,
+		project:          project,
+		separator:        separator,
+		secretManagerURL: defaultSecretManagerURL,
+		runtimeConfigURL: defaultRuntimeConfigURL,
+	}
+}
+
+// GetValues retrieves the values for the given keys. Runtime Configurator
+// variables are read first, so that secrets take precedence.
+func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	ctx := context.Background()
+	if c.runtimeConfig != "" {
+		for _, key := range keys {
+			if err := c.getVariables(ctx, key, vars); err != nil {
+				return vars, err
+			}
+		}
+	}
+
+	secrets, err := c.listSecrets(ctx)
+	if err != nil {
+		return vars, err
+	}
+	for _, name := range secrets {
+		k := c.secretKey(name)
+		if !matchesAny(k, keys) {
+			continue
+		}
+		log.Debug("Processing secret=%s", name)
+		v, ok, err := c.accessSecret(ctx, name)
+		if err != nil {
+			return vars, err
+		}
+		if ok {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+// secretKey maps the secret resource name to a key, so that the secret
+// app_db_user is the key /app/db/user.
+func (c *Client) secretKey(name string) string {
+	id := name[strings.LastIndex(name, "/")+1:]
+	return path.Join("/", strings.ReplaceAll(id, c.separator, "/"))
+}
+
+// matchesAny reports whether k is one of keys or under one of them.
+func matchesAny(k string, keys []string) bool {
+	for _, key := range keys {
+		if k == key || strings.HasPrefix(k, strings.TrimSuffix(key, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// listSecrets returns the resource names of all the secrets of the project.
+func (c *Client) listSecrets(ctx context.Context) ([]string, error) {
+	var names []string
+	pageToken := ""
+	for {
+		query := url.Values{"pageSize": {"250"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		var page struct {
+			Secrets []struct {
+				Name string `json:"name"`
+			} `json:"secrets"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		u := c.secretManagerURL + "/v1/projects/" + c.project + "/secrets?" + query.Encode()
+		if _, err := c.get(ctx, u, &page); err != nil {
+			return nil, err
+		}
+		for _, s := range page.Secrets {
+			names = append(names, s.Name)
+		}
+		if page.NextPageToken == "" {
+			return names, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// accessSecret returns the payload of the latest version of the secret.
+// It returns false if the secret has no enabled version.
+func (c *Client) accessSecret(ctx context.Context, name string) (string, bool, error) {
+	var version struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	found, err := c.get(ctx, c.secretManagerURL+"/v1/"+name+"/versions/latest:access", &version)
+	if err != nil || !found {
+		return "", false, err
+	}
+	data, err := base64.StdEncoding.DecodeString(version.Payload.Data)
+	if err != nil {
+		return "", false, fmt.Errorf("Cannot decode secret %s - %s", name, err.Error())
+	}
+	return string(data), true, nil
+}
+
+// getVariables adds the Runtime Configurator variables under key to vars.
+func (c *Client) getVariables(ctx context.Context, key string, vars map[string]string) error {
+	parent := "projects/" + c.project + "/configs/" + c.runtimeConfig
+	pageToken := ""
+	for {
+		query := url.Values{
+			"filter":       {parent + "/variables" + key},
+			"returnValues": {"true"},
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		var page struct {
+			Variables []struct {
+				Name  string `json:"name"`
+				Text  string `json:"text"`
+				Value string `json:"value"`
+			} `json:"variables"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		u := c.runtimeConfigURL + "/v1beta1/" + parent + "/variables?" + query.Encode()
+		if _, err := c.get(ctx, u, &page); err != nil {
+			return err
+		}
+		for _, v := range page.Variables {
+			k := strings.TrimPrefix(v.Name, parent+"/variables")
+			if !matchesAny(k, []string{key}) {
+				continue
+			}
+			if v.Value != "" {
+				data, err := base64.StdEncoding.DecodeString(v.Value)
+				if err != nil {
+					return fmt.Errorf("Cannot decode variable %s - %s", v.Name, err.Error())
+				}
+				vars[k] = string(data)
+			} else {
+				vars[k] = v.Text
+			}
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// get decodes the response of an authorized GET request to u into out.
+// It returns false if the resource doesn't exist or has no enabled version.
+func (c *Client) get(ctx context.Context, u string, out interface{}) (bool, error) {
+	token, err := c.tokens.token(ctx)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		e := &apiError{}
+		json.NewDecoder(resp.Body).Decode(e)
+		if resp.StatusCode == http.StatusNotFound || e.Error.Status == "FAILED_PRECONDITION" {
+			return false, nil
+		}
+		return false, fmt.Errorf("GCP request failed - %s %s", resp.Status, e.Error.Message)
+	}
+	return true, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// WatchPrefix is not implemented
+func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	<-stopChan
+	return 0, nil
+}
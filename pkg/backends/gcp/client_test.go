@@ -0,0 +1,108 @@
+package gcp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// staticTokens is a tokenSource returning a fixed token.
+type staticTokens string
+
+func (s staticTokens) token(ctx context.Context) (string, error) {
+	return string(s), nil
+}
+
+func newFakeGCP(t *testing.T) *httptest.Server {
+	secrets := map[string]string{
+		"myapp_database_url":  "db.example.com",
+		"myapp_database_user": "rob",
+		"other_name":          "other",
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			t.Errorf("Expected bearer token, got %q", r.Header.Get("Authorization"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/v1/projects/test/secrets":
+			// Serve the secrets over two pages.
+			if r.URL.Query().Get("pageToken") == "" {
+				w.Write([]byte(`{"secrets": [{"name": "projects/test/secrets/myapp_database_url"},
+  {"name": "projects/test/secrets/disabled"}], "nextPageToken": "next"}`))
+				return
+			}
+			w.Write([]byte(`{"secrets": [{"name": "projects/test/secrets/myapp_database_user"},
+  {"name": "projects/test/secrets/other_name"}]}`))
+		case strings.HasSuffix(r.URL.Path, "/versions/latest:access"):
+			name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/projects/test/secrets/"), "/versions/latest:access")
+			v, ok := secrets[name]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": {"code": 400, "message": "is in DISABLED state", "status": "FAILED_PRECONDITION"}}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"payload": map[string]string{"data": base64.StdEncoding.EncodeToString([]byte(v))},
+			})
+		case r.URL.Path == "/v1beta1/projects/test/configs/myapp/variables":
+			if r.URL.Query().Get("filter") != "projects/test/configs/myapp/variables/myapp" {
+				t.Errorf("Unexpected filter %q", r.URL.Query().Get("filter"))
+			}
+			w.Write([]byte(`{"variables": [
+  {"name": "projects/test/configs/myapp/variables/myapp/database/url", "text": "overridden"},
+  {"name": "projects/test/configs/myapp/variables/myapp/port", "value": "` + base64.StdEncoding.EncodeToString([]byte("5432")) + `"},
+  {"name": "projects/test/configs/myapp/variables/myapplication/name", "text": "other"}
+]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "not found", "status": "NOT_FOUND"}}`))
+		}
+	}))
+}
+
+func TestGetValues(t *testing.T) {
+	ts := newFakeGCP(t)
+	defer ts.Close()
+
+	c := newClient(ts.Client(), staticTokens("test-token"), "test", "")
+	c.secretManagerURL = ts.URL
+	vars, err := c.GetValues([]string{"/myapp", "/disabled"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{
+		"/myapp/database/url":  "db.example.com",
+		"/myapp/database/user": "rob",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected %v, got %v", expected, vars)
+	}
+}
+
+func TestGetValuesRuntimeConfig(t *testing.T) {
+	ts := newFakeGCP(t)
+	defer ts.Close()
+
+	c := newClient(ts.Client(), staticTokens("test-token"), "test", "")
+	c.secretManagerURL = ts.URL
+	c.runtimeConfigURL = ts.URL
+	c.runtimeConfig = "myapp"
+	vars, err := c.GetValues([]string{"/myapp"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{
+		"/myapp/database/url":  "db.example.com",
+		"/myapp/database/user": "rob",
+		"/myapp/port":          "5432",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected %v, got %v", expected, vars)
+	}
+}
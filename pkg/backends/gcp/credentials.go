@@ -0,0 +1,41 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// tokenSource returns the OAuth2 access token authorizing the API requests.
+type tokenSource interface {
+	token(ctx context.Context) (string, error)
+}
+
+// oauthTokenSource adapts an oauth2.TokenSource, which caches the token
+// until shortly before it expires.
+type oauthTokenSource struct {
+	src oauth2.TokenSource
+}
+
+func (s oauthTokenSource) token(ctx context.Context) (string, error) {
+	t, err := s.src.Token()
+	if err != nil {
+		return "", fmt.Errorf("Cannot get access token - %s", err.Error())
+	}
+	return t.AccessToken, nil
+}
+
+// findCredentials looks up the application default credentials: the
+// GOOGLE_APPLICATION_CREDENTIALS file, the gcloud well-known file, then
+// the metadata server.
+func findCredentials(ctx context.Context) (*google.Credentials, error) {
+	creds, err := google.FindDefaultCredentials(ctx, cloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot find application default credentials - %s", err.Error())
+	}
+	return creds, nil
+}
@@ -0,0 +1,229 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/abtreece/confd/pkg/log"
+	util "github.com/abtreece/confd/pkg/util"
+)
+
+// Interval between two requests while watching, when no refresh interval
+// is set.
+const defaultWatchInterval = 60 * time.Second
+
+// Client reads a JSON object from an HTTP endpoint and serves it flattened
+// into keys, so that {"db": {"host": "x"}} is the key /db/host.
+type Client struct {
+	client   *http.Client
+	url      string
+	headers  http.Header
+	refresh  time.Duration
+	username string
+	password string
+
+	mu        sync.Mutex
+	etag      string
+	body      []byte
+	vars      map[string]string
+	fetchedAt time.Time
+	// Incremented every time the document changes
+	version uint64
+}
+
+// NewHTTPClient returns a client for the JSON document at url. headers are
+// "Name: value" pairs sent with every request, token is sent as a bearer
+// token and username as basic auth. Within refresh of a request, the values
+// are served without requesting them again.
+func NewHTTPClient(url string, headers []string, token, username, password string, refresh time.Duration) (*Client, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("Invalid URL %q, http or https is required", url)
+	}
+	h := make(http.Header)
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return nil, fmt.Errorf("Invalid header %q, Name: value is required", header)
+		}
+		h.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if token != "" {
+		h.Set("Authorization", "Bearer "+token)
+	}
+	return &Client{
+		client:   newSafeHTTPClient(),
+		url:      url,
+		headers:  h,
+		refresh:  refresh,
+		username: username,
+		password: password,
+	}, nil
+}
+
+// newSafeHTTPClient returns an HTTP client refusing to connect to link-local
+// addresses, such as cloud metadata services, and to follow redirects to
+// another host or from https to http, so that the endpoint can't be used to
+// reach them.
+func newSafeHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+				ip.IsMulticast() || ip.IsUnspecified() {
+				return fmt.Errorf("Refusing to connect to %s", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("Stopped after 10 redirects")
+			}
+			if req.URL.Host != via[0].URL.Host {
+				return fmt.Errorf("Refusing to follow redirect to %s", req.URL.Host)
+			}
+			if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+				return fmt.Errorf("Refusing to follow redirect to %s", req.URL)
+			}
+			return nil
+		},
+	}
+}
+
+// fetch requests the document, conditionally on the ETag of the last one.
+// It returns true if the document changed since the last request.
+func (c *Client) fetch() (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url, nil)
+	if err != nil {
+		return false, err
+	}
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	if c.etag != "" {
+		req.Header.Set("If-None-Match", c.etag)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && c.vars != nil {
+		log.Debug("%s not modified", c.url)
+		c.fetchedAt = time.Now()
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Cannot get %s - %s", c.url, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return false, fmt.Errorf("Cannot decode %s - %s", c.url, err.Error())
+	}
+	vars := make(map[string]string)
+	if err := util.NodeWalk(doc, "/", vars); err != nil {
+		return false, err
+	}
+	changed := c.vars == nil || !bytes.Equal(body, c.body)
+	if changed {
+		c.version++
+	}
+	c.etag = resp.Header.Get("ETag")
+	c.body = body
+	c.vars = vars
+	c.fetchedAt = time.Now()
+	return changed, nil
+}
+
+// GetValues returns the values of the document matching keys, requesting
+// the document again once the refresh interval has elapsed.
+func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.vars == nil || time.Since(c.fetchedAt) >= c.refresh {
+		if _, err := c.fetch(); err != nil {
+			return nil, err
+		}
+	}
+
+	vars := make(map[string]string)
+	for k, v := range c.vars {
+		for _, key := range keys {
+			if k == key || strings.HasPrefix(k, strings.TrimSuffix(key, "/")+"/") {
+				vars[k] = v
+				break
+			}
+		}
+	}
+	log.Debug(fmt.Sprintf("Key Map: %#v", vars))
+	return vars, nil
+}
+
+// WatchPrefix polls the document every refresh interval, or every minute
+// without one, until its version is past waitIndex.
+func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	interval := c.refresh
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	for {
+		c.mu.Lock()
+		var err error
+		if c.vars == nil {
+			_, err = c.fetch()
+		}
+		version := c.version
+		c.mu.Unlock()
+		if err != nil {
+			return waitIndex, err
+		}
+		if version > waitIndex {
+			return version, nil
+		}
+
+		select {
+		case <-stopChan:
+			return waitIndex, nil
+		case <-time.After(interval):
+		}
+		c.mu.Lock()
+		// Another watch may have fetched the document meanwhile.
+		if time.Since(c.fetchedAt) >= interval {
+			_, err = c.fetch()
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return waitIndex, err
+		}
+	}
+}
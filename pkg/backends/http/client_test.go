@@ -0,0 +1,191 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetValues(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Unexpected authorization %q", r.Header.Get("Authorization"))
+		}
+		if r.Header.Get("X-Environment") != "production" {
+			t.Errorf("Unexpected X-Environment %q", r.Header.Get("X-Environment"))
+		}
+		w.Write([]byte(`{
+  "myapp": {"database": {"url": "db.example.com", "port": 5432, "replicas": ["r1", "r2"]}, "debug": false},
+  "other": "value"
+}`))
+	}))
+	defer ts.Close()
+
+	c, err := NewHTTPClient(ts.URL, []string{"X-Environment: production"}, "secret", "", "", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	vars, err := c.GetValues([]string{"/myapp"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{
+		"/myapp/database/url":        "db.example.com",
+		"/myapp/database/port":       "5432",
+		"/myapp/database/replicas/0": "r1",
+		"/myapp/database/replicas/1": "r2",
+		"/myapp/debug":               "false",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected %v, got %v", expected, vars)
+	}
+}
+
+func TestGetValuesKeyBoundary(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"app": {"port": 80}, "application": {"port": 8080}, "apps": "other"}`))
+	}))
+	defer ts.Close()
+
+	c, err := NewHTTPClient(ts.URL, nil, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, tt := range []struct {
+		keys     []string
+		expected map[string]string
+	}{
+		{[]string{"/app"}, map[string]string{"/app/port": "80"}},
+		{[]string{"/app/"}, map[string]string{"/app/port": "80"}},
+		{[]string{"/apps"}, map[string]string{"/apps": "other"}},
+		{[]string{"/"}, map[string]string{"/app/port": "80", "/application/port": "8080", "/apps": "other"}},
+	} {
+		vars, err := c.GetValues(tt.keys)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !reflect.DeepEqual(vars, tt.expected) {
+			t.Errorf("%v: expected %v, got %v", tt.keys, tt.expected, vars)
+		}
+	}
+}
+
+func TestGetValuesETag(t *testing.T) {
+	body := `{"name": "one"}`
+	etag := `"v1"`
+	requests, notModified := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	c, err := NewHTTPClient(ts.URL, nil, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 2; i++ {
+		vars, err := c.GetValues([]string{"/"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if vars["/name"] != "one" {
+			t.Errorf("Expected /name to be one, got %v", vars)
+		}
+	}
+	if requests != 2 || notModified != 1 {
+		t.Errorf("Expected a conditional request served as not modified, got %d requests and %d not modified", requests, notModified)
+	}
+
+	body, etag = `{"name": "two"}`, `"v2"`
+	vars, err := c.GetValues([]string{"/"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if vars["/name"] != "two" {
+		t.Errorf("Expected /name to be two, got %v", vars)
+	}
+}
+
+func TestGetValuesRefreshInterval(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"name": "one"}`))
+	}))
+	defer ts.Close()
+
+	c, err := NewHTTPClient(ts.URL, nil, "", "", "", time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetValues([]string{"/"}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected values to be reused within the refresh interval, got %d requests", requests)
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	body := `{"name": "one"}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	c, err := NewHTTPClient(ts.URL, nil, "", "", "", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stopChan := make(chan bool)
+	index, err := c.WatchPrefix("/", []string{"/"}, 0, stopChan)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body = `{"name": "two"}`
+	next, err := c.WatchPrefix("/", []string{"/"}, index, stopChan)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if next <= index {
+		t.Errorf("Expected a new index after a change, got %d then %d", index, next)
+	}
+}
+
+func TestSafeHTTPClient(t *testing.T) {
+	c, err := NewHTTPClient("http://169.254.169.254/latest/meta-data/", nil, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := c.GetValues([]string{"/"}); err == nil || !strings.Contains(err.Error(), "Refusing to connect") {
+		t.Errorf("Expected link-local address to be refused, got %v", err)
+	}
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer other.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL, http.StatusFound)
+	}))
+	defer ts.Close()
+	c, err = NewHTTPClient(ts.URL, nil, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := c.GetValues([]string{"/"}); err == nil || !strings.Contains(err.Error(), "Refusing to follow redirect") {
+		t.Errorf("Expected redirect to another host to be refused, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package zookeeper
 
 import (
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -9,74 +10,96 @@ import (
 	zk "github.com/go-zookeeper/zk"
 )
 
+// conn is the part of the zookeeper connection used by the client.
+type conn interface {
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+}
+
 // Client provides a wrapper around the zookeeper client
 type Client struct {
-	client *zk.Conn
+	client conn
 }
 
+// Number of attempts at reading the keys when the connection is lost.
+const getValuesAttempts = 3
+
+// Delay between two attempts at reading the keys.
+var retryDelay = time.Second
+
 func NewZookeeperClient(machines []string) (*Client, error) {
 	c, _, err := zk.Connect(machines, time.Second) //*10)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	return &Client{c}, nil
 }
 
-func nodeWalk(prefix string, c *Client, vars map[string]string) error {
-	var s string
-	l, stat, err := c.client.Children(prefix)
+// nodeWalk adds the data of the leaf znodes under node to vars. Znodes
+// removed while walking, such as ephemeral nodes whose session ended, are
+// skipped.
+func (c *Client) nodeWalk(node string, vars map[string]string) error {
+	children, _, err := c.client.Children(node)
+	if err == zk.ErrNoNode {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	if stat.NumChildren == 0 {
-		b, _, err := c.client.Get(prefix)
+	if len(children) == 0 {
+		b, _, err := c.client.Get(node)
+		if err == zk.ErrNoNode {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		vars[prefix] = string(b)
-
-	} else {
-		for _, key := range l {
-			if prefix == "/" {
-				s = "/" + key
-			} else {
-				s = prefix + "/" + key
-			}
-			_, stat, err := c.client.Exists(s)
-			if err != nil {
-				return err
-			}
-			if stat.NumChildren == 0 {
-				b, _, err := c.client.Get(s)
-				if err != nil {
-					return err
-				}
-				vars[s] = string(b)
-			} else {
-				nodeWalk(s, c, vars)
-			}
+		vars[node] = string(b)
+		return nil
+	}
+	for _, child := range children {
+		if err := c.nodeWalk(path.Join(node, child), vars); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// GetValues walks the znodes under each key and returns their data. The
+// walk is retried when the connection to the ensemble is lost meanwhile.
 func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var vars map[string]string
+		vars, err = c.getValues(keys)
+		if err == nil || !isConnectionError(err) || attempt == getValuesAttempts {
+			return vars, err
+		}
+		log.Warning("Cannot read from zookeeper, retrying - " + err.Error())
+		time.Sleep(retryDelay)
+	}
+}
+
+func (c *Client) getValues(keys []string) (map[string]string, error) {
 	vars := make(map[string]string)
 	for _, v := range keys {
 		v = strings.Replace(v, "/*", "", -1)
-		_, _, err := c.client.Exists(v)
-		if err != nil {
-			return vars, err
-		}
-		err = nodeWalk(v, c, vars)
-		if err != nil {
+		if err := c.nodeWalk(v, vars); err != nil {
 			return vars, err
 		}
 	}
 	return vars, nil
 }
 
+// isConnectionError reports whether err is caused by the connection to the
+// ensemble rather than by the request.
+func isConnectionError(err error) bool {
+	return err == zk.ErrConnectionClosed || err == zk.ErrSessionExpired || err == zk.ErrNoServer
+}
+
 type watchResponse struct {
 	waitIndex uint64
 	err       error
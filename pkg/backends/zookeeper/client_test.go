@@ -0,0 +1,148 @@
+package zookeeper
+
+import (
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	zk "github.com/go-zookeeper/zk"
+)
+
+// fakeConn serves a fixed znode tree. failures is the number of calls
+// failing with a lost connection before the tree is served, and vanished
+// lists the znodes which are listed as children but gone when read.
+type fakeConn struct {
+	nodes    map[string]string
+	vanished map[string]bool
+	failures int
+}
+
+func (f *fakeConn) fail() error {
+	if f.failures > 0 {
+		f.failures--
+		return zk.ErrConnectionClosed
+	}
+	return nil
+}
+
+func (f *fakeConn) Children(node string) ([]string, *zk.Stat, error) {
+	if err := f.fail(); err != nil {
+		return nil, nil, err
+	}
+	if f.vanished[node] {
+		return nil, nil, zk.ErrNoNode
+	}
+	if _, ok := f.nodes[node]; !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	var children []string
+	for k := range f.nodes {
+		if k != node && path.Dir(k) == node {
+			children = append(children, path.Base(k))
+		}
+	}
+	for k := range f.vanished {
+		if path.Dir(k) == node {
+			children = append(children, path.Base(k))
+		}
+	}
+	sort.Strings(children)
+	return children, &zk.Stat{NumChildren: int32(len(children))}, nil
+}
+
+func (f *fakeConn) ChildrenW(node string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	children, stat, err := f.Children(node)
+	return children, stat, make(chan zk.Event), err
+}
+
+func (f *fakeConn) Get(node string) ([]byte, *zk.Stat, error) {
+	if err := f.fail(); err != nil {
+		return nil, nil, err
+	}
+	v, ok := f.nodes[node]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return []byte(v), &zk.Stat{}, nil
+}
+
+func (f *fakeConn) GetW(node string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	b, stat, err := f.Get(node)
+	return b, stat, make(chan zk.Event), err
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		nodes: map[string]string{
+			"/":                     "",
+			"/kafka":                "",
+			"/kafka/brokers":        "",
+			"/kafka/brokers/1":      "broker1:9092",
+			"/kafka/brokers/2":      "broker2:9092",
+			"/kafka/config":         "",
+			"/kafka/config/retain":  "7d",
+			"/hadoop":               "",
+			"/hadoop/namenode/host": "nn.example.com",
+			"/hadoop/namenode":      "",
+		},
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	c := &Client{newFakeConn()}
+	vars, err := c.GetValues([]string{"/kafka", "/hadoop/namenode/*", "/missing"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{
+		"/kafka/brokers/1":      "broker1:9092",
+		"/kafka/brokers/2":      "broker2:9092",
+		"/kafka/config/retain":  "7d",
+		"/hadoop/namenode/host": "nn.example.com",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected %v, got %v", expected, vars)
+	}
+}
+
+func TestGetValuesVanishedNode(t *testing.T) {
+	conn := newFakeConn()
+	conn.vanished = map[string]bool{"/kafka/brokers/3": true}
+	c := &Client{conn}
+	vars, err := c.GetValues([]string{"/kafka/brokers"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{
+		"/kafka/brokers/1": "broker1:9092",
+		"/kafka/brokers/2": "broker2:9092",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("Expected %v, got %v", expected, vars)
+	}
+}
+
+func TestGetValuesRetry(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = 0
+
+	conn := newFakeConn()
+	conn.failures = getValuesAttempts - 1
+	c := &Client{conn}
+	vars, err := c.GetValues([]string{"/kafka/config"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if vars["/kafka/config/retain"] != "7d" {
+		t.Errorf("Expected /kafka/config/retain to be 7d, got %v", vars)
+	}
+
+	conn.failures = getValuesAttempts
+	_, err = c.GetValues([]string{"/kafka/config"})
+	if err == nil || !strings.Contains(err.Error(), "connection closed") {
+		t.Errorf("Expected a connection error after %d attempts, got %v", getValuesAttempts, err)
+	}
+}
@@ -9,6 +9,7 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"time"
@@ -72,3 +73,8 @@ func Info(format string, v ...interface{}) {
 func Warning(format string, v ...interface{}) {
 	log.Warning(fmt.Sprintf(format, v...))
 }
+
+// SetOutput sets the writer log entries are written to.
+func SetOutput(w io.Writer) {
+	log.SetOutput(w)
+}
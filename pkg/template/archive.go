@@ -0,0 +1,248 @@
+package template
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abtreece/confd/pkg/log"
+	"github.com/spf13/afero"
+)
+
+// archive collects the template resources sharing a TarDest. Each resource
+// is rendered as a member of a single tar archive, named after its dest,
+// instead of being written to its dest.
+type archive struct {
+	dest      string
+	resources []*TemplateResource
+	mu        sync.Mutex
+}
+
+// groupArchives splits the template resources into the ones written to
+// their own dest and the archives collecting those with a TarDest.
+func groupArchives(ts []*TemplateResource) ([]*TemplateResource, []*archive) {
+	var files []*TemplateResource
+	var archives []*archive
+	byDest := make(map[string]*archive)
+	for _, t := range ts {
+		if t.TarDest == "" {
+			files = append(files, t)
+			continue
+		}
+		a, ok := byDest[t.TarDest]
+		if !ok {
+			a = &archive{dest: t.TarDest}
+			byDest[t.TarDest] = a
+			archives = append(archives, a)
+		}
+		a.resources = append(a.resources, t)
+	}
+	for _, a := range archives {
+		sort.Slice(a.resources, func(i, j int) bool {
+			return a.resources[i].Dest < a.resources[j].Dest
+		})
+	}
+	return files, archives
+}
+
+// build renders every resource of the archive and returns the tar archive,
+// along with the contents of each member. Headers carry a fixed
+// modification time so that the archive only differs when a member does.
+// It returns an error if any.
+func (a *archive) build() ([]byte, [][]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	members := make([][]byte, 0, len(a.resources))
+	for _, t := range a.resources {
+		if err := t.setFileMode(); err != nil {
+			return nil, nil, err
+		}
+		if err := t.setVars(); err != nil {
+			return nil, nil, err
+		}
+		contents, err := t.contents()
+		if err != nil {
+			return nil, nil, err
+		}
+		members = append(members, contents)
+		t.setShebangMode(contents)
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     strings.TrimPrefix(filepath.ToSlash(t.Dest), "/"),
+			Mode:     int64(t.FileMode.Perm()),
+			Uid:      t.Uid,
+			Gid:      t.Gid,
+			Size:     int64(len(contents)),
+			ModTime:  time.Unix(0, 0),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, nil, err
+		}
+		if _, err := tw.Write(contents); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), members, nil
+}
+
+// check runs the check command of each member resource against its
+// contents, staged next to the archive, as it would against its own staged
+// config. Checks are skipped in noop mode unless CheckInDryRun is set.
+// It returns an error if any.
+func (a *archive) check(members [][]byte) error {
+	for i, t := range a.resources {
+		if !t.hasCheck() || (t.noop && !t.checkInDryRun) {
+			continue
+		}
+		if err := a.checkMember(t, members[i]); err != nil {
+			return errors.New("Config check failed for " + t.destName() + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// checkMember stages contents for t and runs its check command.
+func (a *archive) checkMember(t *TemplateResource, contents []byte) error {
+	fs := a.fs()
+	temp, err := afero.TempFile(fs, filepath.Dir(a.dest), "."+filepath.Base(t.Dest))
+	if err != nil {
+		return err
+	}
+	defer fs.Remove(temp.Name())
+	_, err = temp.Write(contents)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := fs.Chmod(temp.Name(), t.stageFileMode()); err != nil {
+		return err
+	}
+	t.StageFile = temp
+	return t.check(context.Background())
+}
+
+// drifted builds the archive and compares it to the one at dest.
+// It returns true if the archive at dest is out of sync.
+func (a *archive) drifted() (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	contents, _, err := a.build()
+	if err != nil {
+		return false, err
+	}
+	return a.changed(contents), nil
+}
+
+// changed reports whether contents differ from the archive at dest.
+func (a *archive) changed(contents []byte) bool {
+	current, err := afero.ReadFile(a.fs(), a.dest)
+	if err != nil {
+		return true
+	}
+	return !bytes.Equal(current, contents)
+}
+
+func (a *archive) fs() afero.Fs {
+	return a.resources[0].fs
+}
+
+// fileMode returns the permissions of the archive: those every member
+// resource grants, without the execute bits, so that the archive is no
+// more readable than its most restrictive member.
+func (a *archive) fileMode() os.FileMode {
+	mode := os.FileMode(0666)
+	for _, t := range a.resources {
+		mode &= t.FileMode.Perm()
+	}
+	return mode
+}
+
+// chown sets the owner of name to the one of the member resources, if they
+// all share it.
+func (a *archive) chown(name string) {
+	uid, gid := a.resources[0].Uid, a.resources[0].Gid
+	for _, t := range a.resources[1:] {
+		if t.Uid != uid || t.Gid != gid {
+			log.Warning("Members of " + a.dest + " have different owners, keeping the default owner")
+			return
+		}
+	}
+	a.fs().Chown(name, uid, gid)
+}
+
+// process builds the archive and, if it differs from the one at dest,
+// atomically replaces it through a temporary file renamed over dest.
+// The check command of each member resource is run before, against its
+// staged contents, and its reload command afterwards.
+// It returns an error if any.
+func (a *archive) process() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	contents, members, err := a.build()
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Comparing candidate archive to " + a.dest)
+	if !a.changed(contents) {
+		log.Debug("Target archive " + a.dest + " in sync")
+		return nil
+	}
+	log.Info("Target archive " + a.dest + " out of sync")
+	if err := a.check(members); err != nil {
+		return err
+	}
+	if a.resources[0].noop {
+		log.Warning("Noop mode enabled. " + a.dest + " will not be modified")
+		return nil
+	}
+
+	fs := a.fs()
+	temp, err := afero.TempFile(fs, filepath.Dir(a.dest), "."+filepath.Base(a.dest))
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(contents); err != nil {
+		temp.Close()
+		fs.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		fs.Remove(temp.Name())
+		return err
+	}
+	if err := fs.Chmod(temp.Name(), a.fileMode()); err != nil {
+		fs.Remove(temp.Name())
+		return err
+	}
+	a.chown(temp.Name())
+	log.Debug("Overwriting target archive " + a.dest)
+	if err := fs.Rename(temp.Name(), a.dest); err != nil {
+		fs.Remove(temp.Name())
+		return err
+	}
+
+	var lastErr error
+	for _, t := range a.resources {
+		if t.hasReload() {
+			if err := t.reload(context.Background()); err != nil {
+				log.Error(err.Error())
+				lastErr = err
+			}
+		}
+	}
+	log.Info("Target archive " + a.dest + " has been updated")
+	return lastErr
+}
@@ -0,0 +1,109 @@
+package template
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/abtreece/confd/pkg/log"
+	"github.com/spf13/afero"
+)
+
+// auditRecord is the JSON line recorded for each sync of a target config.
+// Action is write, remove or skip, the latter when the config is in sync.
+// Checksums are the SHA-256 of the target config before and after, empty
+// when it doesn't exist.
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Resource    string    `json:"resource"`
+	Dest        string    `json:"dest"`
+	Action      string    `json:"action"`
+	OldChecksum string    `json:"old_checksum"`
+	NewChecksum string    `json:"new_checksum"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// auditLog appends the audit records of the template resources sharing it
+// to a writer, one JSON line at a time.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newAuditLog returns an audit log writing to w, or nil, which records
+// nothing, if w is nil.
+func newAuditLog(w io.Writer) *auditLog {
+	if w == nil {
+		return nil
+	}
+	return &auditLog{w: w}
+}
+
+// record writes r. Failures are logged so that they don't fail the sync.
+func (a *auditLog) record(r auditRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Error("Cannot encode audit record - " + err.Error())
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		log.Error("Cannot write audit record - " + err.Error())
+	}
+}
+
+// fileChecksum returns the hex SHA-256 of the file name, or an empty string
+// if it doesn't exist or isn't a regular file, such as a FIFO.
+// It returns an error if it can't be read.
+func fileChecksum(fs afero.Fs, name string) (string, error) {
+	fi, err := fs.Stat(name)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", nil
+	}
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// audit records the sync of t with action, turning a remove of a missing
+// dest into a skip. err is the result of the sync.
+func (t *TemplateResource) audit(action, oldChecksum string, err error) {
+	// An unreadable dest is recorded without a checksum.
+	newChecksum, _ := fileChecksum(t.fs, t.Dest)
+	r := auditRecord{
+		Time:        time.Now().UTC(),
+		Resource:    t.resourcePath,
+		Dest:        t.Dest,
+		Action:      action,
+		OldChecksum: oldChecksum,
+		NewChecksum: newChecksum,
+		Result:      "ok",
+	}
+	if action == "remove" && oldChecksum == "" {
+		r.Action = "skip"
+	}
+	if err != nil {
+		r.Result = "failed"
+		r.Error = err.Error()
+	}
+	t.auditLog.record(r)
+}
@@ -0,0 +1,69 @@
+package template
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/abtreece/confd/pkg/backends"
+)
+
+// cachingStoreClient wraps a StoreClient to fetch each key from the backend
+// only once, so template resources sharing keys don't query them again.
+// It is meant to live for a single processing run.
+type cachingStoreClient struct {
+	backends.StoreClient
+	mu     sync.Mutex
+	values map[string]map[string]string
+}
+
+func newCachingStoreClient(client backends.StoreClient) *cachingStoreClient {
+	return &cachingStoreClient{
+		StoreClient: client,
+		values:      make(map[string]map[string]string),
+	}
+}
+
+// GetValues returns the values of keys, querying the wrapped StoreClient
+// once for all the keys which weren't requested before.
+func (c *cachingStoreClient) GetValues(keys []string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var missing []string
+	for _, key := range keys {
+		if _, ok := c.values[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		result, err := c.StoreClient.GetValues(missing)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range missing {
+			c.values[key] = make(map[string]string)
+			for k, v := range result {
+				if c.isUnder(k, key) {
+					c.values[key][k] = v
+				}
+			}
+		}
+	}
+
+	vars := make(map[string]string)
+	for _, key := range keys {
+		for k, v := range c.values[key] {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+// isUnder reports whether k, a key returned by the wrapped StoreClient, is
+// key or is under it, once key is transformed as the StoreClient does.
+func (c *cachingStoreClient) isUnder(k, key string) bool {
+	if t, ok := c.StoreClient.(backends.KeyTransformer); ok {
+		key = t.TransformKey(key)
+	}
+	return k == key || strings.HasPrefix(k, strings.TrimSuffix(key, "/")+"/")
+}
@@ -0,0 +1,85 @@
+package template
+
+import (
+	"os"
+
+	"github.com/abtreece/confd/pkg/log"
+	util "github.com/abtreece/confd/pkg/util"
+	"github.com/fsnotify/fsnotify"
+)
+
+// confDirWatcher watches the template resource files of conf.d directories
+// and their subdirectories, including the ones created later.
+type confDirWatcher struct {
+	watcher *fsnotify.Watcher
+	// changes receives a value when resource files were added, modified or
+	// removed since it was last received from.
+	changes chan struct{}
+}
+
+func newConfDirWatcher(roots ...string) (*confDirWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		dirs, err := util.RecursiveDirsLookup(root, "*")
+		if err != nil {
+			watcher.Close()
+			return nil, err
+		}
+		for _, d := range dirs {
+			if err := watcher.Add(d); err != nil {
+				watcher.Close()
+				return nil, err
+			}
+		}
+	}
+	w := &confDirWatcher{watcher: watcher, changes: make(chan struct{}, 1)}
+	go w.run()
+	return w, nil
+}
+
+func (w *confDirWatcher) run() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			log.Debug("Template resource event: %s", event)
+			if event.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+					if err := w.watcher.Add(event.Name); err != nil {
+						log.Error("Cannot watch template resources in " + event.Name + " - " + err.Error())
+					}
+					w.notify()
+					continue
+				}
+			}
+			// A removed or renamed dir may have held resource files.
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 ||
+				(isResourceFile(event.Name) && event.Op != fsnotify.Chmod) {
+				w.notify()
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error("Cannot watch template resources - " + err.Error())
+		}
+	}
+}
+
+// notify records a change without blocking, changes made before the
+// previous one was received from coalescing into it.
+func (w *confDirWatcher) notify() {
+	select {
+	case w.changes <- struct{}{}:
+	default:
+	}
+}
+
+func (w *confDirWatcher) close() {
+	w.watcher.Close()
+}
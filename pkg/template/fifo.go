@@ -0,0 +1,73 @@
+package template
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/abtreece/confd/pkg/log"
+	"github.com/spf13/afero"
+)
+
+// fifoPollInterval is the delay between attempts to open a FIFO dest which
+// has no reader yet.
+const fifoPollInterval = 100 * time.Millisecond
+
+// defaultFIFOTimeout bounds the wait for a reader of a FIFO dest when the
+// resource sets no timeout.
+const defaultFIFOTimeout = 30 * time.Second
+
+// isFIFODest reports whether the dest is a named pipe. A FIFO has no
+// contents to compare or read back, reading it would block until a writer
+// comes along.
+func (t *TemplateResource) isFIFODest() bool {
+	fi, err := t.fs.Stat(t.Dest)
+	return err == nil && fi.Mode()&os.ModeNamedPipe != 0
+}
+
+// writeFIFO writes the staged file into the FIFO dest, which a rename would
+// replace rather than write to. The reader gets the whole config before the
+// dest is closed. Opening the dest doesn't block, it is retried until a
+// reader opens the other end, for up to the resource timeout or else
+// defaultFIFOTimeout.
+// It returns an error if any.
+func (t *TemplateResource) writeFIFO(ctx context.Context, staged string) error {
+	log.Debug("Writing target config " + t.destName() + " to its reader")
+	contents, err := afero.ReadFile(t.fs, staged)
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultFIFOTimeout)
+		defer cancel()
+	}
+	var f afero.File
+	for {
+		f, err = t.fs.OpenFile(t.Dest, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.ENXIO) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("No reader opened %s - %w", t.Dest, ctx.Err())
+		case <-time.After(fifoPollInterval):
+		}
+	}
+	// A reader which stops reading mustn't block the write forever.
+	if d, ok := f.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		deadline, _ := ctx.Deadline()
+		d.SetWriteDeadline(deadline)
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,95 @@
+//go:build !windows
+// +build !windows
+
+package template
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/abtreece/confd/pkg/log"
+	"github.com/spf13/afero"
+)
+
+func TestFIFODest(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+`, "foo = bar\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := syscall.Mkfifo(tr.Dest, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The reader drains each config written until the writer closes.
+	received := make(chan string)
+	go func() {
+		for i := 0; i < 2; i++ {
+			f, err := os.Open(tr.Dest)
+			if err != nil {
+				received <- err.Error()
+				return
+			}
+			b, _ := io.ReadAll(f)
+			f.Close()
+			received <- string(b)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		select {
+		case got := <-received:
+			if got != "foo = bar\n" {
+				t.Errorf("Expected the reader to receive %q, got %q", "foo = bar\n", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the reader")
+		}
+	}
+	fi, err := os.Lstat(tr.Dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("Expected %s to still be a FIFO, got mode %s", tr.Dest, fi.Mode())
+	}
+}
+
+func TestFIFODestNoReader(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+timeout = "300ms"
+`, "foo = bar\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tr.Dest = filepath.Join(confDir, "test.fifo")
+	if err := syscall.Mkfifo(tr.Dest, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = tr.process()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected processing to time out without a reader, got %v", err)
+	}
+}
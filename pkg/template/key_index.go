@@ -0,0 +1,77 @@
+package template
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	util "github.com/abtreece/confd/pkg/util"
+)
+
+// keyIndex maps the store keys of template resources, prefix included, to
+// the resources, so that the resources affected by changed keys are found
+// without matching every resource against every key.
+type keyIndex struct {
+	resources []*TemplateResource
+	byKey     map[string][]*TemplateResource
+	// keys holds the keys of byKey, sorted to find the keys under a
+	// changed key.
+	keys []string
+}
+
+func newKeyIndex(ts []*TemplateResource) *keyIndex {
+	idx := &keyIndex{resources: ts, byKey: make(map[string][]*TemplateResource)}
+	for _, t := range ts {
+		for _, k := range util.AppendPrefix(t.Prefix, t.Keys) {
+			if _, ok := idx.byKey[k]; !ok {
+				idx.keys = append(idx.keys, k)
+			}
+			idx.byKey[k] = append(idx.byKey[k], t)
+		}
+	}
+	sort.Strings(idx.keys)
+	return idx
+}
+
+// affected returns, in their original order, the resources with a key
+// equal to, above or under one of the changed keys. All the members of an
+// archive are returned when any of them is affected, as it is rebuilt
+// whole.
+func (idx *keyIndex) affected(changed []string) []*TemplateResource {
+	hit := make(map[*TemplateResource]bool)
+	mark := func(k string) {
+		for _, t := range idx.byKey[k] {
+			hit[t] = true
+		}
+	}
+	for _, k := range changed {
+		k = path.Join("/", k)
+		// The resource keys the changed key is, or is under.
+		for parent := k; ; parent = path.Dir(parent) {
+			mark(parent)
+			if parent == "/" {
+				break
+			}
+		}
+		// The resource keys under the changed key, such as when a whole
+		// directory was removed.
+		under := strings.TrimSuffix(k, "/") + "/"
+		for i := sort.SearchStrings(idx.keys, under); i < len(idx.keys) && strings.HasPrefix(idx.keys[i], under); i++ {
+			mark(idx.keys[i])
+		}
+	}
+
+	archives := make(map[string]bool)
+	for t := range hit {
+		if t.TarDest != "" {
+			archives[t.TarDest] = true
+		}
+	}
+	var ts []*TemplateResource
+	for _, t := range idx.resources {
+		if hit[t] || archives[t.TarDest] {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
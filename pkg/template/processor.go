@@ -2,6 +2,9 @@ package template
 
 import (
 	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,21 +18,240 @@ type Processor interface {
 }
 
 func Process(config Config) error {
+	if err := checkRequiredKeys(config); err != nil {
+		return err
+	}
+	ts, err := getTemplateResources(withValueCache(config))
+	if err != nil {
+		return err
+	}
+	if err := snapshotStore(config, ts); err != nil {
+		return err
+	}
+	return process(ts)
+}
+
+// ProcessChanged processes only the template resources affected by the
+// changed store keys, such as those reported by a watch, instead of every
+// resource. A resource is affected when one of its keys, prefix included,
+// is a changed key, or is above or under one.
+func ProcessChanged(config Config, changed []string) error {
 	ts, err := getTemplateResources(config)
 	if err != nil {
 		return err
 	}
+	return newChangeProcessor(config, ts).process(changed)
+}
+
+// changeProcessor processes the template resources affected by changed
+// store keys, with their key index built once for all the changes.
+type changeProcessor struct {
+	config Config
+	index  *keyIndex
+	// mu serializes the runs, which may share resources.
+	mu sync.Mutex
+}
+
+func newChangeProcessor(config Config, ts []*TemplateResource) *changeProcessor {
+	return &changeProcessor{config: config, index: newKeyIndex(ts)}
+}
+
+// process processes the resources affected by the changed keys, as Process
+// does for every resource.
+// It returns an error if any.
+func (c *changeProcessor) process(changed []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := checkRequiredKeys(c.config); err != nil {
+		return err
+	}
+	ts := c.index.affected(changed)
+	// Each run reads the store afresh, through a new cache if CacheValues
+	// is set.
+	client := withValueCache(c.config).StoreClient
+	for _, t := range ts {
+		t.storeClient = client
+	}
+	if err := snapshotStore(c.config, ts); err != nil {
+		return err
+	}
 	return process(ts)
 }
 
+// RenderResource renders the template resource at resourcePath and returns
+// its contents, for programs embedding confd. Nothing is staged or written
+// and the check and reload commands aren't run.
+func RenderResource(fs afero.Fs, resourcePath string, c Config) ([]byte, error) {
+	t, err := NewTemplateResource(fs, resourcePath, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.setVars(); err != nil {
+		return nil, err
+	}
+	return t.contents()
+}
+
+// VerifyDrift renders every template resource without modifying anything and
+// compares the result against its dest.
+// It returns the dests which are out of sync with the store.
+func VerifyDrift(config Config) ([]string, error) {
+	ts, err := getTemplateResources(config)
+	if err != nil {
+		return nil, err
+	}
+	var drifted []string
+	var lastErr error
+	ts, archives := groupArchives(ts)
+	for _, t := range ts {
+		changed, err := t.drifted()
+		if err != nil {
+			log.Error(err.Error())
+			lastErr = err
+			continue
+		}
+		if changed {
+			drifted = append(drifted, t.Dest)
+		}
+	}
+	for _, a := range archives {
+		changed, err := a.drifted()
+		if err != nil {
+			log.Error(err.Error())
+			lastErr = err
+			continue
+		}
+		if changed {
+			drifted = append(drifted, a.dest)
+		}
+	}
+	return drifted, lastErr
+}
+
+// Diff renders every template resource without modifying anything and
+// compares the result against its dest.
+// It returns, by dest out of sync with the store, the unified diff that
+// processing would apply. Archives are compared as a whole.
+func Diff(config Config) (map[string]string, error) {
+	ts, err := getTemplateResources(config)
+	if err != nil {
+		return nil, err
+	}
+	diffs := make(map[string]string)
+	var lastErr error
+	ts, archives := groupArchives(ts)
+	for _, t := range ts {
+		diff, changed, err := t.diff()
+		if err != nil {
+			log.Error(err.Error())
+			lastErr = err
+			continue
+		}
+		if changed {
+			diffs[t.Dest] = diff
+		}
+	}
+	for _, a := range archives {
+		changed, err := a.drifted()
+		if err != nil {
+			log.Error(err.Error())
+			lastErr = err
+			continue
+		}
+		if changed {
+			diffs[a.dest] = "Binary archive " + a.dest + " differs\n"
+		}
+	}
+	return diffs, lastErr
+}
+
+// checkRequiredKeys returns an error listing the keys of RequireKeys that
+// have neither a value nor values under them in the store.
+func checkRequiredKeys(config Config) error {
+	if len(config.RequireKeys) == 0 {
+		return nil
+	}
+	prefix := path.Join("/", config.Prefix)
+	values, err := config.StoreClient.GetValues(util.AppendPrefix(prefix, config.RequireKeys))
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, key := range config.RequireKeys {
+		k := path.Join(prefix, key)
+		found := false
+		for v := range values {
+			if v == k || strings.HasPrefix(v, strings.TrimSuffix(k, "/")+"/") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Required keys are missing from the store: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// withValueCache returns config with its StoreClient wrapped in a new cache
+// if CacheValues is set, so that a single run fetches each key once.
+func withValueCache(config Config) Config {
+	if config.CacheValues {
+		config.StoreClient = newCachingStoreClient(config.StoreClient)
+	}
+	return config
+}
+
+// snapshotStore fetches the keys of all the template resources at once if
+// SnapshotStore is set, and has the resources read their values from this
+// snapshot rather than from the backend, so that they all render the same
+// state of the store even if it changes during the run. Keys read with
+// getvAbsolute are still fetched when rendering.
+// It returns an error if fetching the snapshot fails.
+func snapshotStore(config Config, ts []*TemplateResource) error {
+	if !config.SnapshotStore || len(ts) == 0 {
+		return nil
+	}
+	snapshot := newCachingStoreClient(config.StoreClient)
+	var keys []string
+	for _, t := range ts {
+		keys = append(keys, util.AppendPrefix(t.Prefix, t.Keys)...)
+	}
+	if _, err := snapshot.GetValues(keys); err != nil {
+		return err
+	}
+	for _, t := range ts {
+		t.storeClient = snapshot
+	}
+	return nil
+}
+
 func process(ts []*TemplateResource) error {
 	var lastErr error
+	ts, archives := groupArchives(ts)
 	for _, t := range ts {
 		if err := t.process(); err != nil {
 			log.Error(err.Error())
 			lastErr = err
 		}
 	}
+	if err := processArchives(archives); err != nil {
+		lastErr = err
+	}
+	return lastErr
+}
+
+func processArchives(archives []*archive) error {
+	var lastErr error
+	for _, a := range archives {
+		if err := a.process(); err != nil {
+			log.Error(err.Error())
+			lastErr = err
+		}
+	}
 	return lastErr
 }
 
@@ -39,71 +261,196 @@ type intervalProcessor struct {
 	doneChan chan bool
 	errChan  chan error
 	interval int
+	retries  map[string]reloadRetry
+	renders  map[string]renderCache
+	previous map[string]map[string]string
 }
 
 func IntervalProcessor(config Config, stopChan, doneChan chan bool, errChan chan error, interval int) Processor {
-	return &intervalProcessor{config, stopChan, doneChan, errChan, interval}
+	return &intervalProcessor{config, stopChan, doneChan, errChan, interval, make(map[string]reloadRetry), make(map[string]renderCache), make(map[string]map[string]string)}
 }
 
 func (p *intervalProcessor) Process() {
 	defer close(p.doneChan)
-	for {
-		ts, err := getTemplateResources(p.config)
+	changes, closeWatcher := watchConfDir(p.config)
+	defer closeWatcher()
+	for first := true; ; first = false {
+		ts, err := getTemplateResources(withValueCache(p.config))
 		if err != nil {
-			log.Fatal(err.Error())
-			break
+			// Resource files being edited may fail to load once running,
+			// keep processing the others until they're fixed.
+			if first {
+				log.Fatal(err.Error())
+				break
+			}
+			p.errChan <- err
+		}
+		// Nothing is rendered until the required keys are in the store.
+		if err := checkRequiredKeys(p.config); err != nil {
+			p.errChan <- err
+		} else if err := snapshotStore(p.config, ts); err != nil {
+			p.errChan <- err
+		} else {
+			pending, err := p.process(ts)
+			if err != nil {
+				p.errChan <- err
+			}
+			if len(pending) > 0 {
+				p.errChan <- fmt.Errorf("Reload pending for %s", strings.Join(pending, ", "))
+			}
 		}
-		process(ts)
 		select {
 		case <-p.stopChan:
-			break
+			return
+		case <-changes:
+			log.Info("Template resources changed, reloading")
 		case <-time.After(time.Duration(p.interval) * time.Second):
-			continue
 		}
 	}
 }
 
+// watchConfDir returns a channel receiving a value when the template
+// resource files change if WatchConfDir is set, and a nil channel otherwise,
+// along with the function releasing the watcher.
+func watchConfDir(config Config) (<-chan struct{}, func()) {
+	if !config.WatchConfDir {
+		return nil, func() {}
+	}
+	w, err := newConfDirWatcher(configDirs(config)...)
+	if err != nil {
+		log.Error("Cannot watch template resources - " + err.Error())
+		return nil, func() {}
+	}
+	return w.changes, w.close
+}
+
+// process runs a single interval. Template resources are reloaded from the
+// confdir on every interval, so reload failures are carried over by dest to
+// have them retried on the next intervals, and so are the render caches of
+// resources setting skip_unchanged and the values of the last successful
+// run, for the changed and previous functions.
+// It returns the dests whose reload is still pending, and the error of the
+// archives if any.
+func (p *intervalProcessor) process(ts []*TemplateResource) ([]string, error) {
+	var pending []string
+	ts, archives := groupArchives(ts)
+	for _, t := range ts {
+		t.reloadRetry = p.retries[t.Dest]
+		t.renderCache = p.renders[t.Dest]
+		t.previousValues = p.previous[t.Dest]
+		if err := t.process(); err != nil {
+			log.Error(err.Error())
+		}
+		if t.cachesRender() {
+			p.renders[t.Dest] = t.renderCache
+		}
+		if t.previousValues != nil {
+			p.previous[t.Dest] = t.previousValues
+		}
+		if t.reloadRetry.failures > 0 {
+			p.retries[t.Dest] = t.reloadRetry
+			pending = append(pending, t.destName())
+		} else {
+			delete(p.retries, t.Dest)
+		}
+	}
+	// Archives are processed after the other resources, as in process.
+	return pending, processArchives(archives)
+}
+
 type watchProcessor struct {
 	config   Config
 	stopChan chan bool
 	doneChan chan bool
 	errChan  chan error
-	wg       sync.WaitGroup
 }
 
 func WatchProcessor(config Config, stopChan, doneChan chan bool, errChan chan error) Processor {
-	var wg sync.WaitGroup
-	return &watchProcessor{config, stopChan, doneChan, errChan, wg}
+	return &watchProcessor{config, stopChan, doneChan, errChan}
 }
 
+// Process monitors the template resources until stopChan receives. When
+// WatchConfDir is set and the resource files change, the monitors are
+// stopped and the resources reloaded and processed before being monitored
+// again.
 func (p *watchProcessor) Process() {
 	defer close(p.doneChan)
+	changes, closeWatcher := watchConfDir(p.config)
+	defer closeWatcher()
 	ts, err := getTemplateResources(p.config)
 	if err != nil {
 		log.Fatal(err.Error())
 		return
 	}
+	for {
+		stop := make(chan bool)
+		wg := p.monitor(ts, newChangeProcessor(p.config, ts), stop)
+		select {
+		case <-p.stopChan:
+			close(stop)
+			wg.Wait()
+			return
+		case <-changes:
+			log.Info("Template resources changed, reloading")
+			close(stop)
+			wg.Wait()
+		}
+		ts, err = getTemplateResources(p.config)
+		if err != nil {
+			p.errChan <- err
+		}
+		// Nothing is rendered until the required keys are in the store.
+		if err := checkRequiredKeys(p.config); err != nil {
+			p.errChan <- err
+		} else if err := process(ts); err != nil {
+			p.errChan <- err
+		}
+	}
+}
+
+// monitor starts monitoring the keys of ts until stop is closed, once for
+// the resources watching the same keys. The resources affected by the keys
+// of a monitor, archives included, are processed by changes when they
+// change.
+// It returns the wait group of the monitors.
+func (p *watchProcessor) monitor(ts []*TemplateResource, changes *changeProcessor, stop chan bool) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	watched := make(map[string]bool)
 	for _, t := range ts {
-		t := t
-		p.wg.Add(1)
-		go p.monitorPrefix(t)
+		keys := util.AppendPrefix(t.Prefix, t.Keys)
+		id := t.Prefix + "\x00" + strings.Join(keys, "\x00")
+		if watched[id] {
+			continue
+		}
+		watched[id] = true
+		wg.Add(1)
+		go p.monitorPrefix(wg, t.Prefix, keys, changes, stop)
 	}
-	p.wg.Wait()
+	return wg
 }
 
-func (p *watchProcessor) monitorPrefix(t *TemplateResource) {
-	defer p.wg.Done()
-	keys := util.AppendPrefix(t.Prefix, t.Keys)
+func (p *watchProcessor) monitorPrefix(wg *sync.WaitGroup, prefix string, keys []string, changes *changeProcessor, stop chan bool) {
+	defer wg.Done()
+	var lastIndex uint64
 	for {
-		index, err := t.storeClient.WatchPrefix(t.Prefix, keys, t.lastIndex, p.stopChan)
+		index, err := p.config.StoreClient.WatchPrefix(prefix, keys, lastIndex, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
 		if err != nil {
 			p.errChan <- err
 			// Prevent backend errors from consuming all resources.
-			time.Sleep(time.Second * 2)
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second * 2):
+			}
 			continue
 		}
-		t.lastIndex = index
-		if err := t.process(); err != nil {
+		lastIndex = index
+		if err := changes.process(keys); err != nil {
 			p.errChan <- err
 		}
 	}
@@ -113,15 +460,21 @@ func getTemplateResources(config Config) ([]*TemplateResource, error) {
 	var lastError error
 	fs := afero.NewOsFs()
 	templates := make([]*TemplateResource, 0)
+	// Reloads are staggered across all the resources of the run.
+	stagger := newReloadStagger(config.ReloadJitter)
+	audit := newAuditLog(config.AuditLog)
 	log.Debug("Loading template resources from confdir " + config.ConfDir)
 	if !util.IsFileExist(fs, config.ConfDir) {
 		log.Warning(fmt.Sprintf("Cannot load template resources: confdir '%s' does not exist", config.ConfDir))
 		return nil, nil
 	}
-	paths, err := util.RecursiveFilesLookup(config.ConfigDir, "*toml")
+	paths, err := lookupResourceFiles(configDirs(config))
 	if err != nil {
 		return nil, err
 	}
+	if _, err := filepath.Match(config.ResourceFilter, ""); err != nil {
+		return nil, fmt.Errorf("Invalid resource filter %q - %s", config.ResourceFilter, err.Error())
+	}
 
 	if len(paths) < 1 {
 		log.Warning("Found no templates")
@@ -134,7 +487,91 @@ func getTemplateResources(config Config) ([]*TemplateResource, error) {
 			lastError = err
 			continue
 		}
+		if !matchesResourceFilter(config.ResourceFilter, p, t.Dest) {
+			log.Debug(fmt.Sprintf("Skipping template %s, not matching the resource filter", p))
+			continue
+		}
+		t.reloadStagger = stagger
+		t.auditLog = audit
 		templates = append(templates, t)
 	}
 	return templates, lastError
 }
+
+// matchesResourceFilter reports whether the resource file name, its dest or
+// the file name of its dest match the glob pattern. Every resource matches
+// an empty pattern.
+func matchesResourceFilter(pattern, resourcePath, dest string) bool {
+	if pattern == "" {
+		return true
+	}
+	for _, name := range []string{filepath.Base(resourcePath), dest, filepath.Base(dest)} {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// configDirs returns the directories of the template resources, ConfigDir
+// followed by the ConfigDirs.
+func configDirs(config Config) []string {
+	var dirs []string
+	if config.ConfigDir != "" {
+		dirs = append(dirs, config.ConfigDir)
+	}
+	return append(dirs, config.ConfigDirs...)
+}
+
+// resourcePatterns match the names of the template resource files, TOML
+// ones, the default, and YAML or JSON ones, named after resourceSuffixes.
+var resourcePatterns = []string{"*toml", "*.resource.yaml", "*.resource.yml", "*.resource.json"}
+
+// isResourceFile reports whether name is the name of a template resource
+// file.
+func isResourceFile(name string) bool {
+	for _, pattern := range resourcePatterns {
+		if ok, _ := filepath.Match(pattern, filepath.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupResourceFiles returns the template resource files of the dirs. A
+// file replaces the file at the same path relative to an earlier dir, in
+// its place.
+// It returns an error if any.
+func lookupResourceFiles(dirs []string) ([]string, error) {
+	var paths []string
+	index := make(map[string]int)
+	for _, dir := range dirs {
+		var found []string
+		for _, pattern := range resourcePatterns {
+			f, err := util.RecursiveFilesLookup(dir, pattern)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, f...)
+		}
+		// The files are found under the dir with its symlinks resolved.
+		root, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range found {
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return nil, err
+			}
+			if i, ok := index[rel]; ok {
+				log.Debug(fmt.Sprintf("Template resource %s overrides %s", p, paths[i]))
+				paths[i] = p
+				continue
+			}
+			index[rel] = len(paths)
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
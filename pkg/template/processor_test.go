@@ -0,0 +1,1565 @@
+package template
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abtreece/confd/pkg/backends/env"
+	"github.com/abtreece/confd/pkg/log"
+	util "github.com/abtreece/confd/pkg/util"
+	"github.com/spf13/afero"
+)
+
+func TestIntervalProcessorRetriesFailedReload(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+`, "foo = bar\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// The reload fails the first time it runs only.
+	marker := filepath.Join(confDir, "reloaded")
+	tr.ReloadCmd = "test -f " + marker + " || { touch " + marker + "; exit 1; }"
+
+	p := &intervalProcessor{retries: make(map[string]reloadRetry), renders: make(map[string]renderCache), previous: make(map[string]map[string]string)}
+	pending, _ := p.process([]*TemplateResource{tr})
+	if len(pending) != 1 || pending[0] != tr.Dest {
+		t.Fatalf("Expected reload pending for %s, got %v", tr.Dest, pending)
+	}
+
+	pending, _ = p.process([]*TemplateResource{tr})
+	if len(pending) != 0 {
+		t.Errorf("Expected no pending reloads after retry, got %v", pending)
+	}
+	if len(p.retries) != 0 {
+		t.Errorf("Expected retries to be cleared, got %v", p.retries)
+	}
+}
+
+func TestReloadRetryBackoff(t *testing.T) {
+	var r reloadRetry
+	if r.due() {
+		t.Error("Expected no retry before any failure")
+	}
+	r.failed()
+	if !r.due() {
+		t.Error("Expected a retry on the run after the first failure")
+	}
+	r.failed()
+	if r.due() {
+		t.Error("Expected the run after the second failure to be skipped")
+	}
+	if !r.due() {
+		t.Error("Expected a retry once the skipped run elapsed")
+	}
+	for i := 0; i < 10; i++ {
+		r.failed()
+	}
+	if r.skip != maxReloadRetrySkip {
+		t.Errorf("Expected skip to be capped at %d, got %d", maxReloadRetrySkip, r.skip)
+	}
+}
+
+func TestIntervalProcessorReloadBreaker(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+reload_breaker = 2
+reload_breaker_cooldown = "1h"
+`, "foo = bar\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// The reload counts its runs and fails until the marker exists.
+	reloads := filepath.Join(confDir, "reloads")
+	marker := filepath.Join(confDir, "healthy")
+	tr.ReloadCmd = "echo >> " + reloads + "; test -f " + marker
+
+	countReloads := func() int {
+		b, _ := afero.ReadFile(fs, reloads)
+		return strings.Count(string(b), "\n")
+	}
+
+	p := &intervalProcessor{retries: make(map[string]reloadRetry), renders: make(map[string]renderCache), previous: make(map[string]map[string]string)}
+	// The first run fails, the second retries and fails, opening the circuit.
+	p.process([]*TemplateResource{tr})
+	p.process([]*TemplateResource{tr})
+	if n := countReloads(); n != 2 {
+		t.Fatalf("Expected 2 reloads before the circuit opens, got %d", n)
+	}
+	if !time.Now().Before(p.retries[tr.Dest].openUntil) {
+		t.Fatal("Expected the reload circuit to be open")
+	}
+
+	// No reload runs while the circuit is open, even once the dest changes.
+	for i := 0; i < 3; i++ {
+		pending, _ := p.process([]*TemplateResource{tr})
+		if len(pending) != 1 {
+			t.Errorf("Expected the reload to stay pending, got %v", pending)
+		}
+	}
+	if err := afero.WriteFile(fs, tr.Dest, []byte("stale\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	p.process([]*TemplateResource{tr})
+	if n := countReloads(); n != 2 {
+		t.Errorf("Expected no reload while the circuit is open, got %d reloads", n)
+	}
+
+	// Once the cooldown elapsed, the reload is retried and, failing, reopens
+	// the circuit right away.
+	r := p.retries[tr.Dest]
+	r.openUntil = time.Now().Add(-time.Second)
+	p.retries[tr.Dest] = r
+	p.process([]*TemplateResource{tr})
+	if n := countReloads(); n != 3 {
+		t.Errorf("Expected a reload once the cooldown elapsed, got %d reloads", n)
+	}
+	if !time.Now().Before(p.retries[tr.Dest].openUntil) {
+		t.Error("Expected the reload circuit to reopen after a failed retry")
+	}
+
+	// A successful retry after the cooldown closes the circuit.
+	if err := afero.WriteFile(fs, marker, nil, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	r = p.retries[tr.Dest]
+	r.openUntil = time.Now().Add(-time.Second)
+	p.retries[tr.Dest] = r
+	if pending, _ := p.process([]*TemplateResource{tr}); len(pending) != 0 {
+		t.Errorf("Expected no pending reloads after recovery, got %v", pending)
+	}
+	if len(p.retries) != 0 {
+		t.Errorf("Expected retries to be cleared, got %v", p.retries)
+	}
+	if n := countReloads(); n != 4 {
+		t.Errorf("Expected 4 reloads, got %d", n)
+	}
+}
+
+// writeTestResource writes the resource toml and its src template, both
+// named after name, to the conf.d and templates directories of confDir.
+func writeTestResource(fs afero.Fs, confDir, name, resource, tmpl string) error {
+	err := afero.WriteFile(fs, filepath.Join(confDir, "conf.d", name+".toml"), []byte(resource), 0644)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, filepath.Join(confDir, "templates", name+".tmpl"), []byte(tmpl), 0644)
+}
+
+// testConfig returns a Config for confDir using an env StoreClient.
+func testConfig(confDir string) (Config, error) {
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		return Config{}, err
+	}
+	return Config{
+		ConfDir:     confDir,
+		ConfigDir:   filepath.Join(confDir, "conf.d"),
+		StoreClient: storeClient,
+		TemplateDir: filepath.Join(confDir, "templates"),
+	}, nil
+}
+
+func TestProcessConfigDirs(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+
+	resource := func(name, dest string) string {
+		return "[template]\nsrc = \"" + name + ".tmpl\"\ndest = \"" + filepath.Join(confDir, dest) + "\"\nfetch_all = true\n"
+	}
+	for _, name := range []string{"app", "db"} {
+		if err := writeTestResource(fs, confDir, name, resource(name, name+".conf"), name+" = base\n"); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// The overrides replace app and add cache.
+	overrides := filepath.Join(confDir, "overrides")
+	if err := fs.MkdirAll(overrides, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{"app", "cache"} {
+		if err := afero.WriteFile(fs, filepath.Join(overrides, name+".toml"), []byte(resource(name+"-override", name+".conf")), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := afero.WriteFile(fs, filepath.Join(confDir, "templates", name+"-override.tmpl"), []byte(name+" = override\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	config, err := testConfig(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.ConfigDirs = util.Nodes{overrides}
+	if err := Process(config); err != nil {
+		t.Fatal(err.Error())
+	}
+	for name, expected := range map[string]string{
+		"app":   "app = override\n",
+		"db":    "db = base\n",
+		"cache": "cache = override\n",
+	} {
+		b, err := afero.ReadFile(fs, filepath.Join(confDir, name+".conf"))
+		if err != nil || string(b) != expected {
+			t.Errorf("Expected %s.conf to be %q, got %q (%v)", name, expected, b, err)
+		}
+	}
+
+	ts, err := getTemplateResources(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(ts) != 3 {
+		t.Errorf("Expected 3 template resources, got %d", len(ts))
+	}
+}
+
+func TestProcessResourceFilter(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+
+	names := []string{"nginx", "haproxy", "redis"}
+	for _, name := range names {
+		resource := "[template]\nsrc = \"" + name + ".tmpl\"\ndest = \"" + filepath.Join(confDir, name+".cfg") + "\"\nfetch_all = true\n"
+		if err := writeTestResource(fs, confDir, name, resource, name+"\n"); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	config, err := testConfig(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tests := []struct {
+		filter   string
+		expected []string
+	}{
+		{"", names},
+		{"nginx*", []string{"nginx"}},
+		{"haproxy.cfg", []string{"haproxy"}},
+		{filepath.Join(confDir, "red*"), []string{"redis"}},
+		{"none*", nil},
+	}
+	for _, tt := range tests {
+		config.ResourceFilter = tt.filter
+		ts, err := getTemplateResources(config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var got []string
+		for _, tr := range ts {
+			got = append(got, strings.TrimSuffix(filepath.Base(tr.Dest), ".cfg"))
+		}
+		sort.Strings(got)
+		expected := append([]string(nil), tt.expected...)
+		sort.Strings(expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("filter %q: expected %v, got %v", tt.filter, expected, got)
+		}
+	}
+
+	config.ResourceFilter = "nginx*"
+	if err := Process(config); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range names {
+		exists := util.IsFileExist(fs, filepath.Join(confDir, name+".cfg"))
+		if exists != (name == "nginx") {
+			t.Errorf("%s.cfg: expected it to be written only when selected, exists: %t", name, exists)
+		}
+	}
+
+	config.ResourceFilter = "["
+	if _, err := getTemplateResources(config); err == nil {
+		t.Error("Expected an error for an invalid resource filter, got nil")
+	}
+}
+
+func TestProcessReloadJitter(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+
+	// Each reload records the time it ran at.
+	reloads := filepath.Join(confDir, "reloads")
+	for _, name := range []string{"one", "two", "three"} {
+		err := writeTestResource(fs, confDir, name, `
+[template]
+src = "`+name+`.tmpl"
+dest = "`+filepath.Join(confDir, name+".conf")+`"
+fetch_all = true
+reload_cmd = "date +%s%N >> `+reloads+`"
+`, name+"\n")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	config, err := testConfig(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config.ReloadJitter = 200 * time.Millisecond
+	if err := Process(config); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	data, err := afero.ReadFile(fs, reloads)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Fields(string(data))
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 reloads, got %v", lines)
+	}
+	var previous int64
+	for i, line := range lines {
+		at, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if i > 0 && time.Duration(at-previous) < config.ReloadJitter/2 {
+			t.Errorf("Expected reloads spaced by at least %s, got %s", config.ReloadJitter/2, time.Duration(at-previous))
+		}
+		previous = at
+	}
+}
+
+func TestDiff(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+
+	stale := filepath.Join(confDir, "stale.conf")
+	current := filepath.Join(confDir, "current.conf")
+	for name, dest := range map[string]string{"stale": stale, "current": current} {
+		err := writeTestResource(fs, confDir, name, `
+[template]
+src = "`+name+`.tmpl"
+dest = "`+dest+`"
+mode = "0644"
+fetch_all = true
+`, "foo = bar\n")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := afero.WriteFile(fs, stale, []byte("foo = baz\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := afero.WriteFile(fs, current, []byte("foo = bar\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	config, err := testConfig(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	diffs, err := Diff(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{
+		stale: "--- " + stale + "\n+++ " + stale + "\n@@ -1 +1 @@\n-foo = baz\n+foo = bar\n",
+	}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("Expected %q, got %q", expected, diffs)
+	}
+
+	// Nothing is written and the staged files are removed.
+	actual, err := afero.ReadFile(fs, stale)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(actual) != "foo = baz\n" {
+		t.Errorf("Expected %s to be left untouched, got %q", stale, string(actual))
+	}
+	staged, err := afero.Glob(fs, filepath.Join(confDir, ".*"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(staged) != 0 {
+		t.Errorf("Expected staged files to be removed, got %v", staged)
+	}
+}
+
+func TestVerifyDrift(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+
+	stale := filepath.Join(confDir, "stale.conf")
+	current := filepath.Join(confDir, "current.conf")
+	for name, dest := range map[string]string{"stale": stale, "current": current} {
+		err := writeTestResource(fs, confDir, name, `
+[template]
+src = "`+name+`.tmpl"
+dest = "`+dest+`"
+mode = "0644"
+fetch_all = true
+`, "foo = bar\n")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := afero.WriteFile(fs, stale, []byte("foo = baz\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := afero.WriteFile(fs, current, []byte("foo = bar\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	fs.Chmod(current, 0644)
+
+	c, err := testConfig(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	drifted, err := VerifyDrift(c)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(drifted) != 1 || drifted[0] != stale {
+		t.Errorf("Expected drift for %s only, got %v", stale, drifted)
+	}
+	contents, err := afero.ReadFile(fs, stale)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(contents) != "foo = baz\n" {
+		t.Errorf("Expected %s to be left unmodified, got %q", stale, string(contents))
+	}
+}
+
+func TestProcessTarDest(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+
+	tarDest := filepath.Join(confDir, "bundle.tar")
+	resources := map[string]string{
+		"app":  `dest = "etc/app.conf"` + "\n" + `mode = "0600"` + "\n" + `check_cmd = "grep -q 'app = rendered' {{.src}}"`,
+		"hook": `dest = "bin/hook.sh"` + "\n" + `mode = "0755"`,
+	}
+	for name, fields := range resources {
+		err := writeTestResource(fs, confDir, name, `
+[template]
+src = "`+name+`.tmpl"
+tar_dest = "`+tarDest+`"
+fetch_all = true
+`+fields+"\n", name+" = rendered\n")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	c, err := testConfig(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Process(c); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// The 0600 member keeps the archive from being readable by others.
+	fi, err := fs.Stat(tarDest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected %s mode 0600, got %o", tarDest, fi.Mode().Perm())
+	}
+
+	f, err := fs.Open(tarDest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+	expected := []struct {
+		name     string
+		mode     int64
+		contents string
+	}{
+		{"bin/hook.sh", 0755, "hook = rendered\n"},
+		{"etc/app.conf", 0600, "app = rendered\n"},
+	}
+	tr := tar.NewReader(f)
+	for _, e := range expected {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("Expected member %s: %s", e.name, err.Error())
+		}
+		if hdr.Name != e.name || hdr.Mode != e.mode {
+			t.Errorf("Expected member %s mode %o, got %s mode %o", e.name, e.mode, hdr.Name, hdr.Mode)
+		}
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(contents) != e.contents {
+			t.Errorf("Expected %s to contain %q, got %q", e.name, e.contents, string(contents))
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Expected only %d members in %s", len(expected), tarDest)
+	}
+
+	drifted, err := VerifyDrift(c)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(drifted) != 0 {
+		t.Errorf("Expected no drift after processing, got %v", drifted)
+	}
+}
+
+func TestResourceFilesIgnoreStrayFiles(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+
+	err = writeTestResource(fs, confDir, "app", `
+[template]
+src = "app.tmpl"
+dest = "`+filepath.Join(confDir, "app.conf")+`"
+fetch_all = true
+`, "app\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Neither is a template resource, only .resource.yaml, .resource.yml
+	// and .resource.json files are.
+	for name, data := range map[string]string{
+		"app.yaml.bak": "template: [\n",
+		"backup.yaml":  "template: [\n",
+		"data.json":    `{"users": ["a"]}`,
+	} {
+		if err := afero.WriteFile(fs, filepath.Join(confDir, "conf.d", name), []byte(data), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	c, err := testConfig(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ts, err := getTemplateResources(c)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(ts) != 1 || ts[0].resourceName() != "app" {
+		t.Errorf("Expected only the app resource, got %d resources", len(ts))
+	}
+}
+
+func TestProcessTarDestCheck(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+
+	tarDest := filepath.Join(confDir, "bundle.tar")
+	err = writeTestResource(fs, confDir, "app", `
+[template]
+src = "app.tmpl"
+tar_dest = "`+tarDest+`"
+dest = "etc/app.conf"
+check_cmd = "grep -q ^valid {{.src}}"
+fetch_all = true
+`, "invalid\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := testConfig(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Process(c); err == nil || !strings.Contains(err.Error(), "Config check failed") {
+		t.Errorf("Expected the member check to fail, got %v", err)
+	}
+	if util.IsFileExist(fs, tarDest) {
+		t.Error("Expected no archive to be written when a member check fails")
+	}
+
+	ts, err := getTemplateResources(c)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	p := &intervalProcessor{retries: make(map[string]reloadRetry), renders: make(map[string]renderCache), previous: make(map[string]map[string]string)}
+	if _, err := p.process(ts); err == nil {
+		t.Error("Expected the interval to return the archive error")
+	}
+}
+
+// countingStoreClient is a StoreClient serving fixed values and counting
+// the GetValues calls.
+type countingStoreClient struct {
+	values map[string]string
+	calls  int
+	// keys holds the keys of the last call.
+	keys []string
+}
+
+func (c *countingStoreClient) GetValues(keys []string) (map[string]string, error) {
+	c.calls++
+	c.keys = keys
+	vars := make(map[string]string)
+	for k, v := range c.values {
+		for _, key := range keys {
+			if strings.HasPrefix(k, key) {
+				vars[k] = v
+			}
+		}
+	}
+	return vars, nil
+}
+
+func (c *countingStoreClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	<-stopChan
+	return 0, nil
+}
+
+func TestProcessCacheValues(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+
+	for _, name := range []string{"one", "two"} {
+		err := writeTestResource(fs, confDir, name, `
+[template]
+src = "`+name+`.tmpl"
+dest = "`+filepath.Join(confDir, name+".conf")+`"
+keys = ["/shared"]
+`, `{{getv "/shared/value"}}`)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	client := &countingStoreClient{values: map[string]string{"/shared/value": "foo"}}
+	c := Config{
+		CacheValues: true,
+		ConfDir:     confDir,
+		ConfigDir:   filepath.Join(confDir, "conf.d"),
+		StoreClient: client,
+		TemplateDir: filepath.Join(confDir, "templates"),
+	}
+	if err := Process(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	if client.calls != 1 {
+		t.Errorf("Expected GetValues to be called once, got %d", client.calls)
+	}
+	for _, name := range []string{"one", "two"} {
+		contents, err := afero.ReadFile(fs, filepath.Join(confDir, name+".conf"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(contents) != "foo" {
+			t.Errorf("Expected %s.conf to contain foo, got %q", name, string(contents))
+		}
+	}
+
+	// The cache doesn't outlive a run.
+	if err := Process(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	if client.calls != 2 {
+		t.Errorf("Expected GetValues to be called again on the next run, got %d calls", client.calls)
+	}
+}
+
+// changingStoreClient returns values which change on every call, as the
+// number of calls made, like a backend updated during a run.
+type changingStoreClient struct {
+	countingStoreClient
+}
+
+func (c *changingStoreClient) GetValues(keys []string) (map[string]string, error) {
+	for k := range c.values {
+		c.values[k] = strconv.Itoa(c.calls + 1)
+	}
+	return c.countingStoreClient.GetValues(keys)
+}
+
+func TestProcessSnapshotStore(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+
+	for name, prefix := range map[string]string{"one": "/db", "two": "/app"} {
+		err := writeTestResource(fs, confDir, name, `
+[template]
+src = "`+name+`.tmpl"
+dest = "`+filepath.Join(confDir, name+".conf")+`"
+keys = ["`+prefix+`"]
+`, `{{getv "`+prefix+`/generation"}}`)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	for _, tt := range []struct {
+		snapshot bool
+		want     map[string]string
+	}{
+		{false, map[string]string{"one": "1", "two": "2"}},
+		{true, map[string]string{"one": "1", "two": "1"}},
+	} {
+		client := &changingStoreClient{countingStoreClient{values: map[string]string{"/db/generation": "", "/app/generation": ""}}}
+		c := Config{
+			ConfDir:       confDir,
+			ConfigDir:     filepath.Join(confDir, "conf.d"),
+			SnapshotStore: tt.snapshot,
+			StoreClient:   client,
+			TemplateDir:   filepath.Join(confDir, "templates"),
+		}
+		if err := Process(c); err != nil {
+			t.Fatal(err.Error())
+		}
+		for name, want := range tt.want {
+			contents, err := afero.ReadFile(fs, filepath.Join(confDir, name+".conf"))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if string(contents) != want {
+				t.Errorf("With SnapshotStore %v, expected %s.conf to contain %s, got %q", tt.snapshot, name, want, string(contents))
+			}
+		}
+		if tt.snapshot && client.calls != 1 {
+			t.Errorf("Expected the snapshot to be fetched in a single call, got %d", client.calls)
+		}
+	}
+}
+
+func TestCachingStoreClientKeys(t *testing.T) {
+	client := &countingStoreClient{values: map[string]string{
+		"/app/name":         "shop",
+		"/application/name": "other",
+	}}
+	c := newCachingStoreClient(client)
+	if _, err := c.GetValues([]string{"/app", "/application"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	for key, want := range map[string]map[string]string{
+		"/app":         {"/app/name": "shop"},
+		"/application": {"/application/name": "other"},
+	} {
+		got, err := c.GetValues([]string{key})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected the values of %s to be %v, got %v", key, want, got)
+		}
+	}
+	if client.calls != 1 {
+		t.Errorf("Expected GetValues to be called once, got %d", client.calls)
+	}
+}
+
+func TestCachingStoreClientEnv(t *testing.T) {
+	t.Setenv("MY_APP_NAME", "shop")
+	client, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// The env backend returns the values of /my_app under /my/app.
+	c := newCachingStoreClient(client)
+	got, err := c.GetValues([]string{"/my_app"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got["/my/app/name"] != "shop" {
+		t.Errorf("Expected /my/app/name to be cached, got %v", got)
+	}
+}
+
+func TestProcessSnapshotStorePrefixes(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+
+	for name, prefix := range map[string]string{"app": "/app", "application": "/application"} {
+		err := writeTestResource(fs, confDir, name, `
+[template]
+src = "`+name+`.tmpl"
+dest = "`+filepath.Join(confDir, name+".conf")+`"
+keys = ["`+prefix+`"]
+`, `{{range gets "/*/name"}}{{.Key}}={{.Value}} {{end}}`)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	client := &countingStoreClient{values: map[string]string{
+		"/app/name":         "shop",
+		"/application/name": "other",
+	}}
+	c := Config{
+		ConfDir:       confDir,
+		ConfigDir:     filepath.Join(confDir, "conf.d"),
+		SnapshotStore: true,
+		StoreClient:   client,
+		TemplateDir:   filepath.Join(confDir, "templates"),
+	}
+	if err := Process(c); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Each resource only sees the keys under its own prefix.
+	for name, want := range map[string]string{"app": "/app/name=shop ", "application": "/application/name=other "} {
+		contents, err := afero.ReadFile(fs, filepath.Join(confDir, name+".conf"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(contents) != want {
+			t.Errorf("Expected %s.conf to contain %q, got %q", name, want, string(contents))
+		}
+	}
+	if client.calls != 1 {
+		t.Errorf("Expected the snapshot to be fetched in a single call, got %d", client.calls)
+	}
+}
+
+func TestProcessRequireKeys(t *testing.T) {
+	log.SetLevel("warn")
+	tests := []struct {
+		desc    string
+		require []string
+		missing string
+	}{
+		{"all present", []string{"/app/db/host", "/app/features"}, ""},
+		{"none required", nil, ""},
+		{"some missing", []string{"/app/db/host", "/app/db/user", "/app/cache"}, "/app/db/user, /app/cache"},
+	}
+	for _, tt := range tests {
+		fs := afero.NewOsFs()
+		confDir, err := createTempDirs(fs)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer fs.RemoveAll(confDir)
+		dest := filepath.Join(confDir, "app.conf")
+		err = writeTestResource(fs, confDir, "app", `
+[template]
+src = "app.tmpl"
+dest = "`+dest+`"
+keys = ["/app"]
+`, `{{getv "/app/db/host"}}`)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		client := &countingStoreClient{values: map[string]string{
+			"/app/db/host":      "db.example.com",
+			"/app/features/new": "on",
+		}}
+		c := Config{
+			ConfDir:     confDir,
+			ConfigDir:   filepath.Join(confDir, "conf.d"),
+			RequireKeys: tt.require,
+			StoreClient: client,
+			TemplateDir: filepath.Join(confDir, "templates"),
+		}
+		err = Process(c)
+		if tt.missing == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tt.desc, err.Error())
+			}
+			if !util.IsFileExist(fs, dest) {
+				t.Errorf("%s: expected %s to be written", tt.desc, dest)
+			}
+			continue
+		}
+		if err == nil || !strings.HasSuffix(err.Error(), ": "+tt.missing) {
+			t.Errorf("%s: expected the missing keys %s to be reported, got %v", tt.desc, tt.missing, err)
+		}
+		if util.IsFileExist(fs, dest) {
+			t.Errorf("%s: expected %s not to be written", tt.desc, dest)
+		}
+	}
+}
+
+func TestKeyIndexAffected(t *testing.T) {
+	nginx := &TemplateResource{Dest: "nginx", Prefix: "/", Keys: []string{"/nginx"}}
+	db := &TemplateResource{Dest: "db", Prefix: "/app", Keys: []string{"/db/host", "/db/port"}}
+	all := &TemplateResource{Dest: "all", Prefix: "/app", Keys: []string{"/"}}
+	member1 := &TemplateResource{Dest: "one", Prefix: "/", Keys: []string{"/bundle/one"}, TarDest: "bundle.tar"}
+	member2 := &TemplateResource{Dest: "two", Prefix: "/", Keys: []string{"/bundle/two"}, TarDest: "bundle.tar"}
+	idx := newKeyIndex([]*TemplateResource{nginx, db, all, member1, member2})
+
+	tests := []struct {
+		desc     string
+		changed  []string
+		expected []string
+	}{
+		{"exact key", []string{"/app/db/host"}, []string{"db", "all"}},
+		{"key under", []string{"/nginx/upstream/app1"}, []string{"nginx"}},
+		{"key above", []string{"/app/db"}, []string{"db", "all"}},
+		{"prefix root", []string{"/app"}, []string{"db", "all"}},
+		{"unrelated", []string{"/other/key", "/app2/db"}, nil},
+		{"archive member", []string{"/bundle/two"}, []string{"one", "two"}},
+		{"several", []string{"nginx", "/app/cache"}, []string{"nginx", "all"}},
+		{"none", nil, nil},
+	}
+	for _, tt := range tests {
+		var dests []string
+		for _, tr := range idx.affected(tt.changed) {
+			dests = append(dests, tr.Dest)
+		}
+		if !reflect.DeepEqual(dests, tt.expected) {
+			t.Errorf("%s: expected %v to be affected, got %v", tt.desc, tt.expected, dests)
+		}
+	}
+}
+
+func TestProcessChanged(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+	for _, name := range []string{"one", "two"} {
+		err := writeTestResource(fs, confDir, name, `
+[template]
+src = "`+name+`.tmpl"
+dest = "`+filepath.Join(confDir, name+".conf")+`"
+keys = ["/`+name+`"]
+`, `{{getv "/`+name+`/value"}}`)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	client := &countingStoreClient{values: map[string]string{"/one/value": "1", "/two/value": "2"}}
+	c := Config{
+		ConfDir:     confDir,
+		ConfigDir:   filepath.Join(confDir, "conf.d"),
+		StoreClient: client,
+		TemplateDir: filepath.Join(confDir, "templates"),
+	}
+	if err := ProcessChanged(c, []string{"/two/value"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if util.IsFileExist(fs, filepath.Join(confDir, "one.conf")) {
+		t.Error("Expected one.conf, whose keys didn't change, not to be written")
+	}
+	contents, err := afero.ReadFile(fs, filepath.Join(confDir, "two.conf"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(contents) != "2" {
+		t.Errorf("Expected two.conf to contain 2, got %q", string(contents))
+	}
+	if client.calls != 1 {
+		t.Errorf("Expected only the affected resource to fetch its keys, got %d calls", client.calls)
+	}
+}
+
+// watchStoreClient is a countingStoreClient whose watches of the fire keys
+// report a change once. The other watches wait until stopped.
+type watchStoreClient struct {
+	*countingStoreClient
+	fire []string
+}
+
+func (c *watchStoreClient) WatchPrefix(prefix string, keys []string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	if waitIndex == 0 && reflect.DeepEqual(keys, c.fire) {
+		return 1, nil
+	}
+	<-stopChan
+	return waitIndex, nil
+}
+
+func TestWatchProcessorChangedKeys(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+	for name, key := range map[string]string{"one": "/one", "shared": "/one", "two": "/two"} {
+		err := writeTestResource(fs, confDir, name, `
+[template]
+src = "`+name+`.tmpl"
+dest = "`+filepath.Join(confDir, name+".conf")+`"
+keys = ["`+key+`"]
+`, name+` {{getv "`+key+`/value"}}`)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	client := &watchStoreClient{
+		countingStoreClient: &countingStoreClient{values: map[string]string{"/one/value": "1", "/two/value": "2"}},
+		fire:                []string{"/one"},
+	}
+	c := Config{
+		ConfDir:     confDir,
+		ConfigDir:   filepath.Join(confDir, "conf.d"),
+		StoreClient: client,
+		TemplateDir: filepath.Join(confDir, "templates"),
+		CacheValues: true,
+	}
+	stopChan := make(chan bool)
+	doneChan := make(chan bool)
+	errChan := make(chan error, 10)
+	go WatchProcessor(c, stopChan, doneChan, errChan).Process()
+	for name, expected := range map[string]string{"one": "one 1", "shared": "shared 1"} {
+		if !waitForFile(fs, filepath.Join(confDir, name+".conf"), expected, 5*time.Second) {
+			t.Errorf("Expected %s.conf, affected by the change, to be written", name)
+		}
+	}
+	close(stopChan)
+	<-doneChan
+
+	if util.IsFileExist(fs, filepath.Join(confDir, "two.conf")) {
+		t.Error("Expected two.conf, whose keys didn't change, not to be written")
+	}
+	// one and shared watch the same keys, so they're processed together,
+	// once, fetching their keys once.
+	if client.calls != 1 {
+		t.Errorf("Expected a single run for the change, got %d calls", client.calls)
+	}
+}
+
+func TestWatchProcessorRequireKeys(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(confDir)
+	dest := filepath.Join(confDir, "app.conf")
+	err = writeTestResource(fs, confDir, "app", `
+[template]
+src = "app.tmpl"
+dest = "`+dest+`"
+keys = ["/app"]
+`, `{{getv "/app/value"}}`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	client := &watchStoreClient{
+		countingStoreClient: &countingStoreClient{values: map[string]string{"/app/value": "1"}},
+		fire:                []string{"/app"},
+	}
+	c := Config{
+		ConfDir:     confDir,
+		ConfigDir:   filepath.Join(confDir, "conf.d"),
+		StoreClient: client,
+		TemplateDir: filepath.Join(confDir, "templates"),
+		RequireKeys: []string{"/db/host"},
+	}
+	stopChan := make(chan bool)
+	doneChan := make(chan bool)
+	errChan := make(chan error, 10)
+	go WatchProcessor(c, stopChan, doneChan, errChan).Process()
+	select {
+	case err := <-errChan:
+		if !strings.HasSuffix(err.Error(), ": /db/host") {
+			t.Errorf("Expected the missing key to be reported, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the change to report the missing key")
+	}
+	close(stopChan)
+	<-doneChan
+	if util.IsFileExist(fs, dest) {
+		t.Errorf("Expected %s not to be written while a required key is missing", dest)
+	}
+}
+
+func TestRenderResource(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewMemMapFs()
+	err := writeTestResource(fs, "/confd", "app", `
+[template]
+src = "app.tmpl"
+dest = "/etc/app.conf"
+keys = ["/app"]
+line_ending = "crlf"
+reload_cmd = "exit 1"
+`, "{{range gets \"/app/*\"}}{{base .Key}} = {{.Value}}\n{{end}}")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client := &countingStoreClient{values: map[string]string{"/app/a": "1", "/app/b": "2"}}
+	contents, err := RenderResource(fs, "/confd/conf.d/app.toml", Config{
+		ConfDir:     "/confd",
+		StoreClient: client,
+		TemplateDir: "/confd/templates",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := "a = 1\r\nb = 2\r\n"; string(contents) != expected {
+		t.Errorf("Expected %q, got %q", expected, string(contents))
+	}
+	if util.IsFileExist(fs, "/etc/app.conf") {
+		t.Error("Expected the dest not to be written")
+	}
+
+	if _, err := RenderResource(fs, "/confd/conf.d/missing.toml", Config{StoreClient: client}); err == nil {
+		t.Error("Expected an error for a missing template resource, got nil")
+	}
+}
+
+func TestSprigAliases(t *testing.T) {
+	log.SetLevel("warn")
+	t.Setenv("SPRIG_REGION", "eu")
+	fs := afero.NewMemMapFs()
+	err := writeTestResource(fs, "/confd", "app", `
+[template]
+src = "app.tmpl"
+dest = "/etc/app.conf"
+keys = ["/app"]
+`, `{{getv "/app/name" | trim | upper}} {{getv "/app/name" | lower | b64enc}} {{b64dec "ZXU="}} {{env "SPRIG_REGION"}} {{expandenv "$SPRIG_REGION"}}`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client := &countingStoreClient{values: map[string]string{"/app/name": " Shop "}}
+	contents, err := RenderResource(fs, "/confd/conf.d/app.toml", Config{
+		ConfDir:            "/confd",
+		EnableSprigAliases: true,
+		StoreClient:        client,
+		TemplateDir:        "/confd/templates",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := "SHOP IHNob3Ag eu eu eu"; string(contents) != expected {
+		t.Errorf("Expected %q, got %q", expected, string(contents))
+	}
+
+	_, err = RenderResource(fs, "/confd/conf.d/app.toml", Config{
+		ConfDir:     "/confd",
+		StoreClient: client,
+		TemplateDir: "/confd/templates",
+	})
+	if err == nil {
+		t.Error("Expected the sprig names to be undefined without EnableSprigAliases")
+	}
+}
+
+func TestExpandedKeys(t *testing.T) {
+	log.SetLevel("warn")
+	t.Setenv("APP_ENV", "staging")
+	fs := afero.NewMemMapFs()
+	err := writeTestResource(fs, "/confd", "app", `
+[template]
+src = "app.tmpl"
+dest = "/etc/app.conf"
+prefix = "/prod"
+keys = ["/apps/${APP_ENV}/config", "/apps/$APP_ENV/features", "/regions/${APP_REGION:-eu}"]
+`, "{{getv \"/apps/staging/config/port\"}}\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client := &countingStoreClient{values: map[string]string{"/prod/apps/staging/config/port": "8080"}}
+	contents, err := RenderResource(fs, "/confd/conf.d/app.toml", Config{
+		ConfDir:     "/confd",
+		StoreClient: client,
+		TemplateDir: "/confd/templates",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(contents) != "8080\n" {
+		t.Errorf("Expected 8080, got %q", contents)
+	}
+	expected := []string{"/prod/apps/staging/config", "/prod/apps/staging/features", "/prod/regions/eu"}
+	if !reflect.DeepEqual(client.keys, expected) {
+		t.Errorf("Expected the keys %v to be fetched, got %v", expected, client.keys)
+	}
+
+	t.Setenv("APP_ENV", "")
+	_, err = RenderResource(fs, "/confd/conf.d/app.toml", Config{
+		ConfDir:     "/confd",
+		StoreClient: client,
+		TemplateDir: "/confd/templates",
+	})
+	if err == nil || !strings.Contains(err.Error(), "APP_ENV") {
+		t.Errorf("Expected an error naming APP_ENV, got %v", err)
+	}
+}
+
+// slowStoreClient is a countingStoreClient taking delay to get values.
+type slowStoreClient struct {
+	countingStoreClient
+	delay time.Duration
+}
+
+func (c *slowStoreClient) GetValues(keys []string) (map[string]string, error) {
+	time.Sleep(c.delay)
+	return c.countingStoreClient.GetValues(keys)
+}
+
+func TestFetchHook(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewMemMapFs()
+	err := writeTestResource(fs, "/confd", "app", `
+[template]
+src = "app.tmpl"
+dest = "/etc/app.conf"
+prefix = "/prod"
+keys = ["/app"]
+`, "{{getv \"/app/a\"}}\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client := &slowStoreClient{
+		countingStoreClient: countingStoreClient{values: map[string]string{"/prod/app/a": "1"}},
+		delay:               10 * time.Millisecond,
+	}
+	var prefixes []string
+	var durations []time.Duration
+	_, err = RenderResource(fs, "/confd/conf.d/app.toml", Config{
+		ConfDir:     "/confd",
+		StoreClient: client,
+		TemplateDir: "/confd/templates",
+		FetchHook: func(prefix string, d time.Duration) {
+			prefixes = append(prefixes, prefix)
+			durations = append(durations, d)
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(prefixes) != 1 || prefixes[0] != "/prod" {
+		t.Fatalf("Expected one fetch of /prod, got %v", prefixes)
+	}
+	if durations[0] < client.delay {
+		t.Errorf("Expected a duration of at least %s, got %s", client.delay, durations[0])
+	}
+}
+
+func TestIntervalProcessorSkipUnchanged(t *testing.T) {
+	log.SetLevel("warn")
+	t.Setenv("SKIP_VALUE", "foo")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+keys = ["/skip/value"]
+skip_unchanged = true
+`, "{{renders}}value = {{getv \"/skip/value\"}}\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	renders := 0
+	tr.funcMap["renders"] = func() string {
+		renders++
+		return ""
+	}
+
+	p := &intervalProcessor{retries: make(map[string]reloadRetry), renders: make(map[string]renderCache), previous: make(map[string]map[string]string)}
+	for i := 0; i < 3; i++ {
+		p.process([]*TemplateResource{tr})
+	}
+	if renders != 1 {
+		t.Errorf("Expected a single render with unchanged values, got %d", renders)
+	}
+
+	t.Setenv("SKIP_VALUE", "bar")
+	p.process([]*TemplateResource{tr})
+	p.process([]*TemplateResource{tr})
+	if renders != 2 {
+		t.Errorf("Expected a render once the values changed, got %d", renders)
+	}
+	if b, err := afero.ReadFile(fs, tr.Dest); err != nil || string(b) != "value = bar\n" {
+		t.Errorf("Expected dest to be rendered, got %q (%v)", b, err)
+	}
+
+	if err := afero.WriteFile(fs, tr.Dest, []byte("edited by hand\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	p.process([]*TemplateResource{tr})
+	if renders != 3 {
+		t.Errorf("Expected a render once the dest changed, got %d", renders)
+	}
+	if b, err := afero.ReadFile(fs, tr.Dest); err != nil || string(b) != "value = bar\n" {
+		t.Errorf("Expected dest to be rendered, got %q (%v)", b, err)
+	}
+}
+
+func TestIntervalProcessorStableRender(t *testing.T) {
+	log.SetLevel("warn")
+	t.Setenv("STABLE_VALUE", "foo")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+keys = ["/stable/value"]
+stable_render = true
+`, "# generated {{datetime.UnixNano}}\nvalue = {{getv \"/stable/value\"}}\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reloads := filepath.Join(confDir, "reloads")
+	tr.ReloadCmd = "echo >> " + reloads
+
+	p := &intervalProcessor{retries: make(map[string]reloadRetry), renders: make(map[string]renderCache), previous: make(map[string]map[string]string)}
+	p.process([]*TemplateResource{tr})
+	first, err := afero.ReadFile(fs, tr.Dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		// Touching the dest doesn't make it out of sync either.
+		later := time.Now().Add(time.Duration(i+1) * time.Minute)
+		if err := fs.Chtimes(tr.Dest, later, later); err != nil {
+			t.Fatal(err.Error())
+		}
+		p.process([]*TemplateResource{tr})
+	}
+	if b, err := afero.ReadFile(fs, tr.Dest); err != nil || string(b) != string(first) {
+		t.Errorf("Expected dest to be kept with unchanged values, got %q (%v)", b, err)
+	}
+	if b, _ := afero.ReadFile(fs, reloads); string(b) != "\n" {
+		t.Errorf("Expected a single reload with unchanged values, got %q", b)
+	}
+
+	t.Setenv("STABLE_VALUE", "bar")
+	p.process([]*TemplateResource{tr})
+	if b, err := afero.ReadFile(fs, tr.Dest); err != nil || !strings.HasSuffix(string(b), "value = bar\n") {
+		t.Errorf("Expected dest to be rendered once the values changed, got %q (%v)", b, err)
+	}
+	if b, _ := afero.ReadFile(fs, reloads); string(b) != "\n\n" {
+		t.Errorf("Expected a reload once the values changed, got %q", b)
+	}
+
+	// A removed dest is rendered again.
+	if err := fs.Remove(tr.Dest); err != nil {
+		t.Fatal(err.Error())
+	}
+	p.process([]*TemplateResource{tr})
+	if !util.IsFileExist(fs, tr.Dest) {
+		t.Error("Expected a removed dest to be rendered")
+	}
+}
+
+func TestIntervalProcessorChangedPrevious(t *testing.T) {
+	log.SetLevel("warn")
+	t.Setenv("GEN_VALUE", "foo")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+keys = ["/gen/value"]
+`, `{{if changed "/gen/value"}}changed{{else}}same{{end}} previous={{previous "/gen/value"}} value={{getv "/gen/value"}}`)
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Resources are reloaded on every interval, as the interval processor
+	// does.
+	reload := func() *TemplateResource {
+		reloaded, err := NewTemplateResource(fs, tr.resourcePath, Config{
+			StoreClient: tr.storeClient,
+			TemplateDir: filepath.Join(confDir, "templates"),
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		reloaded.Dest = tr.Dest
+		return reloaded
+	}
+
+	p := &intervalProcessor{retries: make(map[string]reloadRetry), renders: make(map[string]renderCache), previous: make(map[string]map[string]string)}
+	steps := []struct {
+		value    string
+		expected string
+	}{
+		{"foo", "changed previous= value=foo"},
+		{"foo", "same previous=foo value=foo"},
+		{"bar", "changed previous=foo value=bar"},
+		{"bar", "same previous=bar value=bar"},
+	}
+	for i, step := range steps {
+		t.Setenv("GEN_VALUE", step.value)
+		p.process([]*TemplateResource{reload()})
+		if b, err := afero.ReadFile(fs, tr.Dest); err != nil || string(b) != step.expected {
+			t.Errorf("Interval %d: expected dest to be %q, got %q (%v)", i, step.expected, b, err)
+		}
+	}
+}
+
+// waitForFile polls name until it has the expected contents or the timeout
+// expires.
+func waitForFile(fs afero.Fs, name, expected string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if b, err := afero.ReadFile(fs, name); err == nil && string(b) == expected {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestProcessorsWatchConfDir(t *testing.T) {
+	log.SetLevel("warn")
+	for _, mode := range []string{"interval", "watch"} {
+		t.Run(mode, func(t *testing.T) {
+			fs := afero.NewOsFs()
+			confDir, err := createTempDirs(fs)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer fs.RemoveAll(confDir)
+			resource := func(name string) string {
+				return `
+[template]
+src = "` + name + `.tmpl"
+dest = "` + filepath.Join(confDir, name+".conf") + `"
+fetch_all = true
+`
+			}
+			if err := writeTestResource(fs, confDir, "one", resource("one"), "one\n"); err != nil {
+				t.Fatal(err.Error())
+			}
+			config, err := testConfig(confDir)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			config.WatchConfDir = true
+
+			stopChan := make(chan bool)
+			doneChan := make(chan bool)
+			errChan := make(chan error, 10)
+			var p Processor
+			if mode == "watch" {
+				p = WatchProcessor(config, stopChan, doneChan, errChan)
+			} else {
+				p = IntervalProcessor(config, stopChan, doneChan, errChan, 3600)
+			}
+			go p.Process()
+			defer func() {
+				close(stopChan)
+				<-doneChan
+			}()
+			if mode == "interval" && !waitForFile(fs, filepath.Join(confDir, "one.conf"), "one\n", 5*time.Second) {
+				t.Fatal("Expected the initial resource to be processed")
+			}
+			// Let the watcher start before changing the resources.
+			time.Sleep(200 * time.Millisecond)
+
+			// A modified resource takes effect right away. Templates aren't
+			// watched, so they're written before the resources.
+			if err := afero.WriteFile(fs, filepath.Join(confDir, "templates", "one.tmpl"), []byte("one modified\n"), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+			err = afero.WriteFile(fs, filepath.Join(confDir, "conf.d", "one.toml"), []byte(resource("one")+"mode = \"0600\"\n"), 0644)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !waitForFile(fs, filepath.Join(confDir, "one.conf"), "one modified\n", 5*time.Second) {
+				t.Error("Expected the modified resource to be processed")
+			}
+
+			// So does an added one.
+			if err := afero.WriteFile(fs, filepath.Join(confDir, "templates", "two.tmpl"), []byte("two\n"), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := afero.WriteFile(fs, filepath.Join(confDir, "conf.d", "two.toml"), []byte(resource("two")), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+			if !waitForFile(fs, filepath.Join(confDir, "two.conf"), "two\n", 5*time.Second) {
+				t.Error("Expected the added resource to be processed")
+			}
+
+			// A removed one isn't processed anymore.
+			if err := fs.Remove(filepath.Join(confDir, "conf.d", "one.toml")); err != nil {
+				t.Fatal(err.Error())
+			}
+			time.Sleep(200 * time.Millisecond)
+			if err := afero.WriteFile(fs, filepath.Join(confDir, "templates", "two.tmpl"), []byte("two modified\n"), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := afero.WriteFile(fs, filepath.Join(confDir, "templates", "one.tmpl"), []byte("one removed\n"), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+			// Touch the remaining resource to trigger a reload.
+			if err := afero.WriteFile(fs, filepath.Join(confDir, "conf.d", "two.toml"), []byte(resource("two")), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+			if !waitForFile(fs, filepath.Join(confDir, "two.conf"), "two modified\n", 5*time.Second) {
+				t.Error("Expected the remaining resource to be processed")
+			}
+			if b, _ := afero.ReadFile(fs, filepath.Join(confDir, "one.conf")); string(b) != "one modified\n" {
+				t.Errorf("Expected the removed resource not to be processed, got %q", b)
+			}
+		})
+	}
+}
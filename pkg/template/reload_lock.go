@@ -0,0 +1,33 @@
+package template
+
+import (
+	"context"
+	"sync"
+)
+
+// reloadLocks holds the reload locks by name, shared by every template
+// resource of the process.
+var reloadLocks = struct {
+	sync.Mutex
+	locks map[string]chan struct{}
+}{locks: make(map[string]chan struct{})}
+
+// lockReload acquires the reload lock name, blocking until the reload of
+// another resource holding it is done or ctx is done.
+// It returns the function releasing the lock, or an error if ctx is done
+// first.
+func lockReload(ctx context.Context, name string) (func(), error) {
+	reloadLocks.Lock()
+	lock, ok := reloadLocks.locks[name]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		reloadLocks.locks[name] = lock
+	}
+	reloadLocks.Unlock()
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
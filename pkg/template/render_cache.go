@@ -0,0 +1,89 @@
+package template
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	"github.com/spf13/afero"
+)
+
+// renderCache records the store values a template resource was last synced
+// with, and the state of its src and dest afterwards, so that a resource
+// whose inputs and dest are unchanged can skip rendering and comparing.
+type renderCache struct {
+	values string
+	src    fileState
+	dest   fileState
+}
+
+// fileState is the part of a file's metadata telling it was modified.
+type fileState struct {
+	size    int64
+	modTime int64
+	mode    uint32
+}
+
+// statFile returns the state of the file name, or the zero state if it
+// can't be read.
+func statFile(fs afero.Fs, name string) fileState {
+	if name == "" {
+		return fileState{}
+	}
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{fi.Size(), fi.ModTime().UnixNano(), uint32(fi.Mode())}
+}
+
+// hashValues returns a digest of values, independent of the map order.
+func hashValues(values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(values[k]))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// currentRenderCache returns the render cache matching the store values
+// last set and the current src and dest.
+func (t *TemplateResource) currentRenderCache() renderCache {
+	return renderCache{
+		values: t.valuesHash,
+		src:    statFile(t.fs, t.Src),
+		dest:   statFile(t.fs, t.Dest),
+	}
+}
+
+// cachesRender reports whether the resource keeps a render cache, to skip
+// rendering when its inputs are unchanged.
+func (t *TemplateResource) cachesRender() bool {
+	return t.SkipUnchanged || t.StableRender
+}
+
+// inputsUnchanged reports whether the resource was last synced with the
+// current inputs, and has no pending reload: the store values, src and dest
+// with SkipUnchanged. With StableRender, the dest only needs to exist, so
+// that a template whose output changes on every render, such as by using
+// datetime, doesn't rewrite the dest when its mtime changes.
+func (t *TemplateResource) inputsUnchanged() bool {
+	if !t.cachesRender() || t.reloadRetry.failures > 0 {
+		return false
+	}
+	current := t.currentRenderCache()
+	if t.SkipUnchanged {
+		return t.renderCache == current
+	}
+	return t.renderCache.values == current.values &&
+		t.renderCache.src == current.src &&
+		current.dest != fileState{}
+}
@@ -0,0 +1,110 @@
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"text/template/parse"
+)
+
+// defaultMaxRenderDepth is the depth of nested template actions allowed
+// when the config sets no limit.
+const defaultMaxRenderDepth = 100
+
+// includeFunc is the name of the function the template actions are
+// rewritten to call. It is the name of the action, so that errors refer to
+// the template call as written. Template source can't call it, template
+// being a keyword there.
+const includeFunc = "template"
+
+// depthLimiter executes the templates invoked by template actions itself,
+// counting how deep they are nested, so that a template recursing without
+// end fails with a clear error rather than exhausting the stack.
+type depthLimiter struct {
+	tmpl     *template.Template
+	max      int
+	depth    int
+	exceeded error
+}
+
+// limitDepth rewrites the template and block actions of tmpl and of the
+// templates it defines into calls to the depth limiter, which fails once
+// they are nested deeper than max. The returned function executes tmpl.
+func limitDepth(tmpl *template.Template, max int) func(buf *bytes.Buffer) error {
+	l := &depthLimiter{tmpl: tmpl, max: max}
+	tmpl.Funcs(template.FuncMap{includeFunc: l.include})
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil && t.Tree.Root != nil {
+			rewriteTemplateNodes(t.Tree, t.Tree.Root)
+		}
+	}
+	return func(buf *bytes.Buffer) error {
+		err := tmpl.Execute(buf, nil)
+		// Report the depth error alone, not wrapped by every level.
+		if l.exceeded != nil {
+			return l.exceeded
+		}
+		return err
+	}
+}
+
+// include executes the named template with data, as a template action
+// would.
+func (l *depthLimiter) include(name string, data interface{}) (string, error) {
+	if l.depth >= l.max {
+		l.exceeded = fmt.Errorf("Unable to process template %s, template %q exceeds the maximum render depth of %d", l.tmpl.Name(), name, l.max)
+		return "", l.exceeded
+	}
+	t := l.tmpl.Lookup(name)
+	if t == nil {
+		return "", fmt.Errorf("no such template %q", name)
+	}
+	l.depth++
+	defer func() { l.depth-- }()
+	var buf bytes.Buffer
+	err := t.Execute(&buf, data)
+	return buf.String(), err
+}
+
+// rewriteTemplateNodes replaces the template nodes under node with actions
+// calling includeFunc with the template name and the pipeline.
+func rewriteTemplateNodes(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for i, child := range n.Nodes {
+			if tn, ok := child.(*parse.TemplateNode); ok {
+				n.Nodes[i] = includeAction(tree, tn)
+				continue
+			}
+			rewriteTemplateNodes(tree, child)
+		}
+	case *parse.IfNode:
+		rewriteTemplateNodes(tree, n.List)
+		rewriteTemplateNodes(tree, n.ElseList)
+	case *parse.RangeNode:
+		rewriteTemplateNodes(tree, n.List)
+		rewriteTemplateNodes(tree, n.ElseList)
+	case *parse.WithNode:
+		rewriteTemplateNodes(tree, n.List)
+		rewriteTemplateNodes(tree, n.ElseList)
+	}
+}
+
+// includeAction returns the action calling includeFunc with "name" and
+// pipeline, equivalent to the template node tn.
+func includeAction(tree *parse.Tree, tn *parse.TemplateNode) *parse.ActionNode {
+	var data parse.Node = &parse.NilNode{NodeType: parse.NodeNil, Pos: tn.Pos}
+	if tn.Pipe != nil {
+		data = tn.Pipe
+	}
+	cmd := &parse.CommandNode{NodeType: parse.NodeCommand, Pos: tn.Pos, Args: []parse.Node{
+		parse.NewIdentifier(includeFunc).SetTree(tree).SetPos(tn.Pos),
+		&parse.StringNode{NodeType: parse.NodeString, Pos: tn.Pos, Quoted: fmt.Sprintf("%q", tn.Name), Text: tn.Name},
+		data,
+	}}
+	pipe := &parse.PipeNode{NodeType: parse.NodePipe, Pos: tn.Pos, Line: tn.Line, Cmds: []*parse.CommandNode{cmd}}
+	return &parse.ActionNode{NodeType: parse.NodeAction, Pos: tn.Pos, Line: tn.Line, Pipe: pipe}
+}
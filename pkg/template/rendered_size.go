@@ -0,0 +1,33 @@
+package template
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// renderedSizePlaceholder is output by the renderedSize function, and
+// replaced with the size of the rendered config once rendered.
+const renderedSizePlaceholder = "\x00confd:renderedSize\x00"
+
+// resolveRenderedSize replaces the renderedSize placeholders of contents
+// with the size in bytes of the result, which accounts for the digits of
+// the size itself.
+func resolveRenderedSize(contents []byte) []byte {
+	placeholder := []byte(renderedSizePlaceholder)
+	n := bytes.Count(contents, placeholder)
+	if n == 0 {
+		return contents
+	}
+	rest := len(contents) - n*len(placeholder)
+	// The size has some number of digits d when the contents with n
+	// sizes of d digits are that long. Such a d always exists, as the
+	// number of digits of rest+n*d grows slower than d.
+	size := rest
+	for d := 1; ; d++ {
+		size = rest + n*d
+		if len(strconv.Itoa(size)) == d {
+			break
+		}
+	}
+	return bytes.ReplaceAll(contents, placeholder, []byte(strconv.Itoa(size)))
+}
@@ -2,17 +2,27 @@ package template
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/user"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/abtreece/confd/pkg/backends"
@@ -20,17 +30,77 @@ import (
 	util "github.com/abtreece/confd/pkg/util"
 	"github.com/kelseyhightower/memkv"
 	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
 )
 
 type Config struct {
+	// AuditLog receives a JSON line for each sync of a target config,
+	// recording its checksums before and after and the result.
+	AuditLog    io.Writer `toml:"-"`
+	CacheValues bool      `toml:"cache-values"`
+	// CheckInDryRun still stages the configs and runs their check
+	// commands in noop mode, failing on a failed check, so that CI can
+	// validate them.
+	CheckInDryRun bool   `toml:"check-in-dry-run"`
 	ConfDir       string `toml:"confdir"`
 	ConfigDir     string
-	KeepStageFile bool
-	Noop          bool   `toml:"noop"`
-	Prefix        string `toml:"prefix"`
+	// ConfigDirs are more directories of template resources, searched
+	// after ConfigDir in order. A resource file replaces the one at the
+	// same path relative to an earlier directory.
+	ConfigDirs util.Nodes `toml:"config-dirs"`
+	// EnableSprigAliases registers the sprig names of the template
+	// functions, such as upper or b64enc, easing the migration of Helm
+	// templates.
+	EnableSprigAliases bool `toml:"enable-sprig-aliases"`
+	// FetchHook, if set, is called after each template resource fetched
+	// its keys from the store, with the prefix and how long GetValues
+	// took, to find the prefixes slow to fetch.
+	FetchHook func(prefix string, d time.Duration) `toml:"-"`
+	// HeaderTemplate and FooterTemplate are templates rendered with the
+	// functions and store of each template resource, and written before
+	// and after its rendered src.
+	FooterTemplate string `toml:"footer-template"`
+	HeaderTemplate string `toml:"header-template"`
+	KeepStageFile  bool
+	// MaskPatterns are regular expressions whose matches in the output of
+	// the check and reload commands are masked before it is logged.
+	MaskPatterns util.Nodes `toml:"mask-patterns"`
+	// MaxRenderDepth is how deeply template actions may be nested, such
+	// as by a recursive template, before rendering fails. Defaults to
+	// defaultMaxRenderDepth.
+	MaxRenderDepth int    `toml:"max-render-depth"`
+	Noop           bool   `toml:"noop"`
+	Prefix         string `toml:"prefix"`
+	// RedactDestInLogs logs a digest of the dest of template resources
+	// instead of their path, for dests revealing tenants or the like.
+	RedactDestInLogs bool `toml:"redact-dest-in-logs"`
+	// ReloadJitter spreads out the reload commands of a run, starting
+	// each one a random delay of half to the whole ReloadJitter after the
+	// previous one.
+	ReloadJitter time.Duration `toml:"reload-jitter"`
+	// RequireKeys lists the keys which must exist in the store, with a
+	// value or values under them, before any template resource is
+	// processed.
+	RequireKeys util.Nodes `toml:"require-keys"`
+	// ResourceFilter is a glob pattern selecting the template resources to
+	// process by their file name, dest, or dest file name. All of them are
+	// processed if empty.
+	ResourceFilter string `toml:"resource-filter"`
+	// SnapshotStore fetches the keys of all the template resources at
+	// once at the start of a run, and has them render from this snapshot,
+	// so that related configs reflect the same state of the store.
+	SnapshotStore bool `toml:"snapshot-store"`
 	StoreClient   backends.StoreClient
 	SyncOnly      bool `toml:"sync-only"`
 	TemplateDir   string
+	// WatchConfDir reloads the template resources when their files in
+	// ConfigDir are added, modified or removed.
+	WatchConfDir bool `toml:"watch-confdir"`
+	// FuncMap holds custom template functions made available to every
+	// template resource. They may only replace built-in functions of the
+	// same name when AllowFuncOverride is set.
+	FuncMap           map[string]interface{}
+	AllowFuncOverride bool
 }
 
 // TemplateResourceConfig holds the parsed template resource.
@@ -40,31 +110,83 @@ type TemplateResourceConfig struct {
 
 // TemplateResource is the representation of a parsed template resource.
 type TemplateResource struct {
-	CheckCmd      string `toml:"check_cmd"`
-	Dest          string
-	FileMode      os.FileMode
-	Gid           int
-	Group         string
-	Keys          []string
-	Mode          string
-	Owner         string
-	Prefix        string
-	ReloadCmd     string `toml:"reload_cmd"`
-	Src           string
-	StageFile     afero.File
-	Uid           int
-	funcMap       map[string]interface{}
-	lastIndex     uint64
-	keepStageFile bool
-	noop          bool
-	Store         memkv.Store
-	storeClient   backends.StoreClient
-	syncOnly      bool
-	fs            afero.Fs
+	ACLs                  []string `toml:"acls"`
+	AllowEmptyTemplate    bool     `toml:"allow_empty_template"`
+	AllowKeys             []string `toml:"allow_keys"`
+	AllowedCheckExitCodes []int    `toml:"allowed_check_exit_codes"`
+	BinaryKeys            []string `toml:"binary_keys"`
+	CheckArgv             []string `toml:"check_argv"`
+	CheckCmd              string   `toml:"check_cmd"`
+	ChecksumSidecar       string   `toml:"checksum_sidecar"`
+	CompareMode           string   `toml:"compare_mode"`
+	Defaults              string
+	DenyKeys              []string `toml:"deny_keys"`
+	Dest                  string
+	ExecutableIfShebang   bool `toml:"executable_if_shebang"`
+	Extends               string
+	FetchAll              bool `toml:"fetch_all"`
+	FileMode              os.FileMode
+	Gid                   int
+	Group                 string
+	IgnorePatterns        []string `toml:"ignore_patterns"`
+	Keys                  []string
+	LineEnding            string `toml:"line_ending"`
+	MaxSize               int64  `toml:"max_size"`
+	Mode                  string
+	Owner                 string
+	Prefix                string
+	Raw                   string
+	ReloadArgv            []string      `toml:"reload_argv"`
+	ReloadBreaker         int           `toml:"reload_breaker"`
+	ReloadBreakerCooldown time.Duration `toml:"reload_breaker_cooldown"`
+	ReloadCmd             string        `toml:"reload_cmd"`
+	ReloadLock            string        `toml:"reload_lock"`
+	RemoveIfEmpty         bool          `toml:"remove_if_empty"`
+	SkipUnchanged         bool          `toml:"skip_unchanged"`
+	Src                   string
+	StableRender          bool        `toml:"stable_render"`
+	StageFileMode         os.FileMode `toml:"stage_file_mode"`
+	StageFile             afero.File
+	SymlinkSwap           bool   `toml:"symlink_swap"`
+	TarDest               string `toml:"tar_dest"`
+	Timeout               time.Duration
+	TrimCompare           bool `toml:"trim_compare"`
+	Uid                   int
+	VerifyAfterWrite      bool   `toml:"verify_after_write"`
+	WorkingDir            string `toml:"working_dir"`
+	WriteOnce             bool   `toml:"write_once"`
+	absoluteValues        map[string]absoluteValue
+	auditLog              *auditLog
+	fetchHook             func(string, time.Duration)
+	footerTemplate        string
+	funcMap               map[string]interface{}
+	headerTemplate        string
+	ignorePatterns        []*regexp.Regexp
+	maskPatterns          []*regexp.Regexp
+	maxRenderDepth        int
+	reloadRetry           reloadRetry
+	reloadStagger         *reloadStagger
+	renderCache           renderCache
+	rendervDepth          int
+	keepStageFile         bool
+	noop                  bool
+	checkInDryRun         bool
+	previousValues        map[string]string
+	redactDest            bool
+	Store                 memkv.Store
+	resourcePath          string
+	storeClient           backends.StoreClient
+	syncOnly              bool
+	values                map[string]string
+	valuesHash            string
+	fs                    afero.Fs
 }
 
 var ErrEmptySrc = errors.New("empty src template")
 
+// ErrEmptyKey is returned when a template resource lists a blank key.
+var ErrEmptyKey = errors.New("empty key in keys")
+
 // NewTemplateResource creates a TemplateResource.
 func NewTemplateResource(fs afero.Fs, path string, config Config) (*TemplateResource, error) {
 	if config.StoreClient == nil {
@@ -75,21 +197,56 @@ func NewTemplateResource(fs afero.Fs, path string, config Config) (*TemplateReso
 	// unset from configuration.
 	tc := &TemplateResourceConfig{TemplateResource{Uid: -1, Gid: -1}}
 
-	log.Debug("Loading template resource from " + path)
-	_, err := toml.DecodeFS(afero.NewIOFS(fs), path, &tc)
-	if err != nil {
+	if err := decodeResource(fs, path, config.ConfDir, tc, nil); err != nil {
 		return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err.Error())
 	}
 
-	tr := tc.TemplateResource
+	tr := &tc.TemplateResource
+	tr.fetchHook = config.FetchHook
+	tr.footerTemplate = config.FooterTemplate
+	tr.headerTemplate = config.HeaderTemplate
 	tr.keepStageFile = config.KeepStageFile
+	tr.redactDest = config.RedactDestInLogs
+	tr.maxRenderDepth = config.MaxRenderDepth
+	if tr.maxRenderDepth <= 0 {
+		tr.maxRenderDepth = defaultMaxRenderDepth
+	}
+	tr.resourcePath = path
 	tr.noop = config.Noop
+	tr.checkInDryRun = config.CheckInDryRun
 	tr.storeClient = config.StoreClient
 	tr.funcMap = newFuncMap()
 	tr.Store = memkv.New()
 	tr.syncOnly = config.SyncOnly
 	tr.fs = fs
 	addFuncs(tr.funcMap, tr.Store.FuncMap)
+	addFuncs(tr.funcMap, newStoreFuncMap(&tr.Store, func() map[string]string { return tr.values }))
+	addFuncs(tr.funcMap, newServiceFuncMap(config.StoreClient))
+	tr.funcMap["getvAbsolute"] = tr.getvAbsolute
+	tr.funcMap["destPath"] = tr.destPath
+	tr.funcMap["srcPath"] = tr.srcPath
+	tr.funcMap["resourceName"] = tr.resourceName
+	tr.funcMap["changed"] = tr.changed
+	tr.funcMap["previous"] = tr.previous
+	tr.funcMap["renderedSize"] = func() string { return renderedSizePlaceholder }
+	tr.funcMap["renderv"] = tr.renderv
+	if config.EnableSprigAliases {
+		addFuncs(tr.funcMap, newSprigFuncMap(tr.funcMap))
+	}
+	for name := range config.FuncMap {
+		if _, ok := tr.funcMap[name]; ok && !config.AllowFuncOverride {
+			return nil, fmt.Errorf("Cannot register template function %s - overrides a built-in function", name)
+		}
+	}
+	addFuncs(tr.funcMap, config.FuncMap)
+
+	for _, pattern := range config.MaskPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot compile mask pattern %q - %s", pattern, err.Error())
+		}
+		tr.maskPatterns = append(tr.maskPatterns, re)
+	}
 
 	if config.Prefix != "" {
 		tr.Prefix = config.Prefix
@@ -99,10 +256,56 @@ func NewTemplateResource(fs afero.Fs, path string, config Config) (*TemplateReso
 		tr.Prefix = "/" + tr.Prefix
 	}
 
-	if tr.Src == "" {
+	if tr.Src == "" && tr.Raw == "" {
 		return nil, ErrEmptySrc
 	}
 
+	if err := tr.normalizeKeys(); err != nil {
+		return nil, fmt.Errorf("Cannot process template resource %s - %s", path, err.Error())
+	}
+
+	switch tr.LineEnding {
+	case "", "lf", "crlf":
+	default:
+		return nil, fmt.Errorf("Cannot process template resource %s - invalid line_ending %q", path, tr.LineEnding)
+	}
+
+	switch tr.ChecksumSidecar {
+	case "", "md5", "sha256":
+	default:
+		return nil, fmt.Errorf("Cannot process template resource %s - invalid checksum_sidecar %q", path, tr.ChecksumSidecar)
+	}
+
+	switch tr.CompareMode {
+	case "", "bytes", "json", "yaml":
+	default:
+		return nil, fmt.Errorf("Cannot process template resource %s - invalid compare_mode %q", path, tr.CompareMode)
+	}
+
+	if tr.ReloadBreaker < 0 || tr.ReloadBreakerCooldown < 0 {
+		return nil, fmt.Errorf("Cannot process template resource %s - reload_breaker and reload_breaker_cooldown must not be negative", path)
+	}
+
+	for _, acl := range tr.ACLs {
+		if strings.TrimSpace(acl) == "" || strings.Contains(acl, ",") {
+			return nil, fmt.Errorf("Cannot process template resource %s - invalid acl %q", path, acl)
+		}
+	}
+
+	for _, pattern := range tr.IgnorePatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot process template resource %s - invalid ignore pattern %q - %s", path, pattern, err.Error())
+		}
+		tr.ignorePatterns = append(tr.ignorePatterns, re)
+	}
+
+	for _, pattern := range append(tr.AllowKeys, tr.DenyKeys...) {
+		if !validKeyPattern(pattern) {
+			return nil, fmt.Errorf("Cannot process template resource %s - invalid key pattern %q", path, pattern)
+		}
+	}
+
 	if tr.Uid == -1 {
 		if tr.Owner != "" {
 			u, err := user.Lookup(tr.Owner)
@@ -119,7 +322,15 @@ func NewTemplateResource(fs afero.Fs, path string, config Config) (*TemplateReso
 	}
 
 	if tr.Gid == -1 {
-		if tr.Group != "" {
+		if isNumericID(tr.Group) {
+			// A numeric group is used as is, minimal containers may
+			// lack /etc/group to look it up in.
+			gid, err := strconv.ParseUint(tr.Group, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot process template resource %s - invalid group %q", path, tr.Group)
+			}
+			tr.Gid = int(gid)
+		} else if tr.Group != "" {
 			g, err := user.LookupGroup(tr.Group)
 			if err != nil {
 				return nil, fmt.Errorf("Cannot find group's GID - %s", err.Error())
@@ -133,8 +344,95 @@ func NewTemplateResource(fs afero.Fs, path string, config Config) (*TemplateReso
 		}
 	}
 
-	tr.Src = filepath.Join(config.TemplateDir, tr.Src)
-	return &tr, nil
+	if tr.Defaults != "" && !filepath.IsAbs(tr.Defaults) {
+		tr.Defaults = filepath.Join(config.ConfDir, tr.Defaults)
+	}
+
+	if tr.WorkingDir != "" {
+		if !filepath.IsAbs(tr.WorkingDir) {
+			tr.WorkingDir = filepath.Join(config.ConfDir, tr.WorkingDir)
+		}
+		if fi, err := fs.Stat(tr.WorkingDir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("Cannot process template resource %s - working_dir %s is not a directory", path, tr.WorkingDir)
+		}
+	}
+
+	if tr.Src != "" {
+		tr.Src = filepath.Join(config.TemplateDir, tr.Src)
+	}
+	return tr, nil
+}
+
+// isNumericID reports whether s is a decimal user or group ID rather than
+// a name.
+func isNumericID(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeKeys validates the Keys and rewrites each entry as a clean,
+// absolute key path, after expanding its environment variables. An empty
+// Keys list defaults to the Raw key if set, and only fetches the whole
+// prefix subtree when FetchAll is set; otherwise a warning is logged since
+// the template will have nothing to render from.
+func (t *TemplateResource) normalizeKeys() error {
+	if t.Raw != "" {
+		t.Raw = path.Join("/", t.Raw)
+		if len(t.Keys) == 0 {
+			t.Keys = []string{t.Raw}
+		}
+	}
+	keys := make([]string, 0, len(t.Keys))
+	for _, k := range t.Keys {
+		k, err := expandKey(k)
+		if err != nil {
+			return err
+		}
+		k = strings.TrimSpace(k)
+		if k == "" {
+			return ErrEmptyKey
+		}
+		keys = append(keys, path.Join("/", k))
+	}
+	if len(keys) == 0 {
+		if t.FetchAll {
+			keys = append(keys, "/")
+		} else {
+			log.Warning("No keys configured for " + t.Src + "; set fetch_all to retrieve the whole prefix")
+		}
+	}
+	t.Keys = keys
+	return nil
+}
+
+// expandKey replaces the $VAR and ${VAR} environment variables of the key
+// with their values. ${VAR:-default} expands to default when VAR is unset
+// or empty.
+// It returns an error naming the variables which are unset or empty and
+// have no default.
+func expandKey(key string) (string, error) {
+	var missing []string
+	expanded := os.Expand(key, func(name string) string {
+		name, def, hasDefault := strings.Cut(name, ":-")
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		if !hasDefault {
+			missing = append(missing, name)
+		}
+		return def
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("Cannot expand key %s - unset variables %s", key, strings.Join(missing, ", "))
+	}
+	return expanded, nil
 }
 
 // setVars sets the Vars for template resource.
@@ -143,37 +441,421 @@ func (t *TemplateResource) setVars() error {
 	log.Debug("Retrieving keys from store")
 	log.Debug("Key prefix set to " + t.Prefix)
 
+	start := time.Now()
 	result, err := t.storeClient.GetValues(util.AppendPrefix(t.Prefix, t.Keys))
+	elapsed := time.Since(start)
 	if err != nil {
 		return err
 	}
 	log.Debug("Got the following map from store: %v", result)
+	log.Debug("Fetched prefix %s in %s", t.Prefix, elapsed)
+	if t.fetchHook != nil {
+		t.fetchHook(t.Prefix, elapsed)
+	}
 
-	t.Store.Purge()
+	t.absoluteValues = nil
+	values := make(map[string]string)
+
+	if t.Defaults != "" {
+		defaults, err := t.readDefaults()
+		if err != nil {
+			return err
+		}
+		for k, v := range defaults {
+			values[k] = v
+		}
+	}
 
 	for k, v := range result {
-		t.Store.Set(path.Join("/", strings.TrimPrefix(k, t.Prefix)), v)
+		key := path.Join("/", strings.TrimPrefix(k, t.Prefix))
+		if t.isBinaryKey(key) {
+			decoded, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return fmt.Errorf("Cannot decode binary key %s - %s", key, err.Error())
+			}
+			v = string(decoded)
+		}
+		values[key] = v
+	}
+	for k := range values {
+		if !t.isKeyAllowed(k) {
+			log.Debug("Key " + k + " is not allowed for " + t.destName())
+			delete(values, k)
+		}
+	}
+	t.setValues(values)
+	if t.cachesRender() {
+		t.valuesHash = hashValues(values)
 	}
 	return nil
 }
 
-// CreateStageFile stages the src configuration file by processing the src
-// template and setting the desired owner, group, and mode. It also sets the
-// StageFile for the template resource.
-// It returns an error if any.
-func (t *TemplateResource) CreateStageFile() error {
-	log.Debug("Using source template " + t.Src)
+// setValues replaces the content of the store with values.
+func (t *TemplateResource) setValues(values map[string]string) {
+	t.Store.Purge()
+	for k, v := range values {
+		t.Store.Set(k, v)
+	}
+	t.values = values
+}
 
-	if !util.IsFileExist(t.fs, t.Src) {
-		return errors.New("Missing template: " + t.Src)
+// absoluteValue is a value fetched by getvAbsolute, cached for the run.
+type absoluteValue struct {
+	value string
+	found bool
+}
+
+// getvAbsolute returns the value of the absolute key, fetched from the store
+// client regardless of the resource prefix and keys, or the optional default
+// if it doesn't exist. Each key is fetched once per run. The key, as given,
+// must be allowed by AllowKeys and DenyKeys.
+func (t *TemplateResource) getvAbsolute(key string, v ...string) (string, error) {
+	key = path.Clean("/" + key)
+	if !t.isKeyAllowed(key) {
+		return "", fmt.Errorf("Key %s is not allowed for %s", key, t.Dest)
+	}
+	av, ok := t.absoluteValues[key]
+	if !ok {
+		vars, err := t.storeClient.GetValues([]string{key})
+		if err != nil {
+			return "", err
+		}
+		av.value, av.found = vars[key]
+		if t.absoluteValues == nil {
+			t.absoluteValues = make(map[string]absoluteValue)
+		}
+		t.absoluteValues[key] = av
+	}
+	if !av.found {
+		if len(v) > 0 {
+			return v[0], nil
+		}
+		return "", &memkv.KeyError{Key: key, Err: memkv.ErrNotExist}
 	}
+	return av.value, nil
+}
 
-	log.Debug("Compiling source template " + t.Src)
+// destPath returns the dest of the resource, so that a template can refer
+// to its own target file.
+func (t *TemplateResource) destPath() string {
+	return t.Dest
+}
+
+// srcPath returns the path of the template of the resource.
+func (t *TemplateResource) srcPath() string {
+	return t.Src
+}
+
+// resourceName returns the name of the template resource file, without
+// its directory and .toml, .resource.yaml, .resource.yml or .resource.json
+// suffix.
+func (t *TemplateResource) resourceName() string {
+	name := filepath.Base(t.resourcePath)
+	for suffix := range resourceSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return strings.TrimSuffix(name, ".toml")
+}
+
+// destName returns the dest, to be logged, or when RedactDestInLogs is set,
+// a name made of a digest of the dest, telling dests apart without
+// revealing them.
+func (t *TemplateResource) destName() string {
+	if !t.redactDest {
+		return t.Dest
+	}
+	sum := sha256.Sum256([]byte(t.Dest))
+	return "<dest " + hex.EncodeToString(sum[:4]) + ">"
+}
+
+// redact replaces the dest path in s, and the path prefix of the staged
+// files named after it, with destName when RedactDestInLogs is set.
+func (t *TemplateResource) redact(s string) string {
+	if !t.redactDest || t.Dest == "" {
+		return s
+	}
+	staged := filepath.Join(filepath.Dir(t.Dest), "."+filepath.Base(t.Dest))
+	s = strings.ReplaceAll(s, staged, t.destName())
+	return strings.ReplaceAll(s, t.Dest, t.destName())
+}
+
+// changed reports whether the value of key differs from the one it had on
+// the last successful run of the resource, including being set or unset
+// since. Every key is changed on the first run.
+func (t *TemplateResource) changed(key string) bool {
+	if t.previousValues == nil {
+		return true
+	}
+	key = path.Join("/", key)
+	previous, wasSet := t.previousValues[key]
+	current, isSet := t.values[key]
+	return wasSet != isSet || previous != current
+}
+
+// previous returns the value key had on the last successful run of the
+// resource, or an empty string if it had none.
+func (t *TemplateResource) previous(key string) string {
+	return t.previousValues[path.Join("/", key)]
+}
+
+// renderv executes the value of key as a template with the template
+// functions of the resource, so that it may itself read other keys, and
+// returns the result. Values rendering values nest at most maxRenderDepth
+// deep.
+func (t *TemplateResource) renderv(key string) (string, error) {
+	v, err := t.Store.GetValue(key)
+	if err != nil {
+		return "", err
+	}
+	if t.rendervDepth >= t.maxRenderDepth {
+		return "", fmt.Errorf("renderv of %s exceeds the maximum render depth of %d", key, t.maxRenderDepth)
+	}
+	tmpl, err := template.New(key).Funcs(t.funcMap).Parse(v)
+	if err != nil {
+		return "", err
+	}
+	t.rendervDepth++
+	defer func() { t.rendervDepth-- }()
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// isBinaryKey reports whether key is, or is under, one of the BinaryKeys.
+func (t *TemplateResource) isBinaryKey(key string) bool {
+	for _, k := range t.BinaryKeys {
+		k = path.Join("/", k)
+		if key == k || strings.HasPrefix(key, strings.TrimSuffix(k, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isKeyAllowed reports whether templates may read key, as it or one of its
+// parents matches one of the AllowKeys, if any, and none of the DenyKeys.
+func (t *TemplateResource) isKeyAllowed(key string) bool {
+	if len(t.AllowKeys) > 0 && !matchesKeyPattern(key, t.AllowKeys) {
+		return false
+	}
+	return !matchesKeyPattern(key, t.DenyKeys)
+}
+
+// validKeyPattern reports whether pattern is a well-formed glob pattern.
+func validKeyPattern(pattern string) bool {
+	_, err := path.Match(pattern, "/")
+	return err == nil
+}
+
+// matchesKeyPattern reports whether key, or one of its parents, matches one
+// of the glob patterns.
+func matchesKeyPattern(key string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = path.Join("/", pattern)
+		for k := key; ; k = path.Dir(k) {
+			if ok, _ := path.Match(pattern, k); ok {
+				return true
+			}
+			if k == "/" {
+				break
+			}
+		}
+	}
+	return false
+}
 
-	tmpl, err := template.New(filepath.Base(t.Src)).Funcs(t.funcMap).ParseFS(afero.NewIOFS(t.fs), t.Src)
+// decodeResource decodes the template resource file at path into tc, after
+// the base file it extends, if any, so that its fields override those of
+// the base. A relative base is resolved against confDir. seen holds the
+// files being decoded, to reject a cycle.
+func decodeResource(fs afero.Fs, path, confDir string, tc *TemplateResourceConfig, seen map[string]bool) error {
+	if seen[path] {
+		return fmt.Errorf("extends cycle at %s", path)
+	}
+	if seen == nil {
+		seen = make(map[string]bool)
+	}
+	seen[path] = true
+
+	log.Debug("Loading template resource from " + path)
+	data, err := afero.ReadFile(fs, path)
 	if err != nil {
-		return fmt.Errorf("Unable to process template %s, %s", t.Src, err)
+		return err
+	}
+	if data, err = resourceTOML(path, data); err != nil {
+		return err
+	}
+	var head struct {
+		TemplateResource struct {
+			Extends string
+		} `toml:"template"`
+	}
+	if _, err := toml.Decode(string(data), &head); err != nil {
+		return err
+	}
+	if base := head.TemplateResource.Extends; base != "" {
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(confDir, base)
+		}
+		if err := decodeResource(fs, base, confDir, tc, seen); err != nil {
+			return fmt.Errorf("Cannot extend %s - %s", base, err.Error())
+		}
+	}
+	_, err = toml.Decode(string(data), tc)
+	return err
+}
+
+// resourceSuffixes are the suffixes of the names of the template resource
+// files written in YAML or JSON, by format. Other files are TOML, so that
+// stray YAML and JSON files in the confdir aren't taken for resources.
+var resourceSuffixes = map[string]string{
+	".resource.yaml": "yaml",
+	".resource.yml":  "yaml",
+	".resource.json": "json",
+}
+
+// resourceFormat returns the format of the template resource file path,
+// yaml or json according to its suffix, or toml.
+func resourceFormat(path string) string {
+	for suffix, format := range resourceSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return format
+		}
 	}
+	return "toml"
+}
+
+// resourceTOML returns the template resource file data, converting it to
+// TOML when the file is YAML or JSON according to its suffix, so that all
+// of them are decoded alike, with the same field names. A numeric mode, as
+// YAML and JSON allow, is converted to the octal string TOML expects.
+func resourceTOML(path string, data []byte) ([]byte, error) {
+	var doc interface{}
+	switch resourceFormat(path) {
+	case "yaml":
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		doc = stringKeys(doc)
+	case "json":
+		// Numbers are kept as written, so that integers decode into the
+		// integer fields.
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&doc); err != nil {
+			return nil, err
+		}
+		doc = jsonNumbers(doc)
+	default:
+		return data, nil
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("template resource must be a mapping")
+	}
+	for k, v := range m {
+		if tm, ok := v.(map[string]interface{}); ok && strings.EqualFold(k, "template") {
+			octalMode(tm)
+		}
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// octalMode replaces an integer mode of the template table tm with its
+// octal string, such as 0644 for 420, the value of the YAML 0644.
+func octalMode(tm map[string]interface{}) {
+	for k, v := range tm {
+		if !strings.EqualFold(k, "mode") {
+			continue
+		}
+		switch n := v.(type) {
+		case int:
+			tm[k] = fmt.Sprintf("%#o", n)
+		case int64:
+			tm[k] = fmt.Sprintf("%#o", n)
+		case uint64:
+			tm[k] = fmt.Sprintf("%#o", n)
+		}
+	}
+}
+
+// jsonNumbers converts the json.Number values of v, including nested ones,
+// to int64 or, for fractions, float64.
+func jsonNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonNumbers(e)
+		}
+	}
+	return v
+}
+
+// readDefaults reads the structured Defaults file, TOML, JSON or YAML
+// depending on its extension, and flattens it into store keys.
+func (t *TemplateResource) readDefaults() (map[string]string, error) {
+	log.Debug("Loading defaults from " + t.Defaults)
+	data, err := afero.ReadFile(t.fs, t.Defaults)
+	if err != nil {
+		return nil, err
+	}
+
+	var node interface{}
+	switch filepath.Ext(t.Defaults) {
+	case ".toml":
+		m := make(map[string]interface{})
+		err = toml.Unmarshal(data, &m)
+		node = m
+	case ".json":
+		m := make(map[string]interface{})
+		err = json.Unmarshal(data, &m)
+		node = m
+	case ".yml", ".yaml":
+		m := make(map[interface{}]interface{})
+		err = yaml.Unmarshal(data, &m)
+		node = m
+	default:
+		err = fmt.Errorf("Invalid defaults file extension %s. TOML, JSON or YAML only.", t.Defaults)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]string)
+	if err := util.NodeWalk(node, "/", vars); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// CreateStageFile stages the src configuration file by processing the src
+// template, or copying the Raw value byte for byte, and setting the desired
+// owner, group, and mode. It also sets the StageFile for the template resource.
+// It returns an error if any.
+func (t *TemplateResource) CreateStageFile() error {
+	contents, err := t.contents()
+	if err != nil {
+		return err
+	}
+	t.setShebangMode(contents)
 
 	// create TempFile in Dest directory to avoid cross-filesystem issues
 	temp, err := afero.TempFile(t.fs, filepath.Dir(t.Dest), "."+filepath.Base(t.Dest))
@@ -181,7 +863,7 @@ func (t *TemplateResource) CreateStageFile() error {
 		return err
 	}
 
-	if err = tmpl.Execute(temp, nil); err != nil {
+	if _, err = temp.Write(contents); err != nil {
 		temp.Close()
 		t.fs.Remove(temp.Name())
 		return err
@@ -190,144 +872,937 @@ func (t *TemplateResource) CreateStageFile() error {
 
 	// Set the owner, group, and mode on the stage file now to make it easier to
 	// compare against the destination configuration file later.
-	t.fs.Chmod(temp.Name(), t.FileMode)
+	t.fs.Chmod(temp.Name(), t.stageFileMode())
 	t.fs.Chown(temp.Name(), t.Uid, t.Gid)
 	t.StageFile = temp
 	return nil
 }
 
+// setShebangMode adds the execute bits matching its read bits to FileMode
+// if ExecutableIfShebang is set and contents is a script, starting with #!.
+// Without a Mode, FileMode is the mode of the dest, whose execute bits are
+// dropped first as they may have been added for an earlier script.
+func (t *TemplateResource) setShebangMode(contents []byte) {
+	if !t.ExecutableIfShebang {
+		return
+	}
+	if t.Mode == "" {
+		t.FileMode &^= 0111
+	}
+	if bytes.HasPrefix(contents, []byte("#!")) {
+		t.FileMode |= (t.FileMode & 0444) >> 2
+	}
+}
+
+// defaultStageFileMode keeps staged configs, which may hold secrets,
+// private to the owner.
+const defaultStageFileMode os.FileMode = 0600
+
+// stageFileMode returns the mode of the stage file, StageFileMode or else
+// the default. The dest gets FileMode once the stage file is moved over it.
+func (t *TemplateResource) stageFileMode() os.FileMode {
+	if t.StageFileMode == 0 {
+		return defaultStageFileMode
+	}
+	return t.StageFileMode
+}
+
+// isChanged reports whether the staged file differs from the dest, with
+// the dest expected to have FileMode, or from the checksum sidecar. The
+// contents are compared structurally in the json and yaml CompareMode, and
+// without the lines matching IgnorePatterns and, with TrimCompare, without
+// leading and trailing whitespace. A FIFO dest is always out of
+// sync, the config is written to it on every run.
+func (t *TemplateResource) isChanged(staged string) (bool, error) {
+	if t.isFIFODest() {
+		return true, nil
+	}
+	var equal func(a, b []byte) bool
+	switch t.CompareMode {
+	case "json":
+		equal = equalJSON
+	case "yaml":
+		equal = equalYAML
+	}
+	if len(t.ignorePatterns) > 0 {
+		if equal == nil {
+			equal = bytes.Equal
+		}
+		compare := equal
+		equal = func(a, b []byte) bool {
+			return compare(t.withoutIgnoredLines(a), t.withoutIgnoredLines(b))
+		}
+	}
+	if t.TrimCompare {
+		if equal == nil {
+			equal = bytes.Equal
+		}
+		compare := equal
+		equal = func(a, b []byte) bool {
+			return compare(bytes.TrimSpace(a), bytes.TrimSpace(b))
+		}
+	}
+	mode := t.FileMode
+	changed, err := util.IsConfigChanged(t.fs, staged, t.Dest, util.ConfigCompare{Mode: &mode, Equal: equal, Name: t.destName()})
+	if err != nil || changed {
+		return changed, err
+	}
+	inSync, err := t.sidecarInSync(staged)
+	return !inSync, err
+}
+
+// withoutIgnoredLines returns contents without the lines matching one of
+// the IgnorePatterns.
+func (t *TemplateResource) withoutIgnoredLines(contents []byte) []byte {
+	var kept []byte
+	for _, line := range bytes.SplitAfter(contents, []byte("\n")) {
+		if !t.isIgnoredLine(bytes.TrimRight(line, "\r\n")) {
+			kept = append(kept, line...)
+		}
+	}
+	return kept
+}
+
+// isIgnoredLine reports whether line matches one of the IgnorePatterns.
+func (t *TemplateResource) isIgnoredLine(line []byte) bool {
+	for _, re := range t.ignorePatterns {
+		if re.Match(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// equalJSON reports whether a and b are the same JSON document, regardless
+// of key order and whitespace. Numbers are compared as written, so that
+// integers too large for a float64 still differ. Invalid documents are
+// never equal.
+func equalJSON(a, b []byte) bool {
+	x, errX := decodeJSON(a)
+	y, errY := decodeJSON(b)
+	if errX != nil || errY != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// decodeJSON decodes the single JSON document of data, keeping its numbers
+// as json.Number.
+func decodeJSON(data []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the JSON document")
+	}
+	return v, nil
+}
+
+// equalYAML reports whether a and b hold the same YAML documents,
+// regardless of key order, whitespace and comments. Invalid documents are
+// never equal.
+func equalYAML(a, b []byte) bool {
+	x, errX := decodeYAML(a)
+	y, errY := decodeYAML(b)
+	if errX != nil || errY != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// decodeYAML decodes every document of data.
+func decodeYAML(data []byte) ([]interface{}, error) {
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	var docs []interface{}
+	for {
+		var v interface{}
+		err := d.Decode(&v)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, v)
+	}
+}
+
+// contents returns the Raw value if set, the rendered src template otherwise.
+// It returns an error if any.
+func (t *TemplateResource) contents() ([]byte, error) {
+	if t.Raw != "" {
+		log.Debug("Using raw value of " + t.Raw)
+		value, err := t.Store.GetValue(t.Raw)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(value), nil
+	}
+	return t.render()
+}
+
+// render executes the src template against the store and returns the
+// rendered contents.
+// It returns an error if any.
+func (t *TemplateResource) render() ([]byte, error) {
+	log.Debug("Using source template " + t.Src)
+
+	if !util.IsFileExist(t.fs, t.Src) {
+		return nil, errors.New("Missing template: " + t.Src)
+	}
+
+	log.Debug("Compiling source template " + t.Src)
+
+	src, err := afero.ReadFile(t.fs, t.Src)
+	if err != nil {
+		return nil, err
+	}
+	// An empty template is most likely a botched deployment, which would
+	// wipe the dest.
+	if len(src) == 0 && !t.AllowEmptyTemplate {
+		return nil, fmt.Errorf("Empty template: %s, set allow_empty_template to render it", t.Src)
+	}
+	tmpl, err := template.New(filepath.Base(t.Src)).Funcs(t.funcMap).Parse(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to process template %s, %s", t.Src, err)
+	}
+
+	var buf bytes.Buffer
+	if err := t.executeBanner(&buf, "header", t.headerTemplate); err != nil {
+		return nil, err
+	}
+	if err = limitDepth(tmpl, t.maxRenderDepth)(&buf); err != nil {
+		return nil, err
+	}
+	if err := t.executeBanner(&buf, "footer", t.footerTemplate); err != nil {
+		return nil, err
+	}
+	return resolveRenderedSize(convertLineEndings(buf.Bytes(), t.LineEnding)), nil
+}
+
+// executeBanner executes text, the header or footer template, into buf with
+// the functions of the resource. An empty text writes nothing.
+// It returns an error if any.
+func (t *TemplateResource) executeBanner(buf *bytes.Buffer, name, text string) error {
+	if text == "" {
+		return nil
+	}
+	tmpl, err := template.New(name).Funcs(t.funcMap).Parse(text)
+	if err != nil {
+		return fmt.Errorf("Unable to process %s template, %s", name, err)
+	}
+	return tmpl.Execute(buf, nil)
+}
+
+// convertLineEndings rewrites the line endings of contents to the given
+// style, "lf" or "crlf". Any other style leaves contents untouched.
+func convertLineEndings(contents []byte, style string) []byte {
+	switch style {
+	case "lf":
+		return bytes.ReplaceAll(contents, []byte("\r\n"), []byte("\n"))
+	case "crlf":
+		lf := bytes.ReplaceAll(contents, []byte("\r\n"), []byte("\n"))
+		return bytes.ReplaceAll(lf, []byte("\n"), []byte("\r\n"))
+	}
+	return contents
+}
+
 // sync compares the staged and dest config files and attempts to sync them
 // if they differ. sync will run a config check command if set before
 // overwriting the target config file. Finally, sync will run a reload command
 // if set to have the application or service pick up the changes.
 // It returns an error if any.
-func (t *TemplateResource) sync() error {
+func (t *TemplateResource) sync(ctx context.Context) (err error) {
 	staged := t.StageFile.Name()
 	if t.keepStageFile {
-		log.Info("Keeping staged file: " + staged)
+		log.Info("Keeping staged file: " + t.redact(staged))
 	} else {
 		defer t.fs.Remove(staged)
 	}
+	// Changes are audited, skips when the dest is in sync too, but nothing
+	// is in noop mode.
+	action := "skip"
+	if t.auditLog != nil && !t.noop {
+		oldChecksum, _ := fileChecksum(t.fs, t.Dest)
+		defer func() { t.audit(action, oldChecksum, err) }()
+	}
+
+	if t.MaxSize > 0 {
+		fi, err := t.fs.Stat(staged)
+		if err != nil {
+			return err
+		}
+		if fi.Size() > t.MaxSize {
+			action = "write"
+			t.fs.Remove(staged)
+			return fmt.Errorf("Rendered config for %s is %d bytes, exceeding max_size of %d bytes", t.Dest, fi.Size(), t.MaxSize)
+		}
+	}
 
-	log.Debug("Comparing candidate config to " + t.Dest)
-	ok, err := util.IsConfigChanged(t.fs, staged, t.Dest)
+	if t.RemoveIfEmpty {
+		contents, err := afero.ReadFile(t.fs, staged)
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(contents)) == 0 {
+			action = "remove"
+			return t.removeDest(ctx)
+		}
+	}
+
+	log.Debug("Comparing candidate config to " + t.destName())
+	ok, err := t.isChanged(staged)
 	if err != nil {
 		log.Error(err.Error())
 	}
 	if t.noop {
-		log.Warning("Noop mode enabled. " + t.Dest + " will not be modified")
+		if t.checkInDryRun && t.hasCheck() {
+			if err := t.check(ctx); err != nil {
+				return errors.New("Config check failed: " + err.Error())
+			}
+		}
+		log.Warning("Noop mode enabled. " + t.destName() + " will not be modified")
 		return nil
 	}
 	if ok {
-		log.Info("Target config " + t.Dest + " out of sync")
-		if !t.syncOnly && t.CheckCmd != "" {
-			if err := t.check(); err != nil {
+		log.Info("Target config " + t.destName() + " out of sync")
+		action = "write"
+		if t.hasCheck() {
+			if err := t.check(ctx); err != nil {
 				return errors.New("Config check failed: " + err.Error())
 			}
 		}
-		log.Debug("Overwriting target config " + t.Dest)
-		err := t.fs.Rename(staged, t.Dest)
-		if err != nil {
-			if strings.Contains(err.Error(), "device or resource busy") {
-				log.Debug("Rename failed - target is likely a mount. Trying to write instead")
-				// try to open the file and write to it
-				var contents []byte
-				var rerr error
-				contents, rerr = afero.ReadFile(t.fs, staged)
-				if rerr != nil {
-					return rerr
-				}
-				err := afero.WriteFile(t.fs, t.Dest, contents, t.FileMode)
-				// make sure owner and group match the temp file, in case the file was created with WriteFile
-				t.fs.Chown(t.Dest, t.Uid, t.Gid)
-				if err != nil {
-					return err
-				}
-			} else {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := t.fs.Chmod(staged, t.FileMode); err != nil {
+			return err
+		}
+		sidecar := ""
+		if t.ChecksumSidecar != "" {
+			if sidecar, err = t.stageSidecar(staged); err != nil {
 				return err
 			}
+			defer t.fs.Remove(sidecar)
 		}
-		if !t.syncOnly && t.ReloadCmd != "" {
-			if err := t.reload(); err != nil {
+		fifo := t.isFIFODest()
+		checksum := ""
+		if t.VerifyAfterWrite && !fifo {
+			if checksum, err = fileChecksum(t.fs, staged); err != nil {
 				return err
 			}
 		}
-		log.Info("Target config " + t.Dest + " has been updated")
+		if fifo {
+			if err := t.writeFIFO(ctx, staged); err != nil {
+				return err
+			}
+		} else if t.SymlinkSwap {
+			if err := t.swapSymlink(staged); err != nil {
+				return err
+			}
+		} else if err := t.writeDest(staged); err != nil {
+			return err
+		}
+		if t.VerifyAfterWrite && !fifo {
+			written, err := fileChecksum(t.fs, t.Dest)
+			if err != nil {
+				return errors.New("Cannot verify target config " + t.Dest + " after writing - " + err.Error())
+			}
+			if written != checksum {
+				return errors.New("Target config " + t.Dest + " doesn't match the staged config after writing")
+			}
+		}
+		if len(t.ACLs) > 0 && !fifo {
+			if err := t.setACLs(ctx); err != nil {
+				return err
+			}
+		}
+		if sidecar != "" {
+			if err := t.fs.Rename(sidecar, t.sidecarPath()); err != nil {
+				return err
+			}
+		}
+		if t.hasReload() && t.reloadBreakerOpen() {
+			log.Warning("Reload circuit for " + t.destName() + " is open, skipping reload until " + t.reloadRetry.openUntil.Format(time.RFC3339))
+		} else if t.hasReload() {
+			if err := t.reload(ctx); err != nil {
+				t.reloadFailed()
+				return err
+			}
+			t.reloadRetry = reloadRetry{}
+		}
+		log.Info("Target config " + t.destName() + " has been updated")
 	} else {
-		log.Debug("Target config " + t.Dest + " in sync")
+		log.Debug("Target config " + t.destName() + " in sync")
+		if t.hasReload() && t.reloadDue() {
+			log.Info("Retrying reload for " + t.destName())
+			if err := t.reload(ctx); err != nil {
+				t.reloadFailed()
+				return err
+			}
+			t.reloadRetry = reloadRetry{}
+		}
+	}
+	return nil
+}
+
+// setACLs adds the ACLs entries to the dest with setfacl, once written and
+// its mode set, as setting the mode would recompute the ACL mask.
+// It returns an error if any.
+func (t *TemplateResource) setACLs(ctx context.Context) error {
+	log.Debug("Setting ACLs of " + t.destName())
+	if err := t.runArgv(ctx, []string{"setfacl", "-m", strings.Join(t.ACLs, ","), t.Dest}); err != nil {
+		return fmt.Errorf("Cannot set ACLs of %s - %s", t.Dest, err.Error())
+	}
+	return nil
+}
+
+// maxReloadRetrySkip caps the number of runs skipped between reload retries.
+const maxReloadRetrySkip = 32
+
+// defaultReloadBreakerCooldown is how long reloads are suspended once the
+// reload circuit opens, when reload_breaker_cooldown isn't set.
+const defaultReloadBreakerCooldown = 5 * time.Minute
+
+// reloadFailed records a reload failure, opening the reload circuit for the
+// cooldown once ReloadBreaker consecutive reloads failed. A reload failing
+// again after the cooldown reopens it right away.
+func (t *TemplateResource) reloadFailed() {
+	t.reloadRetry.failed()
+	if t.ReloadBreaker <= 0 || t.reloadRetry.failures < t.ReloadBreaker {
+		return
+	}
+	cooldown := t.ReloadBreakerCooldown
+	if cooldown == 0 {
+		cooldown = defaultReloadBreakerCooldown
+	}
+	t.reloadRetry.openUntil = time.Now().Add(cooldown)
+	log.Error(fmt.Sprintf("Reload for %s failed %d times in a row, opening the reload circuit for %s", t.destName(), t.reloadRetry.failures, cooldown))
+}
+
+// reloadBreakerOpen reports whether reloads are suspended by an open reload
+// circuit.
+func (t *TemplateResource) reloadBreakerOpen() bool {
+	return time.Now().Before(t.reloadRetry.openUntil)
+}
+
+// reloadDue reports whether a failed reload should be retried on a run
+// leaving the dest in sync. Once the reload circuit opened, the retry waits
+// for the cooldown rather than backing off in runs.
+func (t *TemplateResource) reloadDue() bool {
+	if !t.reloadRetry.openUntil.IsZero() {
+		return !t.reloadBreakerOpen()
+	}
+	return t.reloadRetry.due()
+}
+
+// reloadRetry records consecutive reload failures of a resource whose dest
+// was already updated, so the reload is retried on later runs even though
+// the dest is in sync. Retries back off exponentially in runs.
+type reloadRetry struct {
+	failures  int
+	skip      int
+	openUntil time.Time
+}
+
+// failed records a reload failure and schedules the next retry.
+func (r *reloadRetry) failed() {
+	r.failures++
+	r.skip = 1<<uint(r.failures-1) - 1
+	if r.skip > maxReloadRetrySkip || r.skip < 0 {
+		r.skip = maxReloadRetrySkip
+	}
+}
+
+// due reports whether a reload retry should run now, consuming one skipped
+// run otherwise.
+func (r *reloadRetry) due() bool {
+	if r.failures == 0 {
+		return false
+	}
+	if r.skip > 0 {
+		r.skip--
+		return false
+	}
+	return true
+}
+
+// writeDest moves the staged file over the dest config file.
+// It returns an error if any.
+func (t *TemplateResource) writeDest(staged string) error {
+	log.Debug("Overwriting target config " + t.destName())
+	err := t.fs.Rename(staged, t.Dest)
+	if err != nil {
+		if strings.Contains(err.Error(), "device or resource busy") {
+			log.Debug("Rename failed - target is likely a mount. Trying to write instead")
+			return t.overwriteDest(staged)
+		}
+		return err
 	}
 	return nil
 }
 
+// overwriteDest writes the staged file into the dest config file in place,
+// for dests that can't be renamed over such as bind mounted files. Renaming
+// any other temp file over the dest would fail the same way, so if the write
+// fails partway, the original contents are written back instead, not to
+// leave the dest truncated.
+// It returns an error if any.
+func (t *TemplateResource) overwriteDest(staged string) error {
+	contents, err := afero.ReadFile(t.fs, staged)
+	if err != nil {
+		return err
+	}
+	original, err := afero.ReadFile(t.fs, t.Dest)
+	if err != nil {
+		return err
+	}
+	if err := writeInPlace(t.fs, t.Dest, contents, t.FileMode); err != nil {
+		if rerr := writeInPlace(t.fs, t.Dest, original, t.FileMode); rerr != nil {
+			return fmt.Errorf("%s, and restoring %s failed - %s", err.Error(), t.Dest, rerr.Error())
+		}
+		return err
+	}
+	// The mode of an existing dest is kept by the write, and that of a
+	// created one is subject to the umask, so set it explicitly.
+	if err := t.fs.Chmod(t.Dest, t.FileMode); err != nil {
+		return err
+	}
+	// make sure owner and group match the staged file
+	t.fs.Chown(t.Dest, t.Uid, t.Gid)
+	return nil
+}
+
+// writeInPlace overwrites the file name with contents, without truncating it
+// first so that its blocks are reused.
+// It returns an error if any.
+func writeInPlace(fs afero.Fs, name string, contents []byte, perm os.FileMode) error {
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Truncate(int64(len(contents)))
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// swapSymlink moves the staged file to a new file named after the dest and
+// the current time, then atomically repoints the dest symlink to it by
+// renaming a new symlink over the dest. Previous targets are kept for
+// rollback.
+// It returns an error if any.
+func (t *TemplateResource) swapSymlink(staged string) error {
+	linker, ok := t.fs.(afero.Linker)
+	if !ok {
+		return errors.New("symlink_swap is not supported by the filesystem")
+	}
+	target := t.Dest + "." + time.Now().UTC().Format(symlinkTargetTime)
+	log.Debug("Writing target config " + t.redact(target))
+	if err := t.fs.Rename(staged, target); err != nil {
+		return err
+	}
+	link := filepath.Join(filepath.Dir(t.Dest), "."+filepath.Base(target)+".link")
+	if err := linker.SymlinkIfPossible(filepath.Base(target), link); err != nil {
+		return err
+	}
+	log.Debug("Pointing target config " + t.destName() + " to " + t.redact(target))
+	if err := t.fs.Rename(link, t.Dest); err != nil {
+		t.fs.Remove(link)
+		return err
+	}
+	t.removeOldTargets()
+	return nil
+}
+
+// symlinkTargetTime is the format of the UTC timestamp naming the targets
+// of SymlinkSwap after the dest, which sort by time.
+const symlinkTargetTime = "20060102150405.000000000"
+
+// symlinkTargetsKept is the number of SymlinkSwap targets kept, the current
+// one and the previous one, for rollback.
+const symlinkTargetsKept = 2
+
+// removeOldTargets removes the SymlinkSwap targets of the dest but the
+// newest symlinkTargetsKept. Failures are logged, the dest being written.
+func (t *TemplateResource) removeOldTargets() {
+	dir := filepath.Dir(t.Dest)
+	prefix := filepath.Base(t.Dest) + "."
+	files, err := afero.ReadDir(t.fs, dir)
+	if err != nil {
+		log.Warning("Cannot list the previous targets of " + t.destName() + " - " + t.redact(err.Error()))
+		return
+	}
+	var targets []string
+	for _, fi := range files {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(symlinkTargetTime, strings.TrimPrefix(name, prefix)); err == nil {
+			targets = append(targets, name)
+		}
+	}
+	sort.Strings(targets)
+	for len(targets) > symlinkTargetsKept {
+		old := filepath.Join(dir, targets[0])
+		log.Debug("Removing previous target config " + t.redact(old))
+		if err := t.fs.Remove(old); err != nil {
+			log.Warning("Cannot remove previous target config - " + t.redact(err.Error()))
+		}
+		targets = targets[1:]
+	}
+}
+
+// removeDest removes the dest config file, used in place of sync when the
+// rendered template is empty and RemoveIfEmpty is set. The reload command is
+// run if the dest existed.
+// It returns an error if any.
+func (t *TemplateResource) removeDest(ctx context.Context) error {
+	if !util.IsFileExist(t.fs, t.Dest) {
+		log.Debug("Target config " + t.destName() + " in sync")
+		return nil
+	}
+	log.Info("Target config " + t.destName() + " out of sync")
+	if t.noop {
+		log.Warning("Noop mode enabled. " + t.destName() + " will not be removed")
+		return nil
+	}
+	log.Debug("Removing target config " + t.destName())
+	if err := t.fs.Remove(t.Dest); err != nil {
+		return err
+	}
+	if t.ChecksumSidecar != "" {
+		t.fs.Remove(t.sidecarPath())
+	}
+	if t.hasReload() {
+		if err := t.reload(ctx); err != nil {
+			return err
+		}
+	}
+	log.Info("Target config " + t.destName() + " has been removed")
+	return nil
+}
+
+// hasCheck reports whether a check command is configured and enabled.
+func (t *TemplateResource) hasCheck() bool {
+	return !t.syncOnly && (t.CheckCmd != "" || len(t.CheckArgv) > 0)
+}
+
+// hasReload reports whether a reload command is configured and enabled.
+func (t *TemplateResource) hasReload() bool {
+	return !t.syncOnly && (t.ReloadCmd != "" || len(t.ReloadArgv) > 0)
+}
+
 // check executes the check command to validate the staged config file. The
 // command is modified so that any references to src template are substituted
 // with a string representing the full path of the staged file. This allows the
 // check to be run on the staged file before overwriting the destination config
-// file.
-// It returns nil if the check command returns 0 and there are no other errors.
-func (t *TemplateResource) check() error {
-	var cmdBuffer bytes.Buffer
-	data := make(map[string]string)
-	data["src"] = t.StageFile.Name()
-	tmpl, err := template.New("checkcmd").Parse(t.CheckCmd)
+// file. CheckArgv is preferred over CheckCmd and is run without a shell.
+// It returns nil if the check command returns 0, or one of the
+// AllowedCheckExitCodes, and there are no other errors.
+func (t *TemplateResource) check(ctx context.Context) error {
+	data := map[string]string{"src": t.StageFile.Name(), "dest": t.Dest}
+	if len(t.CheckArgv) > 0 {
+		argv, err := t.expandArgv(t.CheckArgv, data)
+		if err != nil {
+			return err
+		}
+		return t.allowCheckExit(t.runArgv(ctx, argv))
+	}
+	cmd, err := t.expandCommand(t.CheckCmd, data)
 	if err != nil {
 		return err
 	}
-	if err := tmpl.Execute(&cmdBuffer, data); err != nil {
+	return t.allowCheckExit(t.runCommand(ctx, cmd))
+}
+
+// allowCheckExit maps the exit of the check command with one of the
+// AllowedCheckExitCodes to success.
+// It returns err otherwise.
+func (t *TemplateResource) allowCheckExit(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
 		return err
 	}
-	return runCommand(cmdBuffer.String())
+	for _, code := range t.AllowedCheckExitCodes {
+		if exitErr.ExitCode() == code {
+			log.Warning(fmt.Sprintf("Check command for %s exited with allowed code %d", t.destName(), code))
+			return nil
+		}
+	}
+	return err
 }
 
-// reload executes the reload command.
+// reload executes the reload command, expanded against the store values
+// and the dest. ReloadArgv is preferred over ReloadCmd and is run without a
+// shell. Resources sharing a ReloadLock reload one at a time.
 // It returns nil if the reload command returns 0.
-func (t *TemplateResource) reload() error {
-	return runCommand(t.ReloadCmd)
+func (t *TemplateResource) reload(ctx context.Context) error {
+	if err := t.reloadStagger.wait(ctx); err != nil {
+		return err
+	}
+	if t.ReloadLock != "" {
+		unlock, err := lockReload(ctx, t.ReloadLock)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	data := map[string]string{"src": t.Dest, "dest": t.Dest}
+	if len(t.ReloadArgv) > 0 {
+		argv, err := t.expandArgv(t.ReloadArgv, data)
+		if err != nil {
+			return err
+		}
+		return t.runArgv(ctx, argv)
+	}
+	cmd, err := t.expandCommand(t.ReloadCmd, data)
+	if err != nil {
+		return err
+	}
+	return t.runCommand(ctx, cmd)
+}
+
+// expandCommand executes cmd as a template against data, with the template
+// functions of the resource so that it can use the store values.
+func (t *TemplateResource) expandCommand(cmd string, data map[string]string) (string, error) {
+	var buf bytes.Buffer
+	tmpl, err := template.New("cmd").Funcs(t.funcMap).Parse(cmd)
+	if err != nil {
+		return "", err
+	}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// expandArgv executes each argv element as a template against data, like
+// expandCommand.
+func (t *TemplateResource) expandArgv(argv []string, data map[string]string) ([]string, error) {
+	expanded := make([]string, len(argv))
+	for i, arg := range argv {
+		cmd, err := t.expandCommand(arg, data)
+		if err != nil {
+			return nil, err
+		}
+		expanded[i] = cmd
+	}
+	return expanded, nil
 }
 
 // runCommand is a shared function used by check and reload
-// to run the given command and log its output.
+// to run the given command through the shell and log its output.
 // It returns nil if the given cmd returns 0.
 // The command can be run on unix and windows.
-func runCommand(cmd string) error {
-	log.Debug("Running " + cmd)
-	var c *exec.Cmd
+func (t *TemplateResource) runCommand(ctx context.Context, cmd string) error {
 	if runtime.GOOS == "windows" {
-		c = exec.Command("cmd", "/C", cmd)
-	} else {
-		c = exec.Command("/bin/sh", "-c", cmd)
+		return t.runArgv(ctx, []string{"cmd", "/C", cmd})
 	}
+	return t.runArgv(ctx, []string{"/bin/sh", "-c", cmd})
+}
+
+// runArgv runs the program argv[0] with the remaining arguments, without a
+// shell, in the WorkingDir if set, and logs it and its output with secrets
+// masked. The command is killed if ctx is done before it exits.
+// It returns nil if the command returns 0.
+func (t *TemplateResource) runArgv(ctx context.Context, argv []string) error {
+	log.Debug(t.mask(fmt.Sprintf("Running %q", argv)))
+	c := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	c.Dir = t.WorkingDir
+	// Don't wait on children of the command holding the output open once
+	// it was killed.
+	c.WaitDelay = time.Second
 
 	output, err := c.CombinedOutput()
 	if err != nil {
-		log.Error(fmt.Sprintf("%q", string(output)))
+		log.Error(t.mask(fmt.Sprintf("%q", string(output))))
 		return err
 	}
-	log.Debug(fmt.Sprintf("%q", string(output)))
+	log.Debug(t.mask(fmt.Sprintf("%q", string(output))))
 	return nil
 }
 
+// sensitiveKey matches the keys whose values are masked in the logged
+// command output, besides the matches of the mask patterns.
+var sensitiveKey = regexp.MustCompile(`(?i)(passw(or)?d|secret|token|credential|private_?key|api_?key)`)
+
+// minMaskedLength is the length below which the values of sensitive keys
+// aren't masked, not to mask every occurrence of a short common string.
+const minMaskedLength = 4
+
+// mask replaces the matches of the mask patterns in s, and the values of
+// the sensitive keys of the resource, with ***. The dest is redacted too.
+func (t *TemplateResource) mask(s string) string {
+	s = t.redact(s)
+	for _, re := range t.maskPatterns {
+		s = re.ReplaceAllString(s, "***")
+	}
+	var secrets []string
+	for k, v := range t.values {
+		if len(v) >= minMaskedLength && sensitiveKey.MatchString(k) {
+			// The output is logged quoted, so the secret may be escaped.
+			quoted := strconv.Quote(v)
+			secrets = append(secrets, v, quoted[1:len(quoted)-1])
+		}
+	}
+	// Longer secrets first, not to leave parts of those containing others.
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	for _, v := range secrets {
+		s = strings.ReplaceAll(s, v, "***")
+	}
+	return s
+}
+
 // process is a convenience function that wraps calls to the three main tasks
 // required to keep local configuration files in sync. First we gather vars
 // from the store, then we stage a candidate configuration file, and finally sync
-// things up.
+// things up. The whole run is bounded by Timeout if set.
+// The dest is left untouched until the staged file is moved over it, so a
+// failure in any earlier step, including the check command, leaves it as it
+// was and removes the stage file. Only the reload runs after the move.
 // It returns an error if any.
-func (t *TemplateResource) process() error {
+func (t *TemplateResource) process() (err error) {
+	// The errors are logged, with the dest when it failed to be written.
+	defer func() {
+		if err != nil && t.redactDest {
+			err = &redactedError{t.redact(err.Error()), err}
+		}
+	}()
+	ctx := context.Background()
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+	if t.writtenOnce() {
+		log.Debug("Target config " + t.destName() + " exists and is only written once, skipping")
+		return nil
+	}
 	if err := t.setFileMode(); err != nil {
 		return err
 	}
 	if err := t.setVars(); err != nil {
 		return err
 	}
+	if ctx.Err() != nil {
+		return t.timeoutError(ctx.Err())
+	}
+	if t.inputsUnchanged() {
+		log.Debug("Store values and target config " + t.destName() + " unchanged, skipping")
+		return nil
+	}
 	if err := t.CreateStageFile(); err != nil {
 		return err
 	}
-	if err := t.sync(); err != nil {
+	if err := t.sync(ctx); err != nil {
+		if ctx.Err() != nil {
+			return t.timeoutError(ctx.Err())
+		}
 		return err
 	}
+	if !t.noop {
+		t.previousValues = t.values
+		if t.cachesRender() {
+			t.renderCache = t.currentRenderCache()
+		}
+	}
 	return nil
 }
 
+// writtenOnce reports whether the dest is set to be written once and
+// already exists, in which case it is left as is.
+func (t *TemplateResource) writtenOnce() bool {
+	return t.WriteOnce && util.IsFileExist(t.fs, t.Dest)
+}
+
+// redactedError is an error whose message had the dest redacted.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+
+func (e *redactedError) Unwrap() error { return e.err }
+
+// timeoutError wraps the context error of a process run exceeding Timeout.
+func (t *TemplateResource) timeoutError(err error) error {
+	return fmt.Errorf("Processing %s timed out after %s: %w", t.Dest, t.Timeout, err)
+}
+
+// drifted stages a candidate configuration file and compares it to the dest
+// without syncing, removing the stage file afterwards.
+// It returns true if the dest is out of sync.
+func (t *TemplateResource) drifted() (bool, error) {
+	if t.writtenOnce() {
+		return false, nil
+	}
+	if err := t.setFileMode(); err != nil {
+		return false, err
+	}
+	if err := t.setVars(); err != nil {
+		return false, err
+	}
+	if err := t.CreateStageFile(); err != nil {
+		return false, err
+	}
+	defer t.fs.Remove(t.StageFile.Name())
+	return t.isChanged(t.StageFile.Name())
+}
+
+// diff stages the config file and compares it to the dest, then removes
+// the staged file.
+// It returns the unified diff from the dest to the staged file, and true if
+// the dest is out of sync.
+func (t *TemplateResource) diff() (string, bool, error) {
+	if t.writtenOnce() {
+		return "", false, nil
+	}
+	if err := t.setFileMode(); err != nil {
+		return "", false, err
+	}
+	if err := t.setVars(); err != nil {
+		return "", false, err
+	}
+	if err := t.CreateStageFile(); err != nil {
+		return "", false, err
+	}
+	staged := t.StageFile.Name()
+	defer t.fs.Remove(staged)
+	changed, err := t.isChanged(staged)
+	if err != nil || !changed {
+		return "", false, err
+	}
+
+	contents, err := afero.ReadFile(t.fs, staged)
+	if err != nil {
+		return "", false, err
+	}
+	fromName := t.Dest
+	var current []byte
+	if t.isFIFODest() {
+		fromName = "/dev/null"
+	} else if current, err = afero.ReadFile(t.fs, t.Dest); os.IsNotExist(err) {
+		fromName = "/dev/null"
+	} else if err != nil {
+		return "", false, err
+	}
+	diff := util.UnifiedDiff(fromName, t.Dest, current, contents)
+	if diff == "" {
+		diff = "Only the mode, ownership or checksum sidecar of " + t.Dest + " differs\n"
+	}
+	return diff, true, nil
+}
+
 // setFileMode sets the FileMode.
 func (t *TemplateResource) setFileMode() error {
 	if t.Mode == "" {
@@ -0,0 +1,204 @@
+//go:build !windows
+// +build !windows
+
+package template
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/abtreece/confd/pkg/log"
+	"github.com/spf13/afero"
+)
+
+func TestDestModeUnderUmask(t *testing.T) {
+	log.SetLevel("warn")
+	defer syscall.Umask(syscall.Umask(0077))
+	for _, busy := range []bool{false, true} {
+		fs := afero.NewOsFs()
+		tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+mode = "0664"
+fetch_all = true
+`, "foo = bar\n")
+		defer fs.RemoveAll(confDir)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if busy {
+			// The dest can't be renamed over and is written in place.
+			if err := afero.WriteFile(fs, tr.Dest, []byte("old\n"), 0600); err != nil {
+				t.Fatal(err.Error())
+			}
+			tr.fs = &faultyFs{Fs: fs, renameErr: syscall.EBUSY}
+		}
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		fi, err := os.Stat(tr.Dest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if fi.Mode().Perm() != 0664 {
+			t.Errorf("busy=%v: expected dest mode 0664 under umask 0077, got %s", busy, fi.Mode())
+		}
+	}
+}
+
+func TestACLs(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+mode = "0600"
+fetch_all = true
+acls = ["g:65534:r", "u:65534:rw"]
+`, "secret = s3cr3t\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// A setfacl stand-in records its arguments, for systems without ACL
+	// support.
+	bin := filepath.Join(confDir, "bin")
+	calls := filepath.Join(confDir, "setfacl.calls")
+	if err := fs.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n"
+	if err := afero.WriteFile(fs, filepath.Join(bin, "setfacl"), []byte(script), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, setfaclErr := exec.LookPath("setfacl")
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := "-m g:65534:r,u:65534:rw " + tr.Dest + "\n"
+	if b, err := afero.ReadFile(fs, calls); err != nil || string(b) != expected {
+		t.Errorf("Expected setfacl to be run with %q, got %q (%v)", expected, b, err)
+	}
+	// ACLs are only set when the dest is written.
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if b, _ := afero.ReadFile(fs, calls); string(b) != expected {
+		t.Errorf("Expected setfacl not to be run for a dest in sync, got %q", b)
+	}
+
+	getfacl, err := exec.LookPath("getfacl")
+	if setfaclErr != nil || err != nil {
+		t.Skip("setfacl and getfacl are required to check the applied ACLs")
+	}
+	fs.Remove(filepath.Join(bin, "setfacl"))
+	fs.Remove(tr.Dest)
+	if err := tr.process(); err != nil {
+		if strings.Contains(err.Error(), "Cannot set ACLs") {
+			t.Skip("the filesystem doesn't support ACLs: " + err.Error())
+		}
+		t.Fatal(err.Error())
+	}
+	out, err := exec.Command(getfacl, "-n", tr.Dest).Output()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, entry := range []string{"user:65534:rw-", "group:65534:r--"} {
+		if !strings.Contains(string(out), entry) {
+			t.Errorf("Expected the ACL of the dest to hold %s, got %s", entry, out)
+		}
+	}
+}
+
+func TestExecutableIfShebang(t *testing.T) {
+	log.SetLevel("warn")
+	tests := []struct {
+		tmpl string
+		mode os.FileMode
+	}{
+		{"#!/bin/sh\necho hook\n", 0750},
+		{"# not a script\n", 0640},
+		{" #!/bin/sh\n", 0640},
+	}
+	for _, tt := range tests {
+		fs := afero.NewOsFs()
+		tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+mode = "0640"
+fetch_all = true
+executable_if_shebang = true
+`, tt.tmpl)
+		defer fs.RemoveAll(confDir)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		tr.ReloadCmd = "echo >> " + filepath.Join(confDir, "reloads")
+		for i := 0; i < 2; i++ {
+			if err := tr.process(); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		fi, err := fs.Stat(tr.Dest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if fi.Mode().Perm() != tt.mode {
+			t.Errorf("%q: expected mode %s, got %s", tt.tmpl, tt.mode, fi.Mode().Perm())
+		}
+		// The dest is in sync once written with the execute bits.
+		if b, _ := afero.ReadFile(fs, filepath.Join(confDir, "reloads")); string(b) != "\n" {
+			t.Errorf("%q: expected a single reload, got %q", tt.tmpl, b)
+		}
+	}
+}
+
+func TestExecutableIfShebangNoLongerScript(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+executable_if_shebang = true
+`, "#!/bin/sh\necho hook\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Without a mode, the mode is read back from the dest, which must not
+	// keep the execute bits of the script once it isn't one anymore.
+	for _, step := range []struct {
+		tmpl string
+		mode os.FileMode
+	}{
+		{"#!/bin/sh\necho hook\n", 0755},
+		{"# not a script\n", 0644},
+		{"#!/bin/sh\necho hook again\n", 0755},
+	} {
+		if err := afero.WriteFile(fs, tr.Src, []byte(step.tmpl), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		fi, err := fs.Stat(tr.Dest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if fi.Mode().Perm() != step.mode {
+			t.Errorf("%q: expected mode %s, got %s", step.tmpl, step.mode, fi.Mode().Perm())
+		}
+	}
+}
@@ -1,13 +1,30 @@
 package template
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"text/template"
+	"time"
 
+	"github.com/abtreece/confd/pkg/backends"
+	"github.com/abtreece/confd/pkg/backends/consul"
 	"github.com/abtreece/confd/pkg/backends/env"
 	"github.com/abtreece/confd/pkg/log"
+	util "github.com/abtreece/confd/pkg/util"
 	"github.com/spf13/afero"
 )
 
@@ -108,3 +125,2128 @@ func TestProcessTemplateResources(t *testing.T) {
 		t.Errorf("Expected contents of dest == '%s', got %s", expected, string(results))
 	}
 }
+
+// loadTemplateResource writes the given resource toml to fs and loads it
+// with an env StoreClient.
+func loadTemplateResource(fs afero.Fs, resource string) (*TemplateResource, error) {
+	if err := fs.MkdirAll("test/confd", 0755); err != nil {
+		return nil, err
+	}
+	if err := afero.WriteFile(fs, tomlFilePath, []byte(resource), 0644); err != nil {
+		return nil, err
+	}
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	return NewTemplateResource(fs, tomlFilePath, Config{
+		StoreClient: storeClient,
+		TemplateDir: "test/templates",
+	})
+}
+
+func TestNewTemplateResourceEmptyKeys(t *testing.T) {
+	log.SetLevel("warn")
+	tr, err := loadTemplateResource(afero.NewMemMapFs(), `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tr.Keys) != 0 {
+		t.Errorf("Expected no keys, got %v", tr.Keys)
+	}
+}
+
+func TestNewTemplateResourceFetchAll(t *testing.T) {
+	log.SetLevel("warn")
+	tr, err := loadTemplateResource(afero.NewMemMapFs(), `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+prefix = "/app"
+fetch_all = true
+`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(tr.Keys, []string{"/"}) {
+		t.Errorf("Expected keys [/], got %v", tr.Keys)
+	}
+	keys := util.AppendPrefix(tr.Prefix, tr.Keys)
+	if !reflect.DeepEqual(keys, []string{"/app"}) {
+		t.Errorf("Expected prefixed keys [/app], got %v", keys)
+	}
+}
+
+func TestNewTemplateResourceNormalizesKeys(t *testing.T) {
+	log.SetLevel("warn")
+	tr, err := loadTemplateResource(afero.NewMemMapFs(), `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+keys = [
+  "foo",
+  " /bar/ ",
+  "//baz//qux",
+]
+`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []string{"/foo", "/bar", "/baz/qux"}
+	if !reflect.DeepEqual(tr.Keys, expected) {
+		t.Errorf("Expected keys %v, got %v", expected, tr.Keys)
+	}
+}
+
+func TestNewTemplateResourceBlankKey(t *testing.T) {
+	log.SetLevel("warn")
+	_, err := loadTemplateResource(afero.NewMemMapFs(), `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+keys = [
+  "/foo",
+  "  ",
+]
+`)
+	if err == nil {
+		t.Error("Expected an error for a blank key, got nil")
+	}
+}
+
+// newTestResource creates the conf.d and templates directories under a new
+// temporary confdir, writes the resource toml and its src template there and
+// loads the resource with an env StoreClient. The dest is set to a file
+// inside the confdir. The returned confdir must be removed by the caller.
+func newTestResource(fs afero.Fs, resource, tmpl string) (*TemplateResource, string, error) {
+	confDir, err := createTempDirs(fs)
+	if err != nil {
+		return nil, "", err
+	}
+	resourcePath := filepath.Join(confDir, "conf.d", "test.toml")
+	if err := afero.WriteFile(fs, resourcePath, []byte(resource), 0644); err != nil {
+		return nil, confDir, err
+	}
+	srcPath := filepath.Join(confDir, "templates", "test.conf.tmpl")
+	if err := afero.WriteFile(fs, srcPath, []byte(tmpl), 0644); err != nil {
+		return nil, confDir, err
+	}
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		return nil, confDir, err
+	}
+	tr, err := NewTemplateResource(fs, resourcePath, Config{
+		StoreClient: storeClient,
+		TemplateDir: filepath.Join(confDir, "templates"),
+	})
+	if err != nil {
+		return nil, confDir, err
+	}
+	tr.Dest = filepath.Join(confDir, "test.conf")
+	return tr, confDir, nil
+}
+
+func TestLineEndingCRLF(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+line_ending = "crlf"
+fetch_all = true
+`, "a = 1\nb = 2\r\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	actual, err := afero.ReadFile(fs, tr.Dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := "a = 1\r\nb = 2\r\n"
+	if string(actual) != expected {
+		t.Errorf("Expected dest %q, got %q", expected, string(actual))
+	}
+
+	// A second render must not be seen as a change.
+	if err := tr.CreateStageFile(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.Remove(tr.StageFile.Name())
+	changed, err := tr.isChanged(tr.StageFile.Name())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if changed {
+		t.Errorf("Expected no change on re-render of %s", tr.Dest)
+	}
+}
+
+func TestLineEndingInvalid(t *testing.T) {
+	log.SetLevel("warn")
+	_, err := loadTemplateResource(afero.NewMemMapFs(), `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+line_ending = "cr"
+fetch_all = true
+`)
+	if err == nil {
+		t.Error("Expected an error for an invalid line_ending, got nil")
+	}
+}
+
+func TestSetVarsDefaults(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewMemMapFs()
+	err := afero.WriteFile(fs, "test/confd/defaults.toml", []byte(`
+[confdtest]
+host = "127.0.0.1"
+port = 5432
+`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tr, err := loadTemplateResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+defaults = "test/confd/defaults.toml"
+keys = [
+  "/confdtest",
+]
+`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	os.Setenv("CONFDTEST_HOST", "db.example.com")
+	defer os.Unsetenv("CONFDTEST_HOST")
+	if err := tr.setVars(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := map[string]string{
+		"/confdtest/host": "db.example.com",
+		"/confdtest/port": "5432",
+	}
+	for k, v := range expected {
+		actual, err := tr.Store.GetValue(k)
+		if err != nil {
+			t.Errorf("Expected key %s in store: %s", k, err.Error())
+			continue
+		}
+		if actual != v {
+			t.Errorf("Expected %s to be %q, got %q", k, v, actual)
+		}
+	}
+}
+
+func TestRemoveIfEmpty(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+remove_if_empty = true
+keys = [
+  "/confdtest",
+]
+`, `{{range gets "/confdtest/*"}}{{.Value}}{{end}}
+`)
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// An empty render removes an existing dest.
+	if err := afero.WriteFile(fs, tr.Dest, []byte("stale"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if util.IsFileExist(fs, tr.Dest) {
+		t.Errorf("Expected %s to be removed", tr.Dest)
+	}
+
+	// A non-empty render writes the dest as usual.
+	os.Setenv("CONFDTEST_HOST", "db.example.com")
+	defer os.Unsetenv("CONFDTEST_HOST")
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	actual, err := afero.ReadFile(fs, tr.Dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(actual) != "db.example.com\n" {
+		t.Errorf("Expected dest %q, got %q", "db.example.com\n", string(actual))
+	}
+}
+
+func TestSymlinkSwap(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+symlink_swap = true
+keys = [
+  "/confdtest",
+]
+`, `{{getv "/confdtest/host"}}
+`)
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	os.Setenv("CONFDTEST_HOST", "db1.example.com")
+	defer os.Unsetenv("CONFDTEST_HOST")
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	first, err := fs.(afero.LinkReader).ReadlinkIfPossible(tr.Dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	os.Setenv("CONFDTEST_HOST", "db2.example.com")
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	second, err := fs.(afero.LinkReader).ReadlinkIfPossible(tr.Dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if first == second {
+		t.Fatalf("Expected %s to point to a new target, still points to %s", tr.Dest, first)
+	}
+
+	actual, err := afero.ReadFile(fs, tr.Dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(actual) != "db2.example.com\n" {
+		t.Errorf("Expected dest %q, got %q", "db2.example.com\n", string(actual))
+	}
+	// The previous target is kept for rollback.
+	previous, err := afero.ReadFile(fs, filepath.Join(confDir, first))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(previous) != "db1.example.com\n" {
+		t.Errorf("Expected previous target %q, got %q", "db1.example.com\n", string(previous))
+	}
+
+	// Older targets are removed, only the current and previous ones are
+	// kept.
+	for _, host := range []string{"db3.example.com", "db4.example.com", "db5.example.com"} {
+		os.Setenv("CONFDTEST_HOST", host)
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	targets, err := filepath.Glob(tr.Dest + ".*")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 targets to be kept, got %v", targets)
+	}
+	for i, expected := range []string{"db4.example.com\n", "db5.example.com\n"} {
+		if b, _ := afero.ReadFile(fs, targets[i]); string(b) != expected {
+			t.Errorf("Expected target %s to hold %q, got %q", targets[i], expected, b)
+		}
+	}
+}
+
+func TestRawBinaryValue(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+dest = "test.conf"
+raw = "/geoip/db"
+line_ending = "crlf"
+`, "")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	value := "\x00\xff\xfe\n\x80binary\x00\r\n"
+	tr.Store.Set("/geoip/db", value)
+
+	if err := tr.CreateStageFile(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.sync(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	actual, err := afero.ReadFile(fs, tr.Dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(actual, []byte(value)) {
+		t.Errorf("Expected dest %q, got %q", value, actual)
+	}
+
+	if err := tr.CreateStageFile(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.Remove(tr.StageFile.Name())
+	changed, err := tr.isChanged(tr.StageFile.Name())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if changed {
+		t.Errorf("Expected no change on re-render of %s", tr.Dest)
+	}
+}
+
+func TestConfigFuncMap(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewMemMapFs()
+	tt := templateTest{
+		desc: "custom func test",
+		toml: `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+fetch_all = true
+`,
+		tmpl: `{{greet "confd"}}`,
+	}
+	setupDirectoriesAndFiles(tt, t, fs)
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := Config{
+		StoreClient: storeClient,
+		TemplateDir: "./test/templates",
+		FuncMap: map[string]interface{}{
+			"greet": func(name string) string { return "hello " + name },
+		},
+	}
+	tr, err := NewTemplateResource(fs, tomlFilePath, config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tr.Dest = "./test/tmp/test.conf"
+	if err := tr.CreateStageFile(); err != nil {
+		t.Fatal(err.Error())
+	}
+	actual, err := afero.ReadFile(fs, tr.StageFile.Name())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(actual) != "hello confd" {
+		t.Errorf("Expected %q, got %q", "hello confd", string(actual))
+	}
+
+	// Built-in functions can't be replaced unless explicitly allowed.
+	config.FuncMap = map[string]interface{}{
+		"getv": func(key string) string { return "" },
+	}
+	if _, err := NewTemplateResource(fs, tomlFilePath, config); err == nil {
+		t.Error("Expected an error overriding getv, got nil")
+	}
+	config.AllowFuncOverride = true
+	if _, err := NewTemplateResource(fs, tomlFilePath, config); err != nil {
+		t.Errorf("Expected getv override to be allowed, got %s", err.Error())
+	}
+}
+
+// serviceStoreClient is an env StoreClient also serving fixed service
+// instances, like the consul backend does.
+type serviceStoreClient struct {
+	backends.StoreClient
+	services map[string][]consul.Service
+}
+
+func (c *serviceStoreClient) Service(name string) ([]consul.Service, error) {
+	return c.services[name], nil
+}
+
+func TestServiceFunc(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewMemMapFs()
+	tt := templateTest{
+		desc: "service func test",
+		toml: `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+fetch_all = true
+`,
+		tmpl: `{{range service "web"}}{{.Address}}:{{.Port}} {{join .Tags ","}}
+{{end}}`,
+	}
+	setupDirectoriesAndFiles(tt, t, fs)
+	envClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storeClient := &serviceStoreClient{
+		StoreClient: envClient,
+		services: map[string][]consul.Service{
+			"web": {
+				{ID: "web-1", Name: "web", Address: "10.0.0.1", Port: 8080, Tags: []string{"blue", "v1"}},
+				{ID: "web-2", Name: "web", Address: "10.0.0.2", Port: 8080},
+			},
+		},
+	}
+	config := Config{
+		StoreClient: newCachingStoreClient(storeClient),
+		TemplateDir: "./test/templates",
+	}
+	tr, err := NewTemplateResource(fs, tomlFilePath, config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tr.Dest = "./test/tmp/test.conf"
+	if err := tr.CreateStageFile(); err != nil {
+		t.Fatal(err.Error())
+	}
+	actual, err := afero.ReadFile(fs, tr.StageFile.Name())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := "10.0.0.1:8080 blue,v1\n10.0.0.2:8080 \n"
+	if string(actual) != expected {
+		t.Errorf("Expected %q, got %q", expected, string(actual))
+	}
+
+	// Backends without service discovery fail to render.
+	config.StoreClient = envClient
+	tr, err = NewTemplateResource(fs, tomlFilePath, config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.CreateStageFile(); err == nil {
+		t.Error("Expected an error using service with the env backend, got nil")
+	}
+}
+
+func TestProcessTimeout(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+reload_cmd = "sleep 5"
+timeout = "200ms"
+fetch_all = true
+`, "foo = bar\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	start := time.Now()
+	err = tr.process()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the reload to be cancelled, process took %s", elapsed)
+	}
+}
+
+func TestArgvCommands(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+check_argv = ["test", "-s", "{{.src}}"]
+reload_argv = ["touch", "{{.dest}}.$(echo reloaded); file with spaces"]
+fetch_all = true
+`, "foo = bar\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	// The argument reaches touch untouched by a shell.
+	reloaded := tr.Dest + ".$(echo reloaded); file with spaces"
+	if !util.IsFileExist(fs, reloaded) {
+		t.Errorf("Expected reload_argv to create %q", reloaded)
+	}
+}
+
+func TestAllowedCheckExitCodes(t *testing.T) {
+	log.SetLevel("error")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+check_cmd = "exit 2"
+fetch_all = true
+`, "foo = bar\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Only 0 is a success by default.
+	if err := tr.process(); err == nil {
+		t.Fatal("Expected the check exiting with 2 to fail, got nil")
+	}
+	if util.IsFileExist(fs, tr.Dest) {
+		t.Fatalf("Expected %s not to be written after a failed check", tr.Dest)
+	}
+
+	tr.AllowedCheckExitCodes = []int{1, 2}
+	if err := tr.process(); err != nil {
+		t.Fatalf("Expected the check exiting with 2 to be allowed, got %s", err.Error())
+	}
+	if !util.IsFileExist(fs, tr.Dest) {
+		t.Errorf("Expected %s to be written after an allowed check", tr.Dest)
+	}
+}
+
+func TestBinaryKeys(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+dest = "test.conf"
+raw = "/confdtest/blob"
+binary_keys = ["/confdtest/blob"]
+`, "")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	value := []byte("\x00\xffbinary\x00")
+	os.Setenv("CONFDTEST_BLOB", base64.StdEncoding.EncodeToString(value))
+	defer os.Unsetenv("CONFDTEST_BLOB")
+
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	actual, err := afero.ReadFile(fs, tr.Dest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(actual, value) {
+		t.Errorf("Expected dest %q, got %q", value, actual)
+	}
+}
+
+func TestGetvAbsolute(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewMemMapFs()
+	tt := templateTest{
+		desc: "getvAbsolute test",
+		toml: `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+prefix = "/app"
+keys = ["/name"]
+`,
+		tmpl: `{{getv "/name"}} {{getvAbsolute "/global/region"}} {{getvAbsolute "global/region"}} {{getvAbsolute "/global/missing" "none"}}
+`,
+	}
+	setupDirectoriesAndFiles(tt, t, fs)
+	storeClient := &countingStoreClient{values: map[string]string{
+		"/app/name":      "web",
+		"/global/region": "eu-west-1",
+	}}
+	tr, err := NewTemplateResource(fs, tomlFilePath, Config{
+		StoreClient: storeClient,
+		TemplateDir: "./test/templates",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tr.Dest = "./test/tmp/test.conf"
+	if err := tr.setVars(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.CreateStageFile(); err != nil {
+		t.Fatal(err.Error())
+	}
+	actual, err := afero.ReadFile(fs, tr.StageFile.Name())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := "web eu-west-1 eu-west-1 none\n"; string(actual) != expected {
+		t.Errorf("Expected %q, got %q", expected, actual)
+	}
+	// One call for the resource keys, then one per absolute key.
+	if storeClient.calls != 3 {
+		t.Errorf("Expected 3 GetValues calls, got %d", storeClient.calls)
+	}
+
+	if _, err := tr.getvAbsolute("/global/missing"); err == nil {
+		t.Error("Expected an error for a missing key without default")
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+max_size = 64
+`, "{{range seq 1 100}}line {{.}}\n{{end}}")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tr.keepStageFile = true
+	if err := tr.process(); err == nil {
+		t.Fatal("Expected an error for a rendered config exceeding max_size")
+	}
+	if util.IsFileExist(fs, tr.Dest) {
+		t.Error("Expected dest not to be written")
+	}
+	if util.IsFileExist(fs, tr.StageFile.Name()) {
+		t.Error("Expected the stage file to be removed")
+	}
+
+	tr.MaxSize = 1024
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !util.IsFileExist(fs, tr.Dest) {
+		t.Error("Expected dest to be written within max_size")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	log.SetLevel("warn")
+	t.Setenv("AUDIT_VALUE", "foo")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+keys = ["/audit/value"]
+`, "value = {{getv \"/audit/value\"}}\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var buf bytes.Buffer
+	tr.auditLog = newAuditLog(&buf)
+
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Setenv("AUDIT_VALUE", "bar")
+	tr.CheckCmd = "false"
+	if err := tr.process(); err == nil {
+		t.Fatal("Expected the check to fail")
+	}
+
+	expected := []auditRecord{
+		{Action: "write", NewChecksum: sum("value = foo\n"), Result: "ok"},
+		{Action: "skip", OldChecksum: sum("value = foo\n"), NewChecksum: sum("value = foo\n"), Result: "ok"},
+		{Action: "write", OldChecksum: sum("value = foo\n"), NewChecksum: sum("value = foo\n"), Result: "failed"},
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d audit records, got %d: %s", len(expected), len(lines), buf.String())
+	}
+	for i, line := range lines {
+		var r auditRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err.Error())
+		}
+		if r.Time.IsZero() || r.Resource != filepath.Join(confDir, "conf.d", "test.toml") || r.Dest != tr.Dest {
+			t.Errorf("Unexpected audit record %d: %s", i, line)
+		}
+		e := expected[i]
+		if r.Action != e.Action || r.OldChecksum != e.OldChecksum || r.NewChecksum != e.NewChecksum || r.Result != e.Result {
+			t.Errorf("Expected audit record %d to be %+v, got %s", i, e, line)
+		}
+		if (r.Result == "failed") != (r.Error != "") {
+			t.Errorf("Expected an error only on failure, got %s", line)
+		}
+	}
+}
+
+func TestCommandsUseStoreValues(t *testing.T) {
+	log.SetLevel("warn")
+	t.Setenv("SERVICE", "nginx")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+keys = ["/service"]
+`, "service = {{getv \"/service\"}}\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	checked := filepath.Join(confDir, "checked")
+	reloaded := filepath.Join(confDir, "reloaded")
+	tr.CheckCmd = `grep -q {{getv "/service"}} {{.src}} && echo {{getv "/service"}} > ` + checked
+	tr.ReloadCmd = `echo restart {{getv "/service"}} {{.dest}} > ` + reloaded
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for file, expected := range map[string]string{
+		checked:  "nginx\n",
+		reloaded: "restart nginx " + tr.Dest + "\n",
+	} {
+		actual, err := afero.ReadFile(fs, file)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(actual) != expected {
+			t.Errorf("Expected %q, got %q", expected, actual)
+		}
+	}
+}
+
+// faultyFs fails renames with renameErr if set, like EBUSY for a bind
+// mounted dest, and the first write of the file failName, or of any stage
+// file if failStage is set, halfway like a full disk. If corrupt is set,
+// renamed files lose their contents.
+type faultyFs struct {
+	afero.Fs
+	renameErr error
+	failName  string
+	failStage bool
+	corrupt   bool
+	// unreadable makes the files renamed into place fail to open.
+	unreadable bool
+	failOpen   string
+}
+
+func (fs *faultyFs) Rename(oldname, newname string) error {
+	if fs.renameErr != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.renameErr}
+	}
+	if err := fs.Fs.Rename(oldname, newname); err != nil {
+		return err
+	}
+	if fs.corrupt {
+		return afero.WriteFile(fs.Fs, newname, nil, 0644)
+	}
+	if fs.unreadable {
+		fs.failOpen = newname
+	}
+	return nil
+}
+
+func (fs *faultyFs) Open(name string) (afero.File, error) {
+	if name == fs.failOpen {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EACCES}
+	}
+	return fs.Fs.Open(name)
+}
+
+func (fs *faultyFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return f, err
+	}
+	// Stage files are created exclusively.
+	if name == fs.failName || (fs.failStage && flag&os.O_EXCL != 0) {
+		fs.failName = ""
+		return &failingFile{f}, nil
+	}
+	return f, nil
+}
+
+type failingFile struct {
+	afero.File
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	n, _ := f.File.Write(p[:len(p)/2])
+	return n, syscall.ENOSPC
+}
+
+func TestWriteDestBusyFallback(t *testing.T) {
+	log.SetLevel("warn")
+	base := afero.NewMemMapFs()
+	tr := &TemplateResource{Dest: "/etc/test.conf", FileMode: 0644, Uid: -1, Gid: -1}
+	if err := afero.WriteFile(base, tr.Dest, []byte("original contents\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := afero.WriteFile(base, "/etc/.test.conf.staged", []byte("new\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tr.fs = &faultyFs{Fs: base, renameErr: syscall.EBUSY, failName: tr.Dest}
+	if err := tr.writeDest("/etc/.test.conf.staged"); err == nil {
+		t.Fatal("Expected the failed write to be reported")
+	}
+	if b, _ := afero.ReadFile(base, tr.Dest); string(b) != "original contents\n" {
+		t.Errorf("Expected the original dest to be restored, got %q", b)
+	}
+
+	tr.fs = &faultyFs{Fs: base, renameErr: syscall.EBUSY}
+	if err := tr.writeDest("/etc/.test.conf.staged"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if b, _ := afero.ReadFile(base, tr.Dest); string(b) != "new\n" {
+		t.Errorf("Expected the dest to be overwritten, got %q", b)
+	}
+}
+
+// failingStoreClient fails to get any value.
+type failingStoreClient struct {
+	backends.StoreClient
+}
+
+func (c *failingStoreClient) GetValues(keys []string) (map[string]string, error) {
+	return nil, errors.New("backend unavailable")
+}
+
+func TestProcessFailureLeavesDestUnchanged(t *testing.T) {
+	log.SetLevel("warn")
+	tests := []struct {
+		desc  string
+		setup func(tr *TemplateResource, confDir string)
+	}{
+		{"invalid mode", func(tr *TemplateResource, confDir string) {
+			tr.Mode = "rw-"
+		}},
+		{"store error", func(tr *TemplateResource, confDir string) {
+			tr.storeClient = &failingStoreClient{tr.storeClient}
+		}},
+		{"render error", func(tr *TemplateResource, confDir string) {
+			tr.Src = filepath.Join(confDir, "templates", "broken.tmpl")
+			afero.WriteFile(tr.fs, tr.Src, []byte("{{getv \"/missing\"}}\n"), 0644)
+		}},
+		{"stage write error", func(tr *TemplateResource, confDir string) {
+			tr.fs = &faultyFs{Fs: tr.fs, failStage: true}
+		}},
+		{"max size", func(tr *TemplateResource, confDir string) {
+			tr.MaxSize = 1
+		}},
+		{"check failure", func(tr *TemplateResource, confDir string) {
+			tr.CheckCmd = "false"
+		}},
+		{"timeout", func(tr *TemplateResource, confDir string) {
+			tr.CheckCmd = "sleep 5"
+			tr.Timeout = 100 * time.Millisecond
+		}},
+		{"rename error", func(tr *TemplateResource, confDir string) {
+			tr.fs = &faultyFs{Fs: tr.fs, renameErr: syscall.EXDEV}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			fs := afero.NewOsFs()
+			tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+`, "new contents\n")
+			defer fs.RemoveAll(confDir)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := afero.WriteFile(fs, tr.Dest, []byte("original contents\n"), 0600); err != nil {
+				t.Fatal(err.Error())
+			}
+			tt.setup(tr, confDir)
+
+			if err := tr.process(); err == nil {
+				t.Fatal("Expected process to fail")
+			}
+			fi, err := fs.Stat(tr.Dest)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if b, _ := afero.ReadFile(fs, tr.Dest); string(b) != "original contents\n" || fi.Mode() != 0600 {
+				t.Errorf("Expected dest to be unchanged, got %q with mode %v", b, fi.Mode())
+			}
+			staged, err := afero.Glob(fs, filepath.Join(confDir, ".test.conf*"))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if len(staged) > 0 {
+				t.Errorf("Expected no stage file to be left, got %v", staged)
+			}
+		})
+	}
+}
+
+func TestStageFileMode(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+mode = "0644"
+`, "secret = s3cr3t\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if fi, err := fs.Stat(tr.Dest); err != nil || fi.Mode() != 0644 {
+		t.Fatalf("Expected dest with mode 0644, got %v (%v)", fi.Mode(), err)
+	}
+
+	for _, tt := range []struct {
+		stageFileMode os.FileMode
+		expected      os.FileMode
+	}{
+		{0, 0600},
+		{0640, 0640},
+	} {
+		tr.StageFileMode = tt.stageFileMode
+		if err := tr.CreateStageFile(); err != nil {
+			t.Fatal(err.Error())
+		}
+		fi, err := fs.Stat(tr.StageFile.Name())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if fi.Mode() != tt.expected {
+			t.Errorf("Expected stage file with mode %v, got %v", tt.expected, fi.Mode())
+		}
+		// The stage file mode doesn't make the dest look out of sync.
+		changed, err := tr.isChanged(tr.StageFile.Name())
+		fs.Remove(tr.StageFile.Name())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if changed {
+			t.Errorf("Expected %s to be in sync", tr.Dest)
+		}
+	}
+}
+
+func TestChecksumSidecar(t *testing.T) {
+	log.SetLevel("warn")
+	for _, tt := range []struct {
+		algo string
+		sum  func(data []byte) string
+	}{
+		{"sha256", func(data []byte) string { return fmt.Sprintf("%x", sha256.Sum256(data)) }},
+		{"md5", func(data []byte) string { return fmt.Sprintf("%x", md5.Sum(data)) }},
+	} {
+		fs := afero.NewOsFs()
+		tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+checksum_sidecar = "`+tt.algo+`"
+`, "foo = bar\n")
+		defer fs.RemoveAll(confDir)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		sidecar := tr.Dest + "." + tt.algo
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		dest, err := afero.ReadFile(fs, tr.Dest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		expected := tt.sum(dest) + "  test.conf\n"
+		if actual, _ := afero.ReadFile(fs, sidecar); string(actual) != expected {
+			t.Errorf("Expected %s sidecar %q, got %q", tt.algo, expected, actual)
+		}
+
+		// A stale sidecar puts the dest out of sync and is rewritten.
+		if err := afero.WriteFile(fs, sidecar, []byte("stale\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if drifted, err := tr.drifted(); err != nil || !drifted {
+			t.Errorf("Expected a stale %s sidecar to be drift, got %v (%v)", tt.algo, drifted, err)
+		}
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		if actual, _ := afero.ReadFile(fs, sidecar); string(actual) != expected {
+			t.Errorf("Expected %s sidecar to be rewritten to %q, got %q", tt.algo, expected, actual)
+		}
+		staged, _ := afero.Glob(fs, filepath.Join(confDir, ".test.conf*"))
+		if len(staged) > 0 {
+			t.Errorf("Expected no temp file to be left, got %v", staged)
+		}
+	}
+}
+
+func TestChecksumSidecarInvalid(t *testing.T) {
+	log.SetLevel("warn")
+	_, err := loadTemplateResource(afero.NewMemMapFs(), `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+checksum_sidecar = "crc32"
+fetch_all = true
+`)
+	if err == nil {
+		t.Error("Expected an error for an invalid checksum_sidecar, got nil")
+	}
+}
+
+func TestVerifyAfterWrite(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+verify_after_write = true
+`, "foo = bar\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reloaded := filepath.Join(confDir, "reloaded")
+	tr.ReloadCmd = "touch " + reloaded
+
+	tr.fs = &faultyFs{Fs: fs, corrupt: true}
+	if err := tr.process(); err == nil {
+		t.Fatal("Expected the corrupted write to be detected")
+	}
+	if util.IsFileExist(fs, reloaded) {
+		t.Error("Expected no reload after a corrupted write")
+	}
+
+	tr.fs = &faultyFs{Fs: fs, unreadable: true}
+	if err := tr.process(); err == nil || !strings.Contains(err.Error(), "Cannot verify") {
+		t.Fatalf("Expected an unreadable dest to fail the verification, got %v", err)
+	}
+	if util.IsFileExist(fs, reloaded) {
+		t.Error("Expected no reload after an unverified write")
+	}
+	if _, err := fileChecksum(tr.fs, tr.Dest); err == nil {
+		t.Error("Expected an error for the checksum of an unreadable file")
+	}
+
+	fs.Remove(tr.Dest)
+	tr.fs = fs
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if b, _ := afero.ReadFile(fs, tr.Dest); string(b) != "foo = bar\n" {
+		t.Errorf("Expected dest to be written, got %q", b)
+	}
+	if !util.IsFileExist(fs, reloaded) {
+		t.Error("Expected a reload after a verified write")
+	}
+}
+
+func TestNumericGroup(t *testing.T) {
+	log.SetLevel("warn")
+	tests := []struct {
+		group string
+		gid   int
+		valid bool
+	}{
+		{"1000", 1000, true},
+		{"0", 0, true},
+		{"4242424", 4242424, true},
+		{"4294967296", 0, false},
+	}
+	for _, tt := range tests {
+		// No group of these names exists, so the lookup would fail.
+		tr, err := loadTemplateResource(afero.NewMemMapFs(), `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+group = "`+tt.group+`"
+fetch_all = true
+`)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("group %s: expected an error, got nil", tt.group)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("group %s: unexpected error: %s", tt.group, err.Error())
+			continue
+		}
+		if tr.Gid != tt.gid {
+			t.Errorf("group %s: expected gid %d, got %d", tt.group, tt.gid, tr.Gid)
+		}
+	}
+}
+
+func TestExtends(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewMemMapFs()
+	base := `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/base.conf"
+owner = "nobody"
+check_cmd = "true"
+keys = ["/foo"]
+`
+	if err := afero.WriteFile(fs, "test/base.toml", []byte(base), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	tr, err := loadTemplateResource(fs, `
+[template]
+extends = "test/base.toml"
+dest = "./tmp/test.conf"
+`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if tr.Dest != "./tmp/test.conf" {
+		t.Errorf("expected dest ./tmp/test.conf, got %s", tr.Dest)
+	}
+	if tr.Owner != "nobody" {
+		t.Errorf("expected owner nobody from the base, got %q", tr.Owner)
+	}
+	if tr.CheckCmd != "true" {
+		t.Errorf("expected check_cmd true from the base, got %q", tr.CheckCmd)
+	}
+	if !reflect.DeepEqual(tr.Keys, []string{"/foo"}) {
+		t.Errorf("expected keys [/foo] from the base, got %v", tr.Keys)
+	}
+}
+
+func TestResourceFormats(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewMemMapFs()
+	files := map[string]string{
+		"app.toml": `
+[template]
+src = "app.conf.tmpl"
+dest = "/etc/app.conf"
+keys = ["/app", "/db"]
+mode = "0640"
+stage_file_mode = 0o600
+max_size = 1024
+timeout = "30s"
+fetch_all = true
+allowed_check_exit_codes = [1, 2]
+check_argv = ["app", "-t", "{{.src}}"]
+reload_cmd = "systemctl reload app"
+`,
+		"app.resource.yaml": `
+template:
+  src: app.conf.tmpl
+  dest: /etc/app.conf
+  keys:
+    - /app
+    - /db
+  mode: 0640
+  stage_file_mode: 0600
+  max_size: 1024
+  timeout: 30s
+  fetch_all: true
+  allowed_check_exit_codes: [1, 2]
+  check_argv: [app, -t, "{{.src}}"]
+  reload_cmd: systemctl reload app
+`,
+		"app.resource.json": `{
+	"template": {
+		"src": "app.conf.tmpl",
+		"dest": "/etc/app.conf",
+		"keys": ["/app", "/db"],
+		"mode": 416,
+		"stage_file_mode": 384,
+		"max_size": 1024,
+		"timeout": "30s",
+		"fetch_all": true,
+		"allowed_check_exit_codes": [1, 2],
+		"check_argv": ["app", "-t", "{{.src}}"],
+		"reload_cmd": "systemctl reload app"
+	}
+}`,
+	}
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	type fields struct {
+		Src, Dest, Mode, ReloadCmd string
+		Keys, CheckArgv            []string
+		StageFileMode              os.FileMode
+		MaxSize                    int64
+		Timeout                    time.Duration
+		FetchAll                   bool
+		AllowedCheckExitCodes      []int
+	}
+	var want fields
+	for _, name := range []string{"app.toml", "app.resource.yaml", "app.resource.json"} {
+		p := filepath.Join("test/confd", name)
+		if err := afero.WriteFile(fs, p, []byte(files[name]), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		tr, err := NewTemplateResource(fs, p, Config{StoreClient: storeClient, TemplateDir: "test/templates"})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		if tr.resourceName() != "app" {
+			t.Errorf("%s: expected resource name app, got %s", name, tr.resourceName())
+		}
+		got := fields{tr.Src, tr.Dest, tr.Mode, tr.ReloadCmd, tr.Keys, tr.CheckArgv, tr.StageFileMode, tr.MaxSize, tr.Timeout, tr.FetchAll, tr.AllowedCheckExitCodes}
+		if name == "app.toml" {
+			want = got
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected the resource of app.toml\n%+v\ngot\n%+v", name, want, got)
+		}
+	}
+}
+
+func TestResourceFormatsInvalid(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewMemMapFs()
+	storeClient, err := env.NewEnvClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for name, data := range map[string]string{
+		"list.resource.yaml": "- template\n",
+		"bad.resource.json":  `{"template": `,
+		"bad.resource.yml":   "template: [\n",
+	} {
+		p := filepath.Join("test/confd", name)
+		if err := afero.WriteFile(fs, p, []byte(data), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := NewTemplateResource(fs, p, Config{StoreClient: storeClient}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestExtendsCycle(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewMemMapFs()
+	base := `
+[template]
+extends = "test/confd/config.toml"
+owner = "nobody"
+`
+	if err := afero.WriteFile(fs, "test/base.toml", []byte(base), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err := loadTemplateResource(fs, `
+[template]
+extends = "test/base.toml"
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+keys = ["/foo"]
+`)
+	if err == nil {
+		t.Error("expected an error for an extends cycle, got nil")
+	}
+}
+
+func TestAllowDenyKeys(t *testing.T) {
+	log.SetLevel("warn")
+	t.Setenv("APP_NAME", "shop")
+	t.Setenv("APP_SECRET_TOKEN", "s3cr3t")
+	t.Setenv("OTHER_VALUE", "other")
+	resource := `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+keys = ["/app", "/other"]
+allow_keys = ["/app"]
+deny_keys = ["/app/secret*"]
+`
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, resource, `name = {{getv "/app/name"}}
+keys = {{join (ls "/app") ","}}
+secret = {{exists "/app/secret/token"}}
+other = {{exists "/other/value"}}
+`)
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := "name = shop\nkeys = name\nsecret = false\nother = false\n"
+	if b, err := afero.ReadFile(fs, tr.Dest); err != nil || string(b) != expected {
+		t.Errorf("Expected dest to be %q, got %q (%v)", expected, b, err)
+	}
+
+	for _, tmpl := range []string{
+		`{{getv "/app/secret/token"}}`,
+		`{{getv "/other/value"}}`,
+		`{{getvAbsolute "/app/secret/token"}}`,
+	} {
+		tr, confDir, err := newTestResource(fs, resource, tmpl)
+		defer fs.RemoveAll(confDir)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := tr.process(); err == nil {
+			t.Errorf("Expected %s to fail for a denied key", tmpl)
+		}
+		if util.IsFileExist(fs, tr.Dest) {
+			t.Errorf("Expected %s not to write dest", tmpl)
+		}
+	}
+}
+
+func TestAllowKeysInvalidPattern(t *testing.T) {
+	log.SetLevel("warn")
+	_, err := loadTemplateResource(afero.NewMemMapFs(), `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+keys = ["/app"]
+allow_keys = ["/app/[a-"]
+`)
+	if err == nil {
+		t.Error("Expected an error for an invalid key pattern, got nil")
+	}
+}
+
+func TestCompareMode(t *testing.T) {
+	log.SetLevel("warn")
+	tests := []struct {
+		desc     string
+		mode     string
+		rendered string
+		dest     string
+		changed  bool
+	}{
+		{"json key order", "json", `{"a": 1, "b": [1, 2]}`, "{\n  \"b\": [1, 2],\n  \"a\": 1\n}\n", false},
+		{"json value", "json", `{"a": 1, "b": [1, 2]}`, `{"b": [2, 1], "a": 1}`, true},
+		{"json invalid dest", "json", `{"a": 1}`, `{"a": 1`, true},
+		{"yaml key order and comments", "yaml", "a: 1\nb: [x, y]\n", "# managed\nb:\n  - x\n  - y\na: 1\n", false},
+		{"json big integers", "json", `{"n": 9007199254740993}`, `{"n": 9007199254740992}`, true},
+		{"json trailing data", "json", `{"a": 1}`, `{"a": 1} {"b": 2}`, true},
+		{"yaml value", "yaml", "a: 1\n", "a: 2\n", true},
+		{"yaml later document", "yaml", "a: 1\n---\nb: 1\n", "a: 1\n---\nb: 2\n", true},
+		{"yaml documents", "yaml", "a: 1\n---\nb: [x]\n", "a: 1\n---\nb:\n  - x\n", false},
+		{"bytes", "bytes", `{"a": 1, "b": 2}`, `{"b": 2, "a": 1}`, true},
+		{"default", "", `{"a": 1, "b": 2}`, `{"b": 2, "a": 1}`, true},
+	}
+	for _, tt := range tests {
+		fs := afero.NewOsFs()
+		tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+compare_mode = "`+tt.mode+`"
+fetch_all = true
+`, tt.rendered)
+		defer fs.RemoveAll(confDir)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := afero.WriteFile(fs, tr.Dest, []byte(tt.dest), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := tr.process(); err != nil {
+			t.Fatalf("%s: %s", tt.desc, err.Error())
+		}
+		b, err := afero.ReadFile(fs, tr.Dest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		expected := tt.dest
+		if tt.changed {
+			expected = tt.rendered
+		}
+		if string(b) != expected {
+			t.Errorf("%s: expected dest to be %q, got %q", tt.desc, expected, string(b))
+		}
+	}
+}
+
+func TestCompareModeInvalid(t *testing.T) {
+	log.SetLevel("warn")
+	_, err := loadTemplateResource(afero.NewMemMapFs(), `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+compare_mode = "xml"
+fetch_all = true
+`)
+	if err == nil {
+		t.Error("Expected an error for an invalid compare_mode, got nil")
+	}
+}
+
+func TestCommandOutputMasked(t *testing.T) {
+	t.Setenv("APP_DB_PASSWORD", "hunter2pass")
+	t.Setenv("APP_LICENSE", "LIC-1234-5678")
+	t.Setenv("APP_NAME", "shop")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+keys = ["/app"]
+check_cmd = "echo name={{getv \"/app/name\"}} password={{getv \"/app/db/password\"}} license={{getv \"/app/license\"}}; exit 1"
+`, "name = {{getv \"/app/name\"}}\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tr, err = NewTemplateResource(fs, tr.resourcePath, Config{
+		MaskPatterns: []string{`LIC-[0-9-]+`},
+		StoreClient:  tr.storeClient,
+		TemplateDir:  filepath.Join(confDir, "templates"),
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tr.Dest = filepath.Join(confDir, "test.conf")
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	log.SetLevel("warn")
+	if err := tr.process(); err == nil {
+		t.Fatal("Expected the check command to fail")
+	}
+
+	logged := buf.String()
+	for _, secret := range []string{"hunter2pass", "LIC-1234-5678"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("Expected %s to be masked in the log, got %s", secret, logged)
+		}
+	}
+	if !strings.Contains(logged, "name=shop password=*** license=***") {
+		t.Errorf("Expected the masked command output in the log, got %s", logged)
+	}
+}
+
+func TestMaskPatternsInvalid(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewMemMapFs()
+	if _, err := loadTemplateResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+fetch_all = true
+`); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err := NewTemplateResource(fs, tomlFilePath, Config{
+		MaskPatterns: []string{"LIC-[0-9"},
+		StoreClient:  &env.Client{},
+		TemplateDir:  "test/templates",
+	})
+	if err == nil {
+		t.Error("Expected an error for an invalid mask pattern, got nil")
+	}
+}
+
+func TestHeaderFooterTemplates(t *testing.T) {
+	log.SetLevel("warn")
+	t.Setenv("APP_NAME", "shop")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+keys = ["/app"]
+`, "name = {{getv \"/app/name\"}}\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reloads := filepath.Join(confDir, "reloads")
+	for i := 0; i < 2; i++ {
+		// Resources are reloaded on every run, as the interval processor
+		// does.
+		tr, err := NewTemplateResource(fs, tr.resourcePath, Config{
+			FooterTemplate: "# end of {{getv \"/app/name\"}}\n",
+			HeaderTemplate: "# DO NOT EDIT - managed by confd ({{resourceName}})\n",
+			StoreClient:    tr.storeClient,
+			TemplateDir:    filepath.Join(confDir, "templates"),
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		tr.Dest = filepath.Join(confDir, "test.conf")
+		tr.ReloadCmd = "echo >> " + reloads
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		expected := "# DO NOT EDIT - managed by confd (test)\nname = shop\n# end of shop\n"
+		if b, err := afero.ReadFile(fs, tr.Dest); err != nil || string(b) != expected {
+			t.Errorf("Expected dest to be %q, got %q (%v)", expected, b, err)
+		}
+	}
+	if b, err := afero.ReadFile(fs, reloads); err != nil || string(b) != "\n" {
+		t.Errorf("Expected a single reload with the header and footer unchanged, got %q (%v)", b, err)
+	}
+
+	tr.headerTemplate = "{{getv \"/app/missing\"}}"
+	if err := tr.process(); err == nil {
+		t.Error("Expected a failing header template to fail the run")
+	}
+}
+
+func TestMaxRenderDepth(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+`, `{{define "down"}}{{if gt . 0}}{{template "down" sub . 1}}{{end}}{{.}}{{end}}{{template "down" 3}}`)
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tests := []struct {
+		max   int
+		valid bool
+	}{
+		{0, true},
+		{4, true},
+		{3, false},
+	}
+	for _, tt := range tests {
+		tr, err := NewTemplateResource(fs, tr.resourcePath, Config{
+			MaxRenderDepth: tt.max,
+			StoreClient:    tr.storeClient,
+			TemplateDir:    filepath.Join(confDir, "templates"),
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		contents, err := tr.render()
+		if !tt.valid {
+			if err == nil || !strings.Contains(err.Error(), "exceeds the maximum render depth of 3") {
+				t.Errorf("max %d: expected a render depth error, got %v", tt.max, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("max %d: unexpected error: %s", tt.max, err.Error())
+		} else if string(contents) != "0123" {
+			t.Errorf("max %d: expected 0123, got %q", tt.max, contents)
+		}
+	}
+}
+
+func TestRenderDepthErrors(t *testing.T) {
+	log.SetLevel("warn")
+	tests := []struct {
+		desc     string
+		tmpl     string
+		expected string
+	}{
+		{
+			"self inclusion",
+			`{{define "loop"}}x{{template "loop" .}}{{end}}{{template "loop" .}}`,
+			`template "loop" exceeds the maximum render depth of 100`,
+		},
+		{
+			"error in an included template",
+			`{{define "port"}}{{getv "/missing"}}{{end}}port = {{template "port"}}`,
+			`at <template "port" nil>: error calling template:`,
+		},
+	}
+	for _, tt := range tests {
+		fs := afero.NewOsFs()
+		tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+`, tt.tmpl)
+		defer fs.RemoveAll(confDir)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = tr.render()
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.desc, tt.expected, err)
+		}
+	}
+}
+
+func TestIgnorePatterns(t *testing.T) {
+	log.SetLevel("warn")
+	t.Setenv("GENERATED_AT", "2024-01-01")
+	t.Setenv("APP_NAME", "shop")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+keys = ["/app"]
+ignore_patterns = ["^# generated at "]
+`, "# generated at {{getenv \"GENERATED_AT\"}}\nname = {{getv \"/app/name\"}}\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reloads := filepath.Join(confDir, "reloads")
+	tr.ReloadCmd = "echo >> " + reloads
+
+	steps := []struct {
+		generatedAt string
+		name        string
+		expected    string
+		reloads     string
+	}{
+		{"2024-01-01", "shop", "# generated at 2024-01-01\nname = shop\n", "\n"},
+		// Only the ignored line differs, the dest is kept as is.
+		{"2024-01-02", "shop", "# generated at 2024-01-01\nname = shop\n", "\n"},
+		// The ignored line is written along with the other changes.
+		{"2024-01-03", "store", "# generated at 2024-01-03\nname = store\n", "\n\n"},
+	}
+	for i, step := range steps {
+		t.Setenv("GENERATED_AT", step.generatedAt)
+		t.Setenv("APP_NAME", step.name)
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		if b, err := afero.ReadFile(fs, tr.Dest); err != nil || string(b) != step.expected {
+			t.Errorf("step %d: expected dest to be %q, got %q (%v)", i, step.expected, b, err)
+		}
+		if b, _ := afero.ReadFile(fs, reloads); string(b) != step.reloads {
+			t.Errorf("step %d: expected reloads %q, got %q", i, step.reloads, b)
+		}
+	}
+}
+
+func TestTrimCompare(t *testing.T) {
+	log.SetLevel("warn")
+	t.Setenv("APP_NAME", "shop")
+	for _, trim := range []bool{true, false} {
+		fs := afero.NewOsFs()
+		tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+keys = ["/app"]
+trim_compare = `+strconv.FormatBool(trim)+`
+`, "name = {{getv \"/app/name\"}}\n")
+		defer fs.RemoveAll(confDir)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		reloads := filepath.Join(confDir, "reloads")
+		tr.ReloadCmd = "echo >> " + reloads
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// An editor adds whitespace around the config.
+		edited := "\nname = shop  \n\n"
+		if err := afero.WriteFile(fs, tr.Dest, []byte(edited), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		expected, expectedReloads := "name = shop\n", "\n\n"
+		if trim {
+			expected, expectedReloads = edited, "\n"
+		}
+		if b, err := afero.ReadFile(fs, tr.Dest); err != nil || string(b) != expected {
+			t.Errorf("trim_compare %v: expected dest to be %q, got %q (%v)", trim, expected, b, err)
+		}
+		if b, _ := afero.ReadFile(fs, reloads); string(b) != expectedReloads {
+			t.Errorf("trim_compare %v: expected reloads %q, got %q", trim, expectedReloads, b)
+		}
+	}
+}
+
+func TestIgnorePatternsInvalid(t *testing.T) {
+	log.SetLevel("warn")
+	_, err := loadTemplateResource(afero.NewMemMapFs(), `
+[template]
+src = "test.conf.tmpl"
+dest = "./tmp/test.conf"
+keys = ["/foo"]
+ignore_patterns = ["("]
+`)
+	if err == nil {
+		t.Error("expected an error for an invalid ignore pattern, got nil")
+	}
+}
+
+func TestEmptyTemplate(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	for _, allow := range []bool{false, true} {
+		tr, confDir, err := newTestResource(fs, fmt.Sprintf(`
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+allow_empty_template = %t
+`, allow), "")
+		defer fs.RemoveAll(confDir)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := afero.WriteFile(fs, tr.Dest, []byte("working = config\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		err = tr.process()
+		b, _ := afero.ReadFile(fs, tr.Dest)
+		if !allow {
+			if err == nil {
+				t.Error("expected an empty template to fail the run")
+			}
+			if string(b) != "working = config\n" {
+				t.Errorf("expected the dest to be kept, got %q", b)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("allow_empty_template: unexpected error: %s", err.Error())
+		}
+		if len(b) != 0 {
+			t.Errorf("allow_empty_template: expected an empty dest, got %q", b)
+		}
+	}
+}
+
+func TestWorkingDir(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+`, "foo = bar\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	load := func(workingDir string) (*TemplateResource, error) {
+		resource := `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+working_dir = "` + workingDir + `"
+check_cmd = "test -f test.conf.tmpl"
+reload_cmd = "pwd > pwd.out"
+`
+		if err := afero.WriteFile(fs, tr.resourcePath, []byte(resource), 0644); err != nil {
+			return nil, err
+		}
+		tr, err := NewTemplateResource(fs, tr.resourcePath, Config{
+			ConfDir:     confDir,
+			StoreClient: tr.storeClient,
+			TemplateDir: filepath.Join(confDir, "templates"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		tr.Dest = filepath.Join(confDir, "test.conf")
+		return tr, nil
+	}
+
+	// A relative working_dir is under the confdir.
+	tr, err = load("templates")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tr.process(); err != nil {
+		t.Fatal(err.Error())
+	}
+	workingDir, err := filepath.EvalSymlinks(filepath.Join(confDir, "templates"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := afero.ReadFile(fs, filepath.Join(confDir, "templates", "pwd.out"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got, _ := filepath.EvalSymlinks(strings.TrimSpace(string(b))); got != workingDir {
+		t.Errorf("Expected the reload command to run in %s, got %s", workingDir, got)
+	}
+
+	if _, err := load("missing"); err == nil {
+		t.Error("Expected an error for a missing working_dir, got nil")
+	}
+	if _, err := load(filepath.Join(confDir, "test.conf")); err == nil {
+		t.Error("Expected an error for a working_dir which isn't a directory, got nil")
+	}
+}
+
+func TestRedactDestInLogs(t *testing.T) {
+	t.Setenv("APP_NAME", "shop")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+keys = ["/app"]
+check_cmd = "cat {{.src}}"
+reload_cmd = "echo reloading {{.dest}}"
+`, "name = {{getv \"/app/name\"}}\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	dest := filepath.Join(confDir, "tenant-acme.conf")
+	for _, redact := range []bool{false, true} {
+		fs.Remove(dest)
+		matches, _ := filepath.Glob(dest + ".*")
+		for _, m := range matches {
+			fs.Remove(m)
+		}
+		tr, err := NewTemplateResource(fs, tr.resourcePath, Config{
+			RedactDestInLogs: redact,
+			StoreClient:      tr.storeClient,
+			TemplateDir:      filepath.Join(confDir, "templates"),
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		tr.Dest = dest
+		tr.SymlinkSwap = true
+
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		log.SetLevel("debug")
+		// Written, in sync, then failing the check.
+		for i := 0; i < 3; i++ {
+			if i == 2 {
+				tr.CheckCmd = "exit 1"
+				afero.WriteFile(fs, dest, []byte("edited by hand\n"), 0644)
+			}
+			if err := tr.process(); err != nil {
+				log.Error(err.Error())
+			}
+		}
+		log.SetOutput(os.Stderr)
+		log.SetLevel("warn")
+
+		logged := buf.String()
+		if redact == strings.Contains(logged, "tenant-acme") {
+			t.Errorf("redact %t: expected the dest to be logged only when not redacted, got %s", redact, logged)
+		}
+		if redact && !strings.Contains(logged, "Target config "+tr.destName()+" has been updated") {
+			t.Errorf("Expected the redacted dest in the log, got %s", logged)
+		}
+		if redact {
+			if s := tr.redact("restored tenant-acme.conf from " + dest); s != "restored tenant-acme.conf from "+tr.destName() {
+				t.Errorf("Expected only the dest path to be redacted, got %q", s)
+			}
+		}
+	}
+}
+
+func TestCheckInDryRun(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+check_cmd = "grep -qx valid {{.src}}"
+`, "invalid\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tests := []struct {
+		desc          string
+		checkInDryRun bool
+		tmpl          string
+		wantErr       bool
+	}{
+		{"failing check", true, "invalid\n", true},
+		{"passing check", true, "valid\n", false},
+		{"failing check not run", false, "invalid\n", false},
+	}
+	for _, tt := range tests {
+		if err := afero.WriteFile(fs, filepath.Join(confDir, "templates", "test.conf.tmpl"), []byte(tt.tmpl), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		tr, err := NewTemplateResource(fs, tr.resourcePath, Config{
+			CheckInDryRun: tt.checkInDryRun,
+			Noop:          true,
+			StoreClient:   tr.storeClient,
+			TemplateDir:   filepath.Join(confDir, "templates"),
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		tr.Dest = filepath.Join(confDir, "test.conf")
+		tr.ReloadCmd = "touch " + filepath.Join(confDir, "reloaded")
+		err = tr.process()
+		if tt.wantErr && (err == nil || !strings.Contains(err.Error(), "Config check failed")) {
+			t.Errorf("%s: expected a config check error, got %v", tt.desc, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: unexpected error %s", tt.desc, err.Error())
+		}
+		if util.IsFileExist(fs, tr.Dest) {
+			t.Errorf("%s: expected the dest not to be written", tt.desc)
+		}
+		if util.IsFileExist(fs, filepath.Join(confDir, "reloaded")) {
+			t.Errorf("%s: expected no reload", tt.desc)
+		}
+	}
+}
+
+func TestReloadLock(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+reload_lock = "app"
+`, "foo = bar\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Each reload records its start and end, taking long enough for
+	// concurrent reloads to overlap.
+	reloads := filepath.Join(confDir, "reloads")
+	var ts []*TemplateResource
+	for _, name := range []string{"a", "b", "c"} {
+		r, err := NewTemplateResource(fs, tr.resourcePath, Config{
+			StoreClient: tr.storeClient,
+			TemplateDir: filepath.Join(confDir, "templates"),
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		r.ReloadCmd = "echo start " + name + " >> " + reloads + "; sleep 0.1; echo end " + name + " >> " + reloads
+		ts = append(ts, r)
+	}
+	errs := make(chan error, len(ts))
+	for _, r := range ts {
+		go func(r *TemplateResource) { errs <- r.reload(context.Background()) }(r)
+	}
+	for range ts {
+		if err := <-errs; err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	b, err := afero.ReadFile(fs, reloads)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2*len(ts) {
+		t.Fatalf("Expected %d lines, got %q", 2*len(ts), lines)
+	}
+	for i := 0; i < len(lines); i += 2 {
+		if !strings.HasPrefix(lines[i], "start ") || lines[i+1] != "end"+strings.TrimPrefix(lines[i], "start") {
+			t.Errorf("Expected reloads sharing a lock not to overlap, got %q", lines)
+			break
+		}
+	}
+}
+
+func TestReloadLockContext(t *testing.T) {
+	unlock, err := lockReload(context.Background(), "held")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := lockReload(ctx, "held"); err != context.DeadlineExceeded {
+		t.Errorf("Expected the lock to wait for the context, got %v", err)
+	}
+	unlockOther, err := lockReload(context.Background(), "other")
+	if err != nil {
+		t.Errorf("Expected other locks to be free, got %v", err)
+	} else {
+		unlockOther()
+	}
+}
+
+func TestWriteOnce(t *testing.T) {
+	log.SetLevel("warn")
+	t.Setenv("CLUSTER_ID", "first")
+	fs := afero.NewOsFs()
+	tr, confDir, err := newTestResource(fs, `
+[template]
+src = "test.conf.tmpl"
+dest = "test.conf"
+fetch_all = true
+write_once = true
+`, "cluster_id = {{getenv \"CLUSTER_ID\"}}\n")
+	defer fs.RemoveAll(confDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reloads := filepath.Join(confDir, "reloads")
+	tr.CheckCmd = "echo >> " + reloads
+	tr.ReloadCmd = "echo >> " + reloads
+
+	steps := []struct {
+		desc      string
+		clusterID string
+		remove    bool
+		expected  string
+		reloads   string
+	}{
+		{"missing dest", "first", false, "cluster_id = first\n", "\n\n"},
+		{"existing dest", "second", false, "cluster_id = first\n", "\n\n"},
+		{"removed dest", "third", true, "cluster_id = third\n", "\n\n\n\n"},
+	}
+	for _, step := range steps {
+		t.Setenv("CLUSTER_ID", step.clusterID)
+		if step.remove {
+			if err := fs.Remove(tr.Dest); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		if err := tr.process(); err != nil {
+			t.Fatal(err.Error())
+		}
+		if b, err := afero.ReadFile(fs, tr.Dest); err != nil || string(b) != step.expected {
+			t.Errorf("%s: expected dest to be %q, got %q (%v)", step.desc, step.expected, b, err)
+		}
+		if b, _ := afero.ReadFile(fs, reloads); string(b) != step.reloads {
+			t.Errorf("%s: expected check and reload runs %q, got %q", step.desc, step.reloads, b)
+		}
+	}
+
+	t.Setenv("CLUSTER_ID", "fourth")
+	if drifted, err := tr.drifted(); err != nil || drifted {
+		t.Errorf("Expected an existing write-once dest not to drift, got %v (%v)", drifted, err)
+	}
+}
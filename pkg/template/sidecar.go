@@ -0,0 +1,79 @@
+package template
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// sidecarPath returns the path of the checksum sidecar of the dest, named
+// after the dest and the checksum algorithm.
+func (t *TemplateResource) sidecarPath() string {
+	return t.Dest + "." + t.ChecksumSidecar
+}
+
+// sidecarContents returns the checksum sidecar of the file name, in the
+// format of sha256sum and md5sum so that it can be verified with their -c
+// flag.
+// It returns an error if any.
+func (t *TemplateResource) sidecarContents(name string) (string, error) {
+	f, err := t.fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var h hash.Hash
+	if t.ChecksumSidecar == "md5" {
+		h = md5.New()
+	} else {
+		h = sha256.New()
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x  %s\n", h.Sum(nil), filepath.Base(t.Dest)), nil
+}
+
+// sidecarInSync reports whether the checksum sidecar, if enabled, matches
+// the staged file.
+func (t *TemplateResource) sidecarInSync(staged string) (bool, error) {
+	if t.ChecksumSidecar == "" {
+		return true, nil
+	}
+	expected, err := t.sidecarContents(staged)
+	if err != nil {
+		return false, err
+	}
+	current, err := afero.ReadFile(t.fs, t.sidecarPath())
+	if err != nil {
+		return false, nil
+	}
+	return string(current) == expected, nil
+}
+
+// stageSidecar writes the checksum sidecar of the staged file to a temp file
+// next to the dest, to be moved over the sidecar once the dest is replaced.
+// It returns the name of the temp file.
+func (t *TemplateResource) stageSidecar(staged string) (string, error) {
+	contents, err := t.sidecarContents(staged)
+	if err != nil {
+		return "", err
+	}
+	temp, err := afero.TempFile(t.fs, filepath.Dir(t.Dest), "."+filepath.Base(t.sidecarPath()))
+	if err != nil {
+		return "", err
+	}
+	defer temp.Close()
+	if _, err := temp.WriteString(contents); err != nil {
+		t.fs.Remove(temp.Name())
+		return "", err
+	}
+	t.fs.Chmod(temp.Name(), t.FileMode)
+	t.fs.Chown(temp.Name(), t.Uid, t.Gid)
+	return temp.Name(), nil
+}
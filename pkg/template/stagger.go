@@ -0,0 +1,57 @@
+package template
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// reloadStagger spreads out the reload commands of the template resources
+// sharing it, so that resources changing at once don't all reload at the
+// same time. Each reload starts a random delay of half to the whole jitter
+// after the previous one.
+type reloadStagger struct {
+	jitter time.Duration
+	mu     sync.Mutex
+	next   time.Time
+}
+
+// newReloadStagger returns a stagger for jitter, or nil, which doesn't
+// delay reloads, if jitter isn't positive.
+func newReloadStagger(jitter time.Duration) *reloadStagger {
+	if jitter <= 0 {
+		return nil
+	}
+	return &reloadStagger{jitter: jitter}
+}
+
+// wait reserves the next reload slot and blocks until it starts or ctx is
+// done.
+// It returns an error if ctx is done first.
+func (s *reloadStagger) wait(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	start := time.Now()
+	if s.next.After(start) {
+		start = s.next
+	}
+	half := s.jitter / 2
+	s.next = start.Add(half + time.Duration(rand.Int63n(int64(s.jitter-half)+1)))
+	s.mu.Unlock()
+
+	delay := time.Until(start)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -1,20 +1,36 @@
 package template
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"html"
+	"io"
+	"math/big"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/abtreece/confd/pkg/backends"
+	"github.com/abtreece/confd/pkg/backends/consul"
 	util "github.com/abtreece/confd/pkg/util"
 	"github.com/kelseyhightower/memkv"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func newFuncMap() map[string]interface{} {
@@ -24,13 +40,28 @@ func newFuncMap() map[string]interface{} {
 	m["json"] = UnmarshalJsonObject
 	m["jsonArray"] = UnmarshalJsonArray
 	m["dir"] = path.Dir
+	m["keyJoin"] = KeyJoin
+	m["dig"] = Dig
+	m["relPath"] = filepath.Rel
 	m["map"] = CreateMap
 	m["getenv"] = Getenv
+	m["expandEnv"] = os.ExpandEnv
+	m["coalesce"] = Coalesce
 	m["join"] = strings.Join
+	m["uniq"] = Uniq
+	m["setDiff"] = SetDiff
+	m["setIntersect"] = SetIntersect
+	m["envLine"] = EnvLine
+	m["oneOf"] = OneOf
 	m["datetime"] = time.Now
+	m["parseDuration"] = time.ParseDuration
+	m["toSeconds"] = ToSeconds
+	m["toMillis"] = ToMillis
 	m["toUpper"] = strings.ToUpper
 	m["toLower"] = strings.ToLower
 	m["contains"] = strings.Contains
+	m["hasPrefix"] = strings.HasPrefix
+	m["hasSuffix"] = strings.HasSuffix
 	m["replace"] = strings.Replace
 	m["trimSuffix"] = strings.TrimSuffix
 	m["lookupIP"] = LookupIP
@@ -40,23 +71,274 @@ func newFuncMap() map[string]interface{} {
 	m["lookupIfaceIPV4"] = LookupIfaceIPV4
 	m["lookupIfaceIPV6"] = LookupIfaceIPV6
 	m["fileExists"] = util.IsFileExist
+	m["shellQuote"] = ShellQuote
+	m["htmlEscape"] = html.EscapeString
 	m["base64Encode"] = Base64Encode
 	m["base64Decode"] = Base64Decode
-	m["parseBool"] = strconv.ParseBool
+	m["gunzip"] = Gunzip
+	m["gunzipB64"] = GunzipB64
+	m["derivedRandom"] = DerivedRandom
+	m["certExpiry"] = CertExpiry
+	m["certCN"] = CertCN
+	m["parseBool"] = ParseBool
+	m["parseInt"] = ParseInt
+	m["parseFloat"] = ParseFloat
 	m["reverse"] = Reverse
 	m["sortByLength"] = SortByLength
 	m["sortKVByLength"] = SortKVByLength
+	m["sortByField"] = SortByField
 	m["add"] = func(a, b int) int { return a + b }
 	m["sub"] = func(a, b int) int { return a - b }
 	m["div"] = func(a, b int) int { return a / b }
 	m["mod"] = func(a, b int) int { return a % b }
 	m["mul"] = func(a, b int) int { return a * b }
 	m["seq"] = Seq
+	m["percent"] = Percent
+	m["ratio"] = Ratio
+	m["first"] = First
+	m["last"] = Last
+	m["slice"] = Slice
 	m["atoi"] = strconv.Atoi
+	m["byteLen"] = func(s string) int { return len(s) }
+	m["runeLen"] = utf8.RuneCountInString
 	m["hostname"] = GetHostname
 	return m
 }
 
+// sprigAliases maps the names of sprig functions to the confd functions
+// taking the same arguments.
+var sprigAliases = map[string]string{
+	"upper":     "toUpper",
+	"lower":     "toLower",
+	"b64enc":    "base64Encode",
+	"b64dec":    "base64Decode",
+	"env":       "getenv",
+	"expandenv": "expandEnv",
+	"now":       "datetime",
+}
+
+// newSprigFuncMap returns the sprig names of the functions of m, for
+// templates written for Helm. Sprig functions whose arguments are in
+// another order than their confd equivalent, such as contains or replace,
+// are left out.
+func newSprigFuncMap(m map[string]interface{}) map[string]interface{} {
+	aliases := make(map[string]interface{})
+	for alias, name := range sprigAliases {
+		aliases[alias] = m[name]
+	}
+	aliases["trim"] = strings.TrimSpace
+	return aliases
+}
+
+// newStoreFuncMap returns the template functions reading from the store,
+// complementing the ones provided by memkv. values returns the values last
+// written into s, which the functions listing keys read from since memkv
+// can't list all of its keys.
+func newStoreFuncMap(s *memkv.Store, values func() map[string]string) map[string]interface{} {
+	m := make(map[string]interface{})
+	m["getBinaryFile"] = func(key string) (string, error) {
+		v, err := s.GetValue(key)
+		if err != nil {
+			return "", err
+		}
+		return Base64Decode(v)
+	}
+	m["lenKeys"] = func(prefix string) int {
+		return len(keysUnder(values(), path.Clean("/"+prefix)))
+	}
+	m["keysUnder"] = func(prefix string) []string {
+		return childNames(values(), path.Clean("/"+prefix))
+	}
+	m["groupKeys"] = func(prefix string, depth int) (map[string]map[string]string, error) {
+		return groupKeys(values(), path.Clean("/"+prefix), depth)
+	}
+	m["getDoc"] = func(key string) (interface{}, error) {
+		v, err := s.GetValue(key)
+		if err != nil {
+			return nil, err
+		}
+		return ParseDoc(v)
+	}
+	m["dumpStore"] = func() (string, error) {
+		return dumpStore(values())
+	}
+	m["envFile"] = func(prefix string) string {
+		return envFile(values(), path.Clean("/"+prefix))
+	}
+	m["switchv"] = func(key string) string {
+		v, _ := s.GetValue(key)
+		return v
+	}
+	m["whenEq"] = func(key, value string) bool {
+		v, err := s.GetValue(key)
+		return err == nil && v == value
+	}
+	m["getvi"] = func(key string, v ...string) (string, error) {
+		return getvi(s, path.Clean("/"+key), v...)
+	}
+	m["envOrGetv"] = func(name, key string) (string, error) {
+		if v := os.Getenv(name); v != "" {
+			return v, nil
+		}
+		if v, err := s.GetValue(key); err == nil {
+			return v, nil
+		}
+		return "", fmt.Errorf("Neither environment variable %s nor key %s is set", name, key)
+	}
+	m["getvOrEnv"] = func(key, name string) (string, error) {
+		if v, err := s.GetValue(key); err == nil {
+			return v, nil
+		}
+		if v := os.Getenv(name); v != "" {
+			return v, nil
+		}
+		return "", fmt.Errorf("Neither key %s nor environment variable %s is set", key, name)
+	}
+	m["storeEmptyUnder"] = func(prefix string) bool {
+		return storeEmptyUnder(values(), path.Clean("/"+prefix))
+	}
+	m["storeEmpty"] = func() bool {
+		return storeEmptyUnder(values(), "/")
+	}
+	return m
+}
+
+// keysUnder returns the keys of values under dir, sorted.
+func keysUnder(values map[string]string, dir string) memkv.KVPairs {
+	under := strings.TrimSuffix(dir, "/") + "/"
+	kvs := make(memkv.KVPairs, 0)
+	for k, v := range values {
+		if strings.HasPrefix(k, under) {
+			kvs = append(kvs, memkv.KVPair{Key: k, Value: v})
+		}
+	}
+	sort.Sort(kvs)
+	return kvs
+}
+
+// getvi returns the value of the key of s equal to key ignoring case, or the
+// optional default if there is none. An exact match is preferred, then the
+// first of the matching keys in sorted order.
+func getvi(s *memkv.Store, key string, v ...string) (string, error) {
+	if kv, err := s.Get(key); err == nil {
+		return kv.Value, nil
+	}
+	// Only the keys as deep as key can match it.
+	kvs, err := s.GetAll(strings.Repeat("/*", strings.Count(key, "/")))
+	if err != nil {
+		return "", err
+	}
+	sort.Sort(kvs)
+	for _, kv := range kvs {
+		if strings.EqualFold(kv.Key, key) {
+			return kv.Value, nil
+		}
+	}
+	if len(v) > 0 {
+		return v[0], nil
+	}
+	return "", &memkv.KeyError{Key: key, Err: memkv.ErrNotExist}
+}
+
+// storeEmptyUnder reports whether values holds no key equal to or under
+// dir.
+func storeEmptyUnder(values map[string]string, dir string) bool {
+	if _, ok := values[dir]; ok {
+		return false
+	}
+	return len(keysUnder(values, dir)) == 0
+}
+
+// dumpStore returns every key of values with its value as a JSON object,
+// indented and sorted by key, for debugging templates.
+func dumpStore(values map[string]string) (string, error) {
+	if values == nil {
+		values = map[string]string{}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(values); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// envFile returns the keys of values under dir as .env file lines, one per
+// key in sorted order, named after the key relative to dir.
+func envFile(values map[string]string, dir string) string {
+	var b strings.Builder
+	for _, kv := range keysUnder(values, dir) {
+		b.WriteString(EnvLine(strings.TrimPrefix(kv.Key, dir), kv.Value))
+	}
+	return b.String()
+}
+
+// childNames returns the sorted names of the path segments right under dir
+// of the keys of values under it, such as a and b for /dir/a/x, /dir/a/y
+// and /dir/b.
+func childNames(values map[string]string, dir string) []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, kv := range keysUnder(values, dir) {
+		rel := strings.TrimPrefix(strings.TrimPrefix(kv.Key, dir), "/")
+		name, _, _ := strings.Cut(rel, "/")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// groupKeys groups the keys of values under dir by their first depth path
+// segments below it, such as web-1 for /servers/web-1/ip with depth 1. Each
+// group maps the rest of the keys, ip here, to their values. Keys no deeper
+// than depth are left out.
+func groupKeys(values map[string]string, dir string, depth int) (map[string]map[string]string, error) {
+	if depth < 1 {
+		return nil, fmt.Errorf("groupKeys: depth %d is not positive", depth)
+	}
+	groups := make(map[string]map[string]string)
+	for _, kv := range keysUnder(values, dir) {
+		parts := strings.Split(strings.TrimPrefix(strings.TrimPrefix(kv.Key, dir), "/"), "/")
+		if len(parts) <= depth {
+			continue
+		}
+		name := strings.Join(parts[:depth], "/")
+		if groups[name] == nil {
+			groups[name] = make(map[string]string)
+		}
+		groups[name][strings.Join(parts[depth:], "/")] = kv.Value
+	}
+	return groups, nil
+}
+
+// serviceDiscoverer is implemented by store clients able to look up the
+// healthy instances of a service, such as the Consul backend.
+type serviceDiscoverer interface {
+	Service(name string) ([]consul.Service, error)
+}
+
+// newServiceFuncMap returns the service discovery template functions, which
+// query client directly rather than the store.
+func newServiceFuncMap(client backends.StoreClient) map[string]interface{} {
+	if c, ok := client.(*cachingStoreClient); ok {
+		client = c.StoreClient
+	}
+	m := make(map[string]interface{})
+	m["service"] = func(name string) ([]consul.Service, error) {
+		d, ok := client.(serviceDiscoverer)
+		if !ok {
+			return nil, errors.New("service is not supported by the backend")
+		}
+		return d.Service(name)
+	}
+	return m
+}
+
 func addFuncs(out, in map[string]interface{}) {
 	for name, fn := range in {
 		out[name] = fn
@@ -109,6 +391,260 @@ func SortByLength(values []string) []string {
 	return values
 }
 
+// First returns the first n elements of the list, any slice, array or
+// string, or all of them if it has fewer.
+func First(n int, list interface{}) (interface{}, error) {
+	return sliceList(list, 0, n)
+}
+
+// Last returns the last n elements of the list, any slice, array or
+// string, or all of them if it has fewer.
+func Last(n int, list interface{}) (interface{}, error) {
+	l, err := listLen(list)
+	if err != nil {
+		return nil, err
+	}
+	return sliceList(list, l-n, l)
+}
+
+// Slice returns the elements of list from start up to, excluding, end:
+// slice start end list. Indices are clamped to the bounds of the list.
+// Like the text/template builtin it replaces, it also accepts the list
+// first, followed by up to three indices, which then behaves exactly as the
+// builtin does: slice list [low [high [max]]].
+func Slice(args ...interface{}) (interface{}, error) {
+	if len(args) == 3 {
+		start, startOk := args[0].(int)
+		end, endOk := args[1].(int)
+		if startOk && endOk {
+			return sliceList(args[2], start, end)
+		}
+	}
+	if len(args) < 1 {
+		return nil, errors.New("slice: missing list")
+	}
+	return builtinSlice(args[0], args[1:]...)
+}
+
+// builtinSlice is the text/template builtin slice: item[low:high:max] for
+// any slice, array or string item, failing on indices out of range.
+func builtinSlice(item interface{}, indexes ...interface{}) (interface{}, error) {
+	v, err := listValue(item)
+	if err != nil {
+		return nil, err
+	}
+	if len(indexes) > 3 {
+		return nil, fmt.Errorf("too many slice indexes: %d", len(indexes))
+	}
+	if v.Kind() == reflect.String && len(indexes) == 3 {
+		return nil, errors.New("cannot 3-index slice a string")
+	}
+	c := v.Len()
+	if v.Kind() != reflect.String {
+		c = v.Cap()
+	}
+	idx := [3]int{0, v.Len()}
+	for i, index := range indexes {
+		x := reflect.ValueOf(index)
+		var n int64
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = x.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			n = int64(x.Uint())
+		case reflect.Invalid:
+			return nil, errors.New("cannot index slice/array with nil")
+		default:
+			return nil, fmt.Errorf("cannot index slice/array with type %s", x.Type())
+		}
+		if n < 0 || n > int64(c) {
+			return nil, fmt.Errorf("index out of range: %d", n)
+		}
+		idx[i] = int(n)
+	}
+	if idx[0] > idx[1] {
+		return nil, fmt.Errorf("invalid slice index: %d > %d", idx[0], idx[1])
+	}
+	if len(indexes) < 3 {
+		return v.Slice(idx[0], idx[1]).Interface(), nil
+	}
+	if idx[1] > idx[2] {
+		return nil, fmt.Errorf("invalid slice index: %d > %d", idx[1], idx[2])
+	}
+	return v.Slice3(idx[0], idx[1], idx[2]).Interface(), nil
+}
+
+// listValue returns list, any slice, array or string, or a pointer to one,
+// as a reflect.Value which can be sliced.
+func listValue(list interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(list)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, fmt.Errorf("expected a list, got nil %s", v.Type())
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.String:
+		return v, nil
+	case reflect.Array:
+		if !v.CanAddr() {
+			a := reflect.New(v.Type()).Elem()
+			a.Set(v)
+			v = a
+		}
+		return v, nil
+	}
+	return reflect.Value{}, fmt.Errorf("expected a list, got %T", list)
+}
+
+// listLen returns the length of list, any slice, array or string.
+func listLen(list interface{}) (int, error) {
+	v, err := listValue(list)
+	if err != nil {
+		return 0, err
+	}
+	return v.Len(), nil
+}
+
+// sliceList returns list[start:end], with start and end clamped to the
+// bounds of list.
+func sliceList(list interface{}, start, end int) (interface{}, error) {
+	v, err := listValue(list)
+	if err != nil {
+		return nil, err
+	}
+	end = max(0, min(end, v.Len()))
+	start = max(0, min(start, end))
+	return v.Slice(start, end).Interface(), nil
+}
+
+// Uniq returns the values sorted with duplicates removed.
+func Uniq(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// SetDiff returns the values of a which are not in b, sorted with
+// duplicates removed.
+func SetDiff(a, b []string) []string {
+	return Uniq(filterIn(a, b, false))
+}
+
+// SetIntersect returns the values of a which are also in b, sorted with
+// duplicates removed.
+func SetIntersect(a, b []string) []string {
+	return Uniq(filterIn(a, b, true))
+}
+
+// filterIn returns the values of a whose presence in b is in.
+func filterIn(a, b []string, in bool) []string {
+	set := make(map[string]bool, len(b))
+	for _, v := range b {
+		set[v] = true
+	}
+	var result []string
+	for _, v := range a {
+		if set[v] == in {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// EnvLine returns a NAME=value line of a .env file, ending with a newline.
+// The name is uppercased, with the characters other than letters, digits
+// and underscores replaced by underscores, so that /db/host becomes
+// DB_HOST. Values which would not read back as is unquoted are double
+// quoted, with backslashes, double quotes, dollar signs, backticks,
+// newlines and tabs escaped, so that a shell sourcing the file neither
+// expands variables nor runs commands from the value.
+func EnvLine(name, value string) string {
+	return envName(name) + "=" + envValue(value) + "\n"
+}
+
+// envName returns name as an environment variable name.
+func envName(name string) string {
+	name = strings.ToUpper(strings.Trim(name, "/"))
+	b := []byte(name)
+	for i, c := range b {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// envValue returns value quoted for a .env file if it needs to be.
+func envValue(value string) string {
+	if !strings.ContainsAny(value, " \t\n\r\"'#\\$`=") {
+		return value
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`",
+		"\n", `\n`, "\t", `\t`)
+	return `"` + r.Replace(value) + `"`
+}
+
+// SortByField sorts a list of maps, []map[string]interface{} or an
+// []interface{} of maps as returned by jsonArray, by the value of the named
+// field. Values which all parse as numbers are compared numerically, others
+// as strings. Maps missing the field sort first. The sort is stable.
+func SortByField(values interface{}, field string) (interface{}, error) {
+	var maps []map[string]interface{}
+	switch v := values.(type) {
+	case []map[string]interface{}:
+		maps = v
+	case []interface{}:
+		maps = make([]map[string]interface{}, len(v))
+		for i, e := range v {
+			m, ok := e.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("sortByField: element %d is not a map", i)
+			}
+			maps[i] = m
+		}
+	default:
+		return nil, fmt.Errorf("sortByField: unsupported type %T", values)
+	}
+
+	sorted := make([]map[string]interface{}, len(maps))
+	copy(sorted, maps)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		av, aok := sorted[i][field]
+		bv, bok := sorted[j][field]
+		if !aok || !bok {
+			return !aok && bok
+		}
+		a, b := fmt.Sprint(av), fmt.Sprint(bv)
+		af, aerr := strconv.ParseFloat(a, 64)
+		bf, berr := strconv.ParseFloat(b, 64)
+		if aerr == nil && berr == nil {
+			return af < bf
+		}
+		return a < b
+	})
+
+	if _, ok := values.([]interface{}); ok {
+		result := make([]interface{}, len(sorted))
+		for i, m := range sorted {
+			result[i] = m
+		}
+		return result, nil
+	}
+	return sorted, nil
+}
+
 //Reverse returns the array in reversed order
 //works with []string and []KVPair
 func Reverse(values interface{}) interface{} {
@@ -143,11 +679,119 @@ func Getenv(key string, v ...string) string {
 	return value
 }
 
+// KeyJoin joins the parts into an absolute key, with single slashes between
+// them, however many slashes the parts start or end with. Empty parts are
+// ignored.
+func KeyJoin(parts ...string) string {
+	return path.Join(append([]string{"/"}, parts...)...)
+}
+
+// ParseDoc parses a JSON or YAML document, JSON being a subset of YAML.
+// Its maps are returned as map[string]interface{}, as from json, so that
+// they can be traversed with dig or index and passed to other functions.
+func ParseDoc(data string) (interface{}, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal([]byte(data), &doc); err != nil {
+		return nil, err
+	}
+	return stringKeys(doc), nil
+}
+
+// stringKeys converts the map[interface{}]interface{} maps decoded by yaml,
+// including nested ones, to map[string]interface{}.
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = stringKeys(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = stringKeys(e)
+		}
+	}
+	return v
+}
+
+// Dig returns the value found by following the keys, given first, through
+// the maps and arrays of the document, given last as with a pipeline.
+// Array elements are selected by index. It returns nil if the path doesn't
+// exist.
+func Dig(args ...interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("dig requires a document")
+	}
+	v := args[len(args)-1]
+	for _, arg := range args[:len(args)-1] {
+		key, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("dig keys must be strings, got %T", arg)
+		}
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, nil
+			}
+			v = node[i]
+		default:
+			return nil, nil
+		}
+	}
+	return v, nil
+}
+
+// OneOf returns value if it is one of the allowed values, and an error
+// listing them otherwise, to catch invalid settings before writing them.
+func OneOf(value string, allowed ...string) (string, error) {
+	for _, a := range allowed {
+		if value == a {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("%q is not one of %s", value, strings.Join(allowed, ", "))
+}
+
+// Coalesce returns the first of its arguments which is not an empty string.
+// It returns "" if all of them are empty.
+func Coalesce(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
 func GetHostname() (string, error) {
 	value, error := os.Hostname()
 	return value, error
 }
 
+// ToSeconds parses the duration string and returns it as a whole number of
+// seconds, truncating any fraction.
+func ToSeconds(duration string) (int64, error) {
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, err
+	}
+	return int64(d / time.Second), nil
+}
+
+// ToMillis parses the duration string and returns it as a whole number of
+// milliseconds, truncating any fraction.
+func ToMillis(duration string) (int64, error) {
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, err
+	}
+	return d.Milliseconds(), nil
+}
+
 // CreateMap creates a key-value map of string -> interface{}
 // The i'th is the key and the i+1 is the value
 func CreateMap(values ...interface{}) (map[string]interface{}, error) {
@@ -283,6 +927,36 @@ func LookupSRV(service, proto, name string) []*net.SRV {
 	return addrs
 }
 
+// ShellQuote quotes the value for safe use as a single POSIX shell word.
+// The value is wrapped in single quotes, embedded single quotes are closed,
+// escaped and reopened.
+func ShellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// maxDerivedRandomLength bounds the length of DerivedRandom values.
+const maxDerivedRandomLength = 1024
+
+// DerivedRandom returns length hex digits derived from seed. They look
+// random but are the same on every render for a seed, so that generated
+// defaults such as instance IDs don't change, and differ between seeds.
+// They are not secret, anyone knowing the seed can derive them.
+func DerivedRandom(seed string, length int) (string, error) {
+	if length < 0 || length > maxDerivedRandomLength {
+		return "", fmt.Errorf("derivedRandom: length %d is not between 0 and %d", length, maxDerivedRandomLength)
+	}
+	var out strings.Builder
+	counter := make([]byte, 8)
+	for i := uint64(0); out.Len() < length; i++ {
+		binary.BigEndian.PutUint64(counter, i)
+		h := sha256.New()
+		h.Write(counter)
+		h.Write([]byte(seed))
+		out.WriteString(hex.EncodeToString(h.Sum(nil)))
+	}
+	return out.String()[:length], nil
+}
+
 func Base64Encode(data string) string {
 	return base64.StdEncoding.EncodeToString([]byte(data))
 }
@@ -291,3 +965,119 @@ func Base64Decode(data string) (string, error) {
 	s, err := base64.StdEncoding.DecodeString(data)
 	return string(s), err
 }
+
+// Gunzip returns the decompressed contents of the gzip data, such as a
+// value read with getBinaryFile.
+func Gunzip(data string) (string, error) {
+	r, err := gzip.NewReader(strings.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	return string(b), err
+}
+
+// GunzipB64 returns the decompressed contents of the base64 encoded gzip
+// data.
+func GunzipB64(data string) (string, error) {
+	s, err := Base64Decode(data)
+	if err != nil {
+		return "", err
+	}
+	return Gunzip(s)
+}
+
+// parseCert parses the first certificate of the PEM data.
+func parseCert(name, data string) (*x509.Certificate, error) {
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM encoded certificate found", name)
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+		return cert, nil
+	}
+}
+
+// CertExpiry returns the time the PEM encoded certificate expires at, its
+// notAfter, in RFC3339 format and UTC. For a chain, the first certificate
+// is used.
+func CertExpiry(data string) (string, error) {
+	cert, err := parseCert("certExpiry", data)
+	if err != nil {
+		return "", err
+	}
+	return cert.NotAfter.UTC().Format(time.RFC3339), nil
+}
+
+// CertCN returns the subject common name of the PEM encoded certificate.
+// For a chain, the first certificate is used.
+func CertCN(data string) (string, error) {
+	cert, err := parseCert("certCN", data)
+	if err != nil {
+		return "", err
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// ParseInt converts the decimal integer s, ignoring surrounding spaces.
+func ParseInt(s string) (int, error) {
+	i, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("parseInt: %q is not an integer", s)
+	}
+	return i, nil
+}
+
+// Percent returns pct percent of n, truncated to an int, such as
+// Percent(2048, 80) for 80% of 2048 MiB.
+func Percent(n, pct int) (int, error) {
+	if pct < 0 {
+		return 0, fmt.Errorf("percent: %d%% is negative", pct)
+	}
+	p := new(big.Int).Mul(big.NewInt(int64(n)), big.NewInt(int64(pct)))
+	p.Quo(p, big.NewInt(100))
+	if !p.IsInt64() || p.Int64() != int64(int(p.Int64())) {
+		return 0, fmt.Errorf("percent: %d%% of %d overflows", pct, n)
+	}
+	return int(p.Int64()), nil
+}
+
+// Ratio returns a divided by b.
+func Ratio(a, b int) (float64, error) {
+	if b == 0 {
+		return 0, fmt.Errorf("ratio: %d divided by zero", a)
+	}
+	return float64(a) / float64(b), nil
+}
+
+// ParseFloat converts the floating point number s, ignoring surrounding
+// spaces.
+func ParseFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, fmt.Errorf("parseFloat: %q is not a number", s)
+	}
+	return f, nil
+}
+
+// ParseBool converts s, ignoring case and surrounding spaces. 1, t, true, y,
+// yes and on are true; 0, f, false, n, no and off are false.
+func ParseBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "t", "true", "y", "yes", "on":
+		return true, nil
+	case "0", "f", "false", "n", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("parseBool: %q is not a boolean", s)
+}
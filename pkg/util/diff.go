@@ -0,0 +1,190 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Number of unchanged lines shown around the changes of a unified diff.
+const diffContext = 3
+
+// diffOp is a line of an edit script: kept (' '), removed ('-') or added
+// ('+'). a and b are the line numbers, from 0, before the line in each input.
+type diffOp struct {
+	kind byte
+	a, b int
+}
+
+// UnifiedDiff returns the unified diff turning from into to, with fromName
+// and toName labelling the --- and +++ lines.
+// It returns an empty string if from and to are equal.
+func UnifiedDiff(fromName, toName string, from, to []byte) string {
+	a := splitLines(string(from))
+	b := splitLines(string(to))
+	ops := diffLines(a, b)
+
+	var out strings.Builder
+	for start := 0; start < len(ops); {
+		// Find the next change, and the end of the changes separated by at
+		// most twice the context of unchanged lines, whose contexts then
+		// touch or overlap, from the previous one.
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		last := first
+		for i := first + 1; i < len(ops) && i-last-1 <= 2*diffContext; i++ {
+			if ops[i].kind != ' ' {
+				last = i
+			}
+		}
+		lo := max(first-diffContext, start)
+		hi := min(last+diffContext+1, len(ops))
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		aCount, bCount := 0, 0
+		for _, op := range ops[lo:hi] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(ops[lo].a, aCount), hunkRange(ops[lo].b, bCount))
+		for _, op := range ops[lo:hi] {
+			line := ""
+			switch op.kind {
+			case '-':
+				line = a[op.a]
+			default:
+				line = b[op.b]
+			}
+			out.WriteByte(op.kind)
+			out.WriteString(line)
+			if !strings.HasSuffix(line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = hi
+	}
+	return out.String()
+}
+
+// hunkRange formats the range of a hunk header. An empty range refers to
+// the line before it.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// splitLines splits s after each newline.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// maxDiffEdits bounds the edit scripts searched by diffLines, whose time
+// grows with the number of lines times the number of edits, and memory
+// with the square of the number of edits.
+const maxDiffEdits = 1000
+
+// diffLines returns the shortest edit script turning a into b, using the
+// Myers algorithm, or when it would take more than maxDiffEdits edits, the
+// script removing every line of a and adding every line of b.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	offset := n + m
+	v := make([]int, 2*offset+2)
+	// trace holds, for each d, the diagonals -d to d of v before the step,
+	// the only ones the step reads.
+	var trace [][]int
+
+search:
+	for d := 0; d <= offset; d++ {
+		if d > maxDiffEdits {
+			return replaceLines(n, m)
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk the trace back from the end to recover the edits.
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = v[d+prevK]
+		}
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{' ', x, y})
+		}
+		if d > 0 {
+			if x == prevX {
+				y--
+				ops = append(ops, diffOp{'+', x, y})
+			} else {
+				x--
+				ops = append(ops, diffOp{'-', x, y})
+			}
+		}
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// replaceLines returns the edit script removing the n lines of a and
+// adding the m lines of b.
+func replaceLines(n, m int) []diffOp {
+	ops := make([]diffOp, 0, n+m)
+	for x := 0; x < n; x++ {
+		ops = append(ops, diffOp{'-', x, 0})
+	}
+	for y := 0; y < m; y++ {
+		ops = append(ops, diffOp{'+', n, y})
+	}
+	return ops
+}
@@ -0,0 +1,160 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		desc     string
+		from, to string
+		expected string
+	}{
+		{
+			desc:     "equal",
+			from:     "a\nb\n",
+			to:       "a\nb\n",
+			expected: "",
+		},
+		{
+			desc: "change",
+			from: "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			to:   "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			expected: `--- a
++++ b
+@@ -2,7 +2,7 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+`,
+		},
+		{
+			desc: "separate hunks",
+			from: "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			to:   "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			expected: `--- a
++++ b
+@@ -1,4 +1,4 @@
+-1
++one
+ 2
+ 3
+ 4
+@@ -9,4 +9,4 @@
+ 9
+ 10
+ 11
+-12
++twelve
+`,
+		},
+		{
+			desc: "hunks separated by twice the context",
+			from: "X\n1\n2\n3\n4\n5\n6\nY\n",
+			to:   "x\n1\n2\n3\n4\n5\n6\ny\n",
+			expected: `--- a
++++ b
+@@ -1,8 +1,8 @@
+-X
++x
+ 1
+ 2
+ 3
+ 4
+ 5
+ 6
+-Y
++y
+`,
+		},
+		{
+			desc: "hunks separated by one more than twice the context",
+			from: "X\n1\n2\n3\n4\n5\n6\n7\nY\n",
+			to:   "x\n1\n2\n3\n4\n5\n6\n7\ny\n",
+			expected: `--- a
++++ b
+@@ -1,4 +1,4 @@
+-X
++x
+ 1
+ 2
+ 3
+@@ -6,4 +6,4 @@
+ 5
+ 6
+ 7
+-Y
++y
+`,
+		},
+		{
+			desc: "new file",
+			from: "",
+			to:   "a\nb\n",
+			expected: `--- a
++++ b
+@@ -0,0 +1,2 @@
++a
++b
+`,
+		},
+		{
+			desc: "no newline at end of file",
+			from: "a\nb",
+			to:   "a\nb\n",
+			expected: `--- a
++++ b
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++b
+`,
+		},
+	}
+	for _, tt := range tests {
+		actual := UnifiedDiff("a", "b", []byte(tt.from), []byte(tt.to))
+		if actual != tt.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tt.desc, tt.expected, actual)
+		}
+	}
+}
+
+func TestUnifiedDiffManyEdits(t *testing.T) {
+	var from, to, expected strings.Builder
+	// Every other line changes, which would take more than maxDiffEdits
+	// edits, so the whole file is replaced.
+	n := maxDiffEdits + 2
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&from, "l%d\n", i)
+		if i%2 == 0 {
+			fmt.Fprintf(&to, "l%d\n", i)
+		} else {
+			fmt.Fprintf(&to, "x%d\n", i)
+		}
+	}
+	fmt.Fprintf(&expected, "--- a\n+++ b\n@@ -1,%d +1,%d @@\n", n, n)
+	for _, line := range splitLines(from.String()) {
+		expected.WriteString("-" + line)
+	}
+	for _, line := range splitLines(to.String()) {
+		expected.WriteString("+" + line)
+	}
+	if actual := UnifiedDiff("a", "b", []byte(from.String()), []byte(to.String())); actual != expected.String() {
+		t.Errorf("Expected the whole file to be replaced, got\n%s", actual)
+	}
+
+	// A large file with few changes is still diffed line by line.
+	changed := strings.Replace(from.String(), "l500\n", "x\n", 1)
+	actual := UnifiedDiff("a", "b", []byte(from.String()), []byte(changed))
+	if !strings.HasPrefix(actual, "--- a\n+++ b\n@@ -498,7 +498,7 @@\n") || strings.Count(actual, "\n") != 11 {
+		t.Errorf("Expected a single hunk, got\n%s", actual)
+	}
+}
@@ -4,10 +4,7 @@
 package util
 
 import (
-	"crypto/md5"
 	"errors"
-	"fmt"
-	"io"
 	"syscall"
 
 	"github.com/spf13/afero"
@@ -15,19 +12,25 @@ import (
 
 // filestat return a FileInfo describing the named file.
 func FileStat(fs afero.Fs, name string) (fi FileInfo, err error) {
+	if fi, err = fileMeta(fs, name); err != nil {
+		return fi, err
+	}
+	fi.Md5, err = hashFile(fs, name)
+	return fi, err
+}
+
+// fileMeta is like FileStat, but leaves Md5 empty rather than reading the
+// whole file.
+func fileMeta(fs afero.Fs, name string) (fi FileInfo, err error) {
 	if IsFileExist(fs, name) {
-		f, err := fs.Open(name)
+		stats, err := fs.Stat(name)
 		if err != nil {
 			return fi, err
 		}
-		defer f.Close()
-		stats, _ := f.Stat()
 		fi.Uid = stats.Sys().(*syscall.Stat_t).Uid
 		fi.Gid = stats.Sys().(*syscall.Stat_t).Gid
 		fi.Mode = stats.Mode()
-		h := md5.New()
-		io.Copy(h, f)
-		fi.Md5 = fmt.Sprintf("%x", h.Sum(nil))
+		fi.Size = stats.Size()
 		return fi, nil
 	}
 	return fi, errors.New("File not found")
@@ -1,26 +1,30 @@
 package util
 
 import (
-	"crypto/md5"
 	"errors"
-	"fmt"
-	"io"
-	"os"
+
+	"github.com/spf13/afero"
 )
 
 // filestat return a FileInfo describing the named file.
-func FileStat(name string) (fi FileInfo, err error) {
-	if IsFileExist(name) {
-		f, err := os.Open(name)
+func FileStat(fs afero.Fs, name string) (fi FileInfo, err error) {
+	if fi, err = fileMeta(fs, name); err != nil {
+		return fi, err
+	}
+	fi.Md5, err = hashFile(fs, name)
+	return fi, err
+}
+
+// fileMeta is like FileStat, but leaves Md5 empty rather than reading the
+// whole file. Windows has no uid and gid, which are left zero.
+func fileMeta(fs afero.Fs, name string) (fi FileInfo, err error) {
+	if IsFileExist(fs, name) {
+		stats, err := fs.Stat(name)
 		if err != nil {
 			return fi, err
 		}
-		defer f.Close()
-		stats, _ := f.Stat()
 		fi.Mode = stats.Mode()
-		h := md5.New()
-		io.Copy(h, f)
-		fi.Md5 = fmt.Sprintf("%x", h.Sum(nil))
+		fi.Size = stats.Size()
 		return fi, nil
 	}
 	return fi, errors.New("File not found")
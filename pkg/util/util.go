@@ -1,10 +1,13 @@
 package util
 
 import (
+	"crypto/md5"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 
 	"github.com/abtreece/confd/pkg/log"
 	"github.com/spf13/afero"
@@ -30,6 +33,7 @@ type FileInfo struct {
 	Gid  uint32
 	Mode os.FileMode
 	Md5  string
+	Size int64
 }
 
 func AppendPrefix(prefix string, keys []string) []string {
@@ -54,40 +58,111 @@ func IsFileExist(fs afero.Fs, fpath string) bool {
 	return true
 }
 
+// ConfigCompare tunes how IsConfigChanged compares two config files.
+type ConfigCompare struct {
+	// Mode, if set, is the mode dest is expected to have rather than the
+	// mode of src, for src files staged with restricted permissions.
+	Mode *os.FileMode
+	// Equal, if set, reports whether contents differing byte for byte are
+	// still the same config, such as two JSON documents differing only by
+	// key order.
+	Equal func(a, b []byte) bool
+	// Name refers to dest in the logs, for dests whose path mustn't be
+	// logged. Defaults to dest.
+	Name string
+}
+
 // IsConfigChanged reports whether src and dest config files are equal.
 // Two config files are equal when they have the same file contents and
 // Unix permissions. The owner, group, and mode must match.
 // It return false in other cases.
-func IsConfigChanged(fs afero.Fs, src, dest string) (bool, error) {
+func IsConfigChanged(fs afero.Fs, src, dest string, opts ConfigCompare) (bool, error) {
+	name := opts.Name
+	if name == "" {
+		name = dest
+	}
 	if !IsFileExist(fs, dest) {
 		return true, nil
 	}
-	d, err := FileStat(fs, dest)
+	d, err := fileMeta(fs, dest)
 	if err != nil {
 		return true, err
 	}
-	s, err := FileStat(fs, src)
+	s, err := fileMeta(fs, src)
 	if err != nil {
 		return true, err
 	}
+	// Files of different sizes can't hold the same bytes, spare hashing
+	// them.
+	if d.Size == s.Size {
+		if d.Md5, err = hashFile(fs, dest); err != nil {
+			return true, err
+		}
+		if s.Md5, err = hashFile(fs, src); err != nil {
+			return true, err
+		}
+	}
+	if opts.Mode != nil {
+		s.Mode = *opts.Mode
+	}
 	if d.Uid != s.Uid {
-		log.Info(fmt.Sprintf("%s has UID %d should be %d", dest, d.Uid, s.Uid))
+		log.Info(fmt.Sprintf("%s has UID %d should be %d", name, d.Uid, s.Uid))
 	}
 	if d.Gid != s.Gid {
-		log.Info(fmt.Sprintf("%s has GID %d should be %d", dest, d.Gid, s.Gid))
+		log.Info(fmt.Sprintf("%s has GID %d should be %d", name, d.Gid, s.Gid))
 	}
 	if d.Mode != s.Mode {
-		log.Info(fmt.Sprintf("%s has mode %s should be %s", dest, os.FileMode(d.Mode), os.FileMode(s.Mode)))
+		log.Info(fmt.Sprintf("%s has mode %s should be %s", name, os.FileMode(d.Mode), os.FileMode(s.Mode)))
+	}
+	sameContents := d.Size == s.Size && d.Md5 == s.Md5
+	if !sameContents && opts.Equal != nil {
+		sameContents, err = contentsEqual(fs, src, dest, opts.Equal)
+		if err != nil {
+			return true, err
+		}
+		if sameContents {
+			log.Debug(fmt.Sprintf("%s differs but holds the same config", name))
+		}
 	}
-	if d.Md5 != s.Md5 {
-		log.Info(fmt.Sprintf("%s has md5sum %s should be %s", dest, d.Md5, s.Md5))
+	if !sameContents && d.Size != s.Size {
+		log.Info(fmt.Sprintf("%s has size %d should be %d", name, d.Size, s.Size))
+	} else if !sameContents {
+		log.Info(fmt.Sprintf("%s has md5sum %s should be %s", name, d.Md5, s.Md5))
 	}
-	if d.Uid != s.Uid || d.Gid != s.Gid || d.Mode != s.Mode || d.Md5 != s.Md5 {
+	if d.Uid != s.Uid || d.Gid != s.Gid || d.Mode != s.Mode || !sameContents {
 		return true, nil
 	}
 	return false, nil
 }
 
+// hashFile returns the hex md5sum of the named file. It is a variable so
+// that tests can count the files hashed.
+var hashFile = func(fs afero.Fs, name string) (string, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// contentsEqual reads src and dest and reports whether equal holds for them.
+func contentsEqual(fs afero.Fs, src, dest string, equal func(a, b []byte) bool) (bool, error) {
+	a, err := afero.ReadFile(fs, src)
+	if err != nil {
+		return false, err
+	}
+	b, err := afero.ReadFile(fs, dest)
+	if err != nil {
+		return false, err
+	}
+	return equal(a, b), nil
+}
+
 func IsDirectory(path string) (bool, error) {
 	f, err := os.Stat(path)
 	if err != nil {
@@ -154,3 +229,36 @@ func recursiveLookup(root string, pattern string, dirsLookup bool) ([]string, er
 	}
 	return result, nil
 }
+
+// NodeWalk recursively descends nodes, updating vars with the flattened
+// key/value pairs found under key.
+func NodeWalk(node interface{}, key string, vars map[string]string) error {
+	switch node.(type) {
+	case []interface{}:
+		for i, j := range node.([]interface{}) {
+			key := path.Join(key, strconv.Itoa(i))
+			NodeWalk(j, key, vars)
+		}
+	case map[interface{}]interface{}:
+		for k, v := range node.(map[interface{}]interface{}) {
+			key := path.Join(key, k.(string))
+			NodeWalk(v, key, vars)
+		}
+	case map[string]interface{}:
+		for k, v := range node.(map[string]interface{}) {
+			key := path.Join(key, k)
+			NodeWalk(v, key, vars)
+		}
+	case string:
+		vars[key] = node.(string)
+	case int:
+		vars[key] = strconv.Itoa(node.(int))
+	case int64:
+		vars[key] = strconv.FormatInt(node.(int64), 10)
+	case bool:
+		vars[key] = strconv.FormatBool(node.(bool))
+	case float64:
+		vars[key] = strconv.FormatFloat(node.(float64), 'f', -1, 64)
+	}
+	return nil
+}
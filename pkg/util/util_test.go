@@ -204,7 +204,7 @@ func TestIsConfigChangedTrue(t *testing.T) {
 	if err != nil {
 		t.Errorf(err.Error())
 	}
-	status, err := IsConfigChanged(fs, src.Name(), dest.Name())
+	status, err := IsConfigChanged(fs, src.Name(), dest.Name(), ConfigCompare{})
 	if err != nil {
 		t.Errorf(err.Error())
 	}
@@ -234,7 +234,7 @@ func TestIsConfigChangedFalse(t *testing.T) {
 	if err != nil {
 		t.Errorf(err.Error())
 	}
-	status, err := IsConfigChanged(fs, src.Name(), dest.Name())
+	status, err := IsConfigChanged(fs, src.Name(), dest.Name(), ConfigCompare{})
 	if err != nil {
 		t.Errorf(err.Error())
 	}
@@ -242,3 +242,96 @@ func TestIsConfigChangedFalse(t *testing.T) {
 		t.Errorf("Expected sameConfig(src, dest) to be %v, got %v", false, status)
 	}
 }
+
+func TestIsConfigChangedCompare(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs() // posix stats doesn't support memMapFs
+	dir, err := afero.TempDir(fs, "", "compare")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fs.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dest := filepath.Join(dir, "dest")
+	if err := afero.WriteFile(fs, src, []byte("A"), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := afero.WriteFile(fs, dest, []byte("a"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := fs.Chmod(dest, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	destMode, srcMode := os.FileMode(0644), os.FileMode(0600)
+	same := func(a, b []byte) bool { return true }
+	different := func(a, b []byte) bool { return false }
+	for _, tt := range []struct {
+		desc    string
+		opts    ConfigCompare
+		changed bool
+	}{
+		{"src mode and contents", ConfigCompare{}, true},
+		{"equal contents", ConfigCompare{Mode: &destMode, Equal: same}, false},
+		{"different contents", ConfigCompare{Mode: &destMode, Equal: different}, true},
+		{"equal contents, other mode", ConfigCompare{Mode: &srcMode, Equal: same}, true},
+		{"logged name", ConfigCompare{Mode: &destMode, Equal: same, Name: "<redacted>"}, false},
+	} {
+		status, err := IsConfigChanged(fs, src, dest, tt.opts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if status != tt.changed {
+			t.Errorf("%s: expected IsConfigChanged to be %v, got %v", tt.desc, tt.changed, status)
+		}
+	}
+}
+
+func TestIsConfigChangedSizeCheck(t *testing.T) {
+	log.SetLevel("warn")
+	fs := afero.NewOsFs() // posix stats doesn't support memMapFs
+	hashed := 0
+	defer func(h func(afero.Fs, string) (string, error)) { hashFile = h }(hashFile)
+	hash := hashFile
+	hashFile = func(fs afero.Fs, name string) (string, error) {
+		hashed++
+		return hash(fs, name)
+	}
+
+	for _, tt := range []struct {
+		desc    string
+		src     string
+		dest    string
+		changed bool
+		hashed  int
+	}{
+		{"same contents", "foo", "foo", false, 2},
+		{"same size, different contents", "foo", "bar", true, 2},
+		{"different size", "foo", "foobar", true, 0},
+	} {
+		dir, err := afero.TempDir(fs, "", "size")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer fs.RemoveAll(dir)
+		src := filepath.Join(dir, "src")
+		dest := filepath.Join(dir, "dest")
+		if err := afero.WriteFile(fs, src, []byte(tt.src), 0600); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := afero.WriteFile(fs, dest, []byte(tt.dest), 0600); err != nil {
+			t.Fatal(err.Error())
+		}
+		hashed = 0
+		status, err := IsConfigChanged(fs, src, dest, ConfigCompare{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if status != tt.changed {
+			t.Errorf("%s: expected IsConfigChanged to be %v, got %v", tt.desc, tt.changed, status)
+		}
+		if hashed != tt.hashed {
+			t.Errorf("%s: expected %d files hashed, got %d", tt.desc, tt.hashed, hashed)
+		}
+	}
+}